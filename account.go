@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// timestamp used in configuration, either as a TOML datetime or as a string in RFC 3339 format.
+// A date alone (YYYY-MM-DD) refers to the end of that day, local time.
+type timestamp struct {
+	time.Time
+}
+
+func (t *timestamp) UnmarshalText(text []byte) (err error) {
+	if d, err := time.ParseInLocation("2006-01-02", string(text), time.Local); err == nil {
+		t.Time = d.AddDate(0, 0, 1)
+		return nil
+	}
+	t.Time, err = time.Parse(time.RFC3339, string(text))
+	return err
+}
+
+// ScheduleWindow window of time in which logins are allowed on some days of the week, like "mon-fri 08:00-18:00".
+// Windows ending before they start span midnight.
+type ScheduleWindow struct {
+	days  [7]bool
+	start int
+	end   int
+}
+
+func parseWeekdays(spec string) ([7]bool, error) {
+	var days [7]bool
+	for _, r := range strings.Split(spec, ",") {
+		bounds := strings.SplitN(r, "-", 2)
+		first, ok := weekdays[strings.ToLower(bounds[0])]
+		if !ok {
+			return days, fmt.Errorf("unknown day of the week: %s", bounds[0])
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, ok = weekdays[strings.ToLower(bounds[1])]
+			if !ok {
+				return days, fmt.Errorf("unknown day of the week: %s", bounds[1])
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// parseMinuteOfDay parses a time of the day (HH:MM) into minutes since midnight
+func parseMinuteOfDay(s string) (int, error) {
+	hm := strings.SplitN(s, ":", 2)
+	if len(hm) != 2 {
+		return 0, fmt.Errorf("invalid time of the day: %s", s)
+	}
+	h, err := strconv.Atoi(hm[0])
+	if err != nil || h < 0 || h > 24 {
+		return 0, fmt.Errorf("invalid time of the day: %s", s)
+	}
+	m, err := strconv.Atoi(hm[1])
+	if err != nil || m < 0 || m > 59 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("invalid time of the day: %s", s)
+	}
+	return h*60 + m, nil
+}
+
+// ParseScheduleWindow parses a schedule window like "mon-fri 08:00-18:00" or "sat,sun 10:00-14:00"
+func ParseScheduleWindow(spec string) (*ScheduleWindow, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("invalid schedule window: %s", spec)
+	}
+	days, err := parseWeekdays(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid schedule window: %s: %s", spec, err)
+	}
+	times := strings.SplitN(fields[1], "-", 2)
+	if len(times) != 2 {
+		return nil, fmt.Errorf("invalid schedule window: %s", spec)
+	}
+	w := &ScheduleWindow{days: days}
+	if w.start, err = parseMinuteOfDay(times[0]); err != nil {
+		return nil, fmt.Errorf("invalid schedule window: %s: %s", spec, err)
+	}
+	if w.end, err = parseMinuteOfDay(times[1]); err != nil {
+		return nil, fmt.Errorf("invalid schedule window: %s: %s", spec, err)
+	}
+	return w, nil
+}
+
+// Contains checks whether the time passed as parameter falls in the window
+func (w *ScheduleWindow) Contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	d := t.Weekday()
+	if w.start < w.end {
+		return w.days[d] && m >= w.start && m < w.end
+	}
+	// the window spans midnight
+	return (w.days[d] && m >= w.start) || (w.days[(d+6)%7] && m < w.end)
+}
+
+// Schedule weekly schedule of the windows logins are allowed in
+type Schedule struct {
+	Windows  []*ScheduleWindow
+	Location *time.Location
+}
+
+// ParseSchedule parses a list of schedule windows evaluated in the time zone passed as parameter (local time if empty)
+func ParseSchedule(specs []string, timezone string) (*Schedule, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	s := &Schedule{Location: time.Local}
+	if timezone != "" {
+		var err error
+		s.Location, err = time.LoadLocation(timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule time zone: %s", timezone)
+		}
+	}
+	for _, spec := range specs {
+		w, err := ParseScheduleWindow(spec)
+		if err != nil {
+			return nil, err
+		}
+		s.Windows = append(s.Windows, w)
+	}
+	return s, nil
+}
+
+// Allows checks whether the time passed as parameter falls in any window of the schedule
+func (s *Schedule) Allows(t time.Time) bool {
+	t = t.In(s.Location)
+	for _, w := range s.Windows {
+		if w.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// AccountPolicy restrictions on when an account may log in
+type AccountPolicy struct {
+	// ExpiresAt time from which the account may no longer log in. Zero if it never expires.
+	ExpiresAt time.Time
+	Disabled  bool
+	// Schedule windows logins are allowed in. Nil if logins are allowed at any time.
+	Schedule *Schedule
+}
+
+// Check returns an error if the account may not log in at the time passed as parameter
+func (p *AccountPolicy) Check(now time.Time) error {
+	if err := p.CheckSession(now); err != nil {
+		return err
+	}
+	if p.Schedule != nil && !p.Schedule.Allows(now) {
+		return fmt.Errorf("logins not allowed at %s as per schedule", now)
+	}
+	return nil
+}
+
+// CheckSession returns an error if the sessions of the account may not go on at the time passed as parameter.
+// Unlike logins, sessions are not restricted by the schedule.
+func (p *AccountPolicy) CheckSession(now time.Time) error {
+	if p.Disabled {
+		return fmt.Errorf("account disabled")
+	}
+	if !p.ExpiresAt.IsZero() && !now.Before(p.ExpiresAt) {
+		return fmt.Errorf("account expired at %s", p.ExpiresAt)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScheduleAllows(t *testing.T) {
+	s, err := ParseSchedule([]string{"mon-fri 08:00-18:00", "sat 22:00-02:00"}, "Europe/Madrid")
+	assert.NoError(t, err)
+	madrid, _ := time.LoadLocation("Europe/Madrid")
+	tests := []struct {
+		t        time.Time
+		expected bool
+	}{
+		{time.Date(2020, 1, 6, 8, 0, 0, 0, madrid), true},    // monday
+		{time.Date(2020, 1, 6, 7, 59, 0, 0, madrid), false},  // monday
+		{time.Date(2020, 1, 10, 17, 59, 0, 0, madrid), true}, // friday
+		{time.Date(2020, 1, 10, 18, 0, 0, 0, madrid), false}, // friday
+		{time.Date(2020, 1, 11, 12, 0, 0, 0, madrid), false}, // saturday
+		{time.Date(2020, 1, 11, 23, 0, 0, 0, madrid), true},  // saturday
+		{time.Date(2020, 1, 12, 1, 0, 0, 0, madrid), true},   // sunday
+		{time.Date(2020, 1, 12, 2, 0, 0, 0, madrid), false},  // sunday
+		{time.Date(2020, 1, 6, 7, 30, 0, 0, time.UTC), true}, // monday, 08:30 in Madrid
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, s.Allows(test.t), test.t.String())
+	}
+
+	s, err = ParseSchedule([]string{"fri-mon 00:00-24:00"}, "UTC")
+	assert.NoError(t, err)
+	assert.True(t, s.Allows(time.Date(2020, 1, 5, 12, 0, 0, 0, time.UTC)))  // sunday
+	assert.False(t, s.Allows(time.Date(2020, 1, 7, 12, 0, 0, 0, time.UTC))) // tuesday
+
+	for _, spec := range []string{"mon", "mon 08:00", "funday 08:00-18:00", "mon-fri 08:00-25:00", "mon 8-18"} {
+		_, err = ParseScheduleWindow(spec)
+		assert.Error(t, err, spec)
+	}
+	_, err = ParseSchedule([]string{"mon 08:00-18:00"}, "Nowhere/Nowhere")
+	assert.Error(t, err)
+}
+
+func TestAccountPolicyCheck(t *testing.T) {
+	now := time.Date(2020, 1, 6, 12, 0, 0, 0, time.UTC)
+	assert.NoError(t, (&AccountPolicy{}).Check(now))
+	assert.Error(t, (&AccountPolicy{Disabled: true}).Check(now))
+	assert.NoError(t, (&AccountPolicy{ExpiresAt: now.Add(time.Second)}).Check(now))
+	assert.Error(t, (&AccountPolicy{ExpiresAt: now}).Check(now))
+	s, err := ParseSchedule([]string{"sat,sun 00:00-24:00"}, "UTC")
+	assert.NoError(t, err)
+	assert.Error(t, (&AccountPolicy{Schedule: s}).Check(now))
+	// sessions are not restricted by the schedule
+	assert.NoError(t, (&AccountPolicy{Schedule: s}).CheckSession(now))
+	assert.Error(t, (&AccountPolicy{Disabled: true}).CheckSession(now))
+	assert.Error(t, (&AccountPolicy{ExpiresAt: now}).CheckSession(now))
+}
+
+func TestAuthUserExpiresAt(t *testing.T) {
+	content := userDBFileContent{}
+	_, err := toml.Decode(`
+[users.user1]
+expires_at = 2020-01-06T12:00:00Z
+[users.user2]
+expires_at = "2020-01-06T12:00:00+01:00"
+[users.user3]
+expires_at = "2020-01-06"
+`, &content)
+	assert.NoError(t, err)
+	assert.True(t, time.Date(2020, 1, 6, 12, 0, 0, 0, time.UTC).Equal(content.Users["user1"].ExpiresAt.Time))
+	assert.True(t, time.Date(2020, 1, 6, 11, 0, 0, 0, time.UTC).Equal(content.Users["user2"].ExpiresAt.Time))
+	// dates alone include the whole day
+	assert.True(t, time.Date(2020, 1, 7, 0, 0, 0, 0, time.Local).Equal(content.Users["user3"].ExpiresAt.Time))
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Operations controlled by access rules
+const (
+	ACLOpRead   = "read"
+	ACLOpWrite  = "write"
+	ACLOpList   = "list"
+	ACLOpDelete = "delete"
+)
+
+var aclOps = map[string][]string{
+	ACLOpRead:   {ACLOpRead},
+	ACLOpWrite:  {ACLOpWrite},
+	ACLOpList:   {ACLOpList},
+	ACLOpDelete: {ACLOpDelete},
+	"all":       {ACLOpRead, ACLOpWrite, ACLOpList, ACLOpDelete},
+}
+
+// ACLRule access rule allowing or denying operations over the paths matching a glob pattern,
+// written as `allow write "inbox/**"` or `deny read,list "*.tmp"`
+type ACLRule struct {
+	Allow   bool
+	Ops     []string
+	Pattern string
+	text    string
+	pattern Path
+}
+
+// ParseACLRule parses an access rule
+func ParseACLRule(text string) (*ACLRule, error) {
+	fields := strings.Fields(text)
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("invalid access rule: %s", text)
+	}
+	// the pattern may contain spaces when quoted
+	pattern := strings.TrimSpace(strings.TrimSpace(text)[len(fields[0]):])
+	pattern = strings.TrimSpace(pattern[len(fields[1]):])
+	r := &ACLRule{text: text}
+	switch fields[0] {
+	case "allow":
+		r.Allow = true
+	case "deny":
+		r.Allow = false
+	default:
+		return nil, fmt.Errorf(`invalid access rule: %s: expected "allow" or "deny"`, text)
+	}
+	for _, op := range strings.Split(fields[1], ",") {
+		ops, ok := aclOps[op]
+		if !ok {
+			return nil, fmt.Errorf("invalid access rule: %s: unknown operation %s", text, op)
+		}
+		r.Ops = append(r.Ops, ops...)
+	}
+	r.Pattern = pattern
+	if strings.HasPrefix(r.Pattern, `"`) {
+		var err error
+		r.Pattern, err = strconv.Unquote(r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid access rule: %s: malformed pattern", text)
+		}
+	}
+	r.pattern = SplitIntoPath(strings.TrimPrefix(r.Pattern, "/"))
+	if strings.HasSuffix(r.Pattern, "/") {
+		// a directory pattern matches the directory itself and everything below
+		r.pattern = append(r.pattern, "**")
+	}
+	for _, c := range r.pattern {
+		if _, err := path.Match(c, ""); err != nil {
+			return nil, fmt.Errorf("invalid access rule: %s: malformed pattern", text)
+		}
+	}
+	return r, nil
+}
+
+// String returns the rule as written in configuration
+func (r *ACLRule) String() string {
+	return r.text
+}
+
+func matchPathPattern(pattern Path, p Path) bool {
+	if len(pattern) == 0 {
+		return len(p) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(p); i++ {
+			if matchPathPattern(pattern[1:], p[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(p) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], p[0]); !ok {
+		return false
+	}
+	return matchPathPattern(pattern[1:], p[1:])
+}
+
+// Match checks whether the rule applies to an operation over a path relative to the user root.
+// Patterns with no slash are matched against the base name, at any depth.
+func (r *ACLRule) Match(op string, p Path) bool {
+	found := false
+	for _, _op := range r.Ops {
+		if _op == op {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false
+	}
+	if len(r.pattern) == 1 {
+		return len(p) > 0 && matchPathPattern(r.pattern, p[len(p)-1:])
+	}
+	return matchPathPattern(r.pattern, p)
+}
+
+// ACL ordered list of access rules
+type ACL []*ACLRule
+
+// ParseACL parses a list of access rules
+func ParseACL(texts []string) (ACL, error) {
+	acl := ACL{}
+	for _, text := range texts {
+		r, err := ParseACLRule(text)
+		if err != nil {
+			return nil, err
+		}
+		acl = append(acl, r)
+	}
+	return acl, nil
+}
+
+// Check checks an operation over a path relative to the user root. The first matching rule decides
+// and is returned; operations matching no rule are allowed.
+func (acl ACL) Check(op string, p Path) (bool, *ACLRule) {
+	for _, r := range acl {
+		if r.Match(op, p) {
+			return r.Allow, r
+		}
+	}
+	return true, nil
+}
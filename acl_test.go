@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	fake_log "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseACLRule(t *testing.T) {
+	r, err := ParseACLRule(`allow write,list "inbox/"`)
+	assert.NoError(t, err)
+	assert.True(t, r.Allow)
+	assert.Equal(t, []string{ACLOpWrite, ACLOpList}, r.Ops)
+	assert.Equal(t, Path{"inbox", "**"}, r.pattern)
+
+	r, err = ParseACLRule(`deny all "my files/*.tmp"`)
+	assert.NoError(t, err)
+	assert.False(t, r.Allow)
+	assert.Equal(t, []string{ACLOpRead, ACLOpWrite, ACLOpList, ACLOpDelete}, r.Ops)
+	assert.Equal(t, Path{"my files", "*.tmp"}, r.pattern)
+
+	for _, text := range []string{"", "allow write", `grant read "*"`, `allow rename "*"`, `deny read "[a"`, `deny read "*`} {
+		_, err = ParseACLRule(text)
+		assert.Error(t, err, text)
+	}
+}
+
+func TestACLCheck(t *testing.T) {
+	acl, err := ParseACL([]string{
+		`deny all "*.tmp"`,
+		`allow write,list "inbox/"`,
+		`allow read "/outbox/**/*.csv"`,
+		`deny write,read "**"`,
+	})
+	assert.NoError(t, err)
+
+	cases := []struct {
+		op      string
+		path    string
+		allowed bool
+	}{
+		{ACLOpWrite, "inbox", true},
+		{ACLOpWrite, "inbox/a/b.csv", true},
+		{ACLOpWrite, "inbox/a/b.tmp", false},
+		{ACLOpRead, "file.tmp", false},
+		{ACLOpRead, "inbox/a.csv", false},
+		{ACLOpRead, "outbox/a.csv", true},
+		{ACLOpRead, "outbox/2020/01/a.csv", true},
+		{ACLOpRead, "outbox/a.txt", false},
+		{ACLOpWrite, "outbox/a.csv", false},
+		{ACLOpList, "outbox", true},
+		{ACLOpDelete, "inbox/a.csv", true},
+	}
+	for _, c := range cases {
+		allowed, _ := acl.Check(c.op, SplitIntoPath(c.path))
+		assert.Equal(t, c.allowed, allowed, "%s %s", c.op, c.path)
+	}
+	_, rule := acl.Check(ACLOpRead, SplitIntoPath("file.tmp"))
+	assert.Equal(t, `deny all "*.tmp"`, rule.String())
+}
+
+func TestS3BucketIOACL(t *testing.T) {
+	log, _ := fake_log.NewNullLogger()
+	bucketACL, err := ParseACL([]string{`deny write "**"`})
+	assert.NoError(t, err)
+	userACL, err := ParseACL([]string{`allow write "inbox/"`})
+	assert.NoError(t, err)
+	bucket := &S3Bucket{
+		Name:   "test",
+		Bucket: "test",
+		Perms:  Perms{Readable: true, Writable: true, Listable: true, Deletable: true},
+		ACL:    bucketACL,
+	}
+	userInfo := &UserInfo{User: "user1", ACL: userACL}
+	s3io, err := NewS3BucketIO(context.Background(), bucket, userInfo, S3BucketIOOptions{}, log)
+	assert.NoError(t, err)
+
+	_, err = s3io.Filewrite(sftp.NewRequest("Put", "/file"))
+	assert.Error(t, err)
+	assert.Error(t, s3io.Filecmd(sftp.NewRequest("Mkdir", "/dir")))
+
+	// user rules are evaluated before the bucket ones
+	s3io.PhantomObjectMap.Add(&PhantomObjectInfo{Key: s3io.buildKey("/inbox/uploading"), LastModified: time.Now()})
+	req := sftp.NewRequest("Rename", "/inbox/uploading")
+	req.Target = "/inbox/uploaded"
+	assert.NoError(t, s3io.Filecmd(req))
+	req = sftp.NewRequest("Rename", "/inbox/uploaded")
+	req.Target = "/uploaded"
+	assert.Error(t, s3io.Filecmd(req))
+}
+
+func TestS3BucketIORenameUnreadable(t *testing.T) {
+	log, _ := fake_log.NewNullLogger()
+	bucketACL, err := ParseACL([]string{`deny read "*.tmp"`})
+	assert.NoError(t, err)
+	bucket := &S3Bucket{
+		Name:   "test",
+		Bucket: "test",
+		Perms:  Perms{Readable: true, Writable: true, Listable: true, Deletable: true},
+		ACL:    bucketACL,
+	}
+	s3io, err := NewS3BucketIO(context.Background(), bucket, &UserInfo{User: "user1"}, S3BucketIOOptions{}, log)
+	assert.NoError(t, err)
+
+	s3io.PhantomObjectMap.Add(&PhantomObjectInfo{Key: s3io.buildKey("/x.tmp"), LastModified: time.Now()})
+	s3io.PhantomObjectMap.Add(&PhantomObjectInfo{Key: s3io.buildKey("/y.csv"), LastModified: time.Now()})
+	// files that may not be read may not be renamed so that they can
+	req := sftp.NewRequest("Rename", "/x.tmp")
+	req.Target = "/x.dat"
+	assert.Error(t, s3io.Filecmd(req))
+	assert.NotNil(t, s3io.PhantomObjectMap.Get(s3io.buildKey("/x.tmp")))
+	req = sftp.NewRequest("Rename", "/y.csv")
+	req.Target = "/y.dat"
+	assert.NoError(t, s3io.Filecmd(req))
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// AddrFilter source address allow and deny lists in CIDR notation
+type AddrFilter struct {
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+}
+
+// parseCIDRList parses a list of networks in CIDR notation. Bare addresses are taken as single-address networks.
+func parseCIDRList(cidrs []string) ([]*net.IPNet, error) {
+	var retval []*net.IPNet
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address: %s", cidr)
+			}
+			if ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR: %s", cidr)
+		}
+		retval = append(retval, ipNet)
+	}
+	return retval, nil
+}
+
+// NewAddrFilter creates a source address filter from allow and deny lists
+func NewAddrFilter(allow []string, deny []string) (*AddrFilter, error) {
+	f := &AddrFilter{}
+	var err error
+	f.Allow, err = parseCIDRList(allow)
+	if err != nil {
+		return nil, fmt.Errorf("allow_from: %s", err)
+	}
+	f.Deny, err = parseCIDRList(deny)
+	if err != nil {
+		return nil, fmt.Errorf("deny_from: %s", err)
+	}
+	return f, nil
+}
+
+// Check checks an address against the lists. Addresses matching any deny entry are refused, and so are the ones
+// matching no allow entry if the allow list is not empty. The rule refusing the address is returned along with the result.
+func (f *AddrFilter) Check(addr net.Addr) (bool, string) {
+	if f == nil || (len(f.Allow) == 0 && len(f.Deny) == 0) {
+		return true, ""
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false, fmt.Sprintf("unknown address type %s", addr.Network())
+	}
+	for _, ipNet := range f.Deny {
+		if ipNet.Contains(tcpAddr.IP) {
+			return false, "deny_from " + ipNet.String()
+		}
+	}
+	if len(f.Allow) == 0 {
+		return true, ""
+	}
+	for _, ipNet := range f.Allow {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true, ""
+		}
+	}
+	return false, "allow_from (no match)"
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	fake_log "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddrFilterCheck(t *testing.T) {
+	f, err := NewAddrFilter([]string{"192.0.2.0/24", "2001:db8::1"}, []string{"192.0.2.128/25"})
+	assert.NoError(t, err)
+	tests := []struct {
+		ip       net.IP
+		expected bool
+		rule     string
+	}{
+		{net.ParseIP("192.0.2.1"), true, ""},
+		{net.ParseIP("192.0.2.200"), false, "deny_from 192.0.2.128/25"},
+		{net.ParseIP("198.51.100.1"), false, "allow_from (no match)"},
+		{net.ParseIP("2001:db8::1"), true, ""},
+		{net.ParseIP("2001:db8::2"), false, "allow_from (no match)"},
+	}
+	for _, test := range tests {
+		ok, rule := f.Check(&net.TCPAddr{IP: test.ip, Port: 50000})
+		assert.Equal(t, test.expected, ok, test.ip.String())
+		assert.Equal(t, test.rule, rule, test.ip.String())
+	}
+
+	f, err = NewAddrFilter(nil, []string{"10.0.0.0/8"})
+	assert.NoError(t, err)
+	ok, _ := f.Check(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")})
+	assert.True(t, ok)
+	ok, _ = (*AddrFilter)(nil).Check(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")})
+	assert.True(t, ok)
+
+	_, err = NewAddrFilter([]string{"192.0.2.0/33"}, nil)
+	assert.Error(t, err)
+	_, err = NewAddrFilter(nil, []string{"example.com"})
+	assert.Error(t, err)
+}
+
+func TestLookupLoginUserSourceAddress(t *testing.T) {
+	log, hook := fake_log.NewNullLogger()
+	us := &UserStore{Name: "test", usersMap: map[string]User{}}
+	userFilter, err := NewAddrFilter([]string{"192.0.2.0/24"}, nil)
+	assert.NoError(t, err)
+	us.Add(&UserPlainTextPassword{UserWithPassword{name: "user1", password: "test", addrFilter: userFilter}})
+	bucketFilter, err := NewAddrFilter(nil, []string{"192.0.2.66"})
+	assert.NoError(t, err)
+	buckets := &S3Buckets{
+		Buckets:     map[string]*S3Bucket{"test": &S3Bucket{Name: "test", Users: us, AddrFilter: bucketFilter}},
+		bucketNames: []string{"test"},
+	}
+
+	_, u, err := lookupLoginUser(buckets, &fakeConnMetadata{user: "user1", addr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1)}}, log)
+	assert.NoError(t, err)
+	assert.Equal(t, "user1", u.GetName())
+
+	_, _, err = lookupLoginUser(buckets, &fakeConnMetadata{user: "user1", addr: &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1)}}, log)
+	assert.Error(t, err)
+	assert.Equal(t, "user", hook.LastEntry().Data["scope"])
+
+	_, _, err = lookupLoginUser(buckets, &fakeConnMetadata{user: "user1", addr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 66)}}, log)
+	assert.Error(t, err)
+	assert.Equal(t, "bucket test", hook.LastEntry().Data["scope"])
+	assert.Equal(t, "deny_from 192.0.2.66/32", hook.LastEntry().Data["rule"])
+}
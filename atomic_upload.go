@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	aws "github.com/aws/aws-sdk-go/aws"
+	aws_s3 "github.com/aws/aws-sdk-go/service/s3"
+)
+
+// checksumMetadataKey user metadata the SHA-256 checksum of objects uploaded through a staging key is stored in
+const checksumMetadataKey = "sha256"
+
+// s3CopyPartSize size of the parts objects larger than it are copied in
+var s3CopyPartSize = int64(s3MaxPartSize)
+
+// newStagingKey returns a new random key under the staging prefix passed as parameter
+func newStagingKey(prefix Path) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	// random UUID as per RFC 4122
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	id := fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+	return prefix.Join(Path{id}).String(), nil
+}
+
+// uploadKey returns the key the object is uploaded to
+func (u *S3MultipartUploadWriter) uploadKey() string {
+	if u.StagingKey != "" {
+		return u.StagingKey
+	}
+	return u.Info.GetOne().Key.String()
+}
+
+// hashPart adds the content of a part to the checksum of the object, if it directly follows the data hashed so
+// far. Parts are usually filled in order; when they aren't, the checksum is computed from the uploaded object
+// once it's complete.
+func (u *S3MultipartUploadWriter) hashPart(part *S3PartToUpload) {
+	if u.StagingKey == "" {
+		return
+	}
+	u.checksumMtx.Lock()
+	defer u.checksumMtx.Unlock()
+	if part.offset == 0 && u.checksumOffset == 0 {
+		u.checksum = sha256.New()
+	}
+	if u.checksum == nil {
+		return
+	}
+	if part.offset != u.checksumOffset {
+		u.Log.WithField("partnumber", part.partNumber).Debug("Part filled out of order, the checksum is computed once the upload is complete")
+		u.checksum = nil
+		return
+	}
+	content, err := part.getContent()
+	if err == nil {
+		var n int64
+		n, err = io.Copy(u.checksum, content)
+		u.checksumOffset += n
+	}
+	if err != nil {
+		u.Log.WithField("exception", err).Warn("Error computing checksum")
+		u.checksum = nil
+	}
+}
+
+// objectChecksum returns the hex-encoded SHA-256 checksum of the object uploaded to the staging key
+func (u *S3MultipartUploadWriter) objectChecksum(size int64) (string, error) {
+	u.checksumMtx.Lock()
+	defer u.checksumMtx.Unlock()
+	if u.checksum != nil && u.checksumOffset == size {
+		return hex.EncodeToString(u.checksum.Sum(nil)), nil
+	}
+	u.Log.Debug("Reading uploaded object back to compute its checksum")
+	sse := u.ServerSideEncryption
+	goo, err := u.S3.GetObjectWithContext(
+		u.Ctx,
+		&aws_s3.GetObjectInput{
+			Bucket:               &u.Bucket,
+			Key:                  &u.StagingKey,
+			SSECustomerAlgorithm: nilIfEmpty(sse.CustomerAlgorithm()),
+			SSECustomerKey:       nilIfEmpty(sse.CustomerKey),
+			SSECustomerKeyMD5:    nilIfEmpty(sse.CustomerKeyMD5),
+		},
+	)
+	if err != nil {
+		return "", err
+	}
+	defer goo.Body.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, goo.Body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// commit copies the object uploaded to the staging key into place along with its checksum, then deletes it
+func (u *S3MultipartUploadWriter) commit() error {
+	// the upload is complete by now
+	u.multiPartUploadID = nil
+	info := u.Info.GetOne()
+	key := info.Key.String()
+	log := u.Log.WithField("stagingkey", u.StagingKey)
+	checksum, err := u.objectChecksum(info.Size)
+	if err == nil {
+		log.WithField("checksum", checksum).Debug("Committing upload")
+		err = u.s3CopyObject(u.StagingKey, key, info.Size, map[string]*string{checksumMetadataKey: &checksum})
+	}
+	if err != nil {
+		log.WithField("exception", err).Error("Error committing upload")
+	}
+	log.Debug("DeleteObject")
+	if _, derr := u.S3.DeleteObjectWithContext(u.Ctx, &aws_s3.DeleteObjectInput{Bucket: &u.Bucket, Key: &u.StagingKey}); derr != nil {
+		log.WithField("exception", derr).Error("Error deleting staged object")
+	}
+	return err
+}
+
+// s3CopyObject copies an object of the bucket with the metadata given. Objects larger than s3CopyPartSize are
+// copied part by part through a multipart upload.
+func (u *S3MultipartUploadWriter) s3CopyObject(src string, dest string, size int64, metadata map[string]*string) error {
+	copySource := u.Bucket + "/" + src
+	sse := u.ServerSideEncryption
+	if size <= s3CopyPartSize {
+		u.Log.Debugf("CopyObject(dest=%s, sse=%v)", dest, sse.Type)
+		_, err := u.S3.CopyObjectWithContext(
+			u.Ctx,
+			&aws_s3.CopyObjectInput{
+				ACL:                            &aclPrivate,
+				Bucket:                         &u.Bucket,
+				CopySource:                     &copySource,
+				Key:                            &dest,
+				Metadata:                       metadata,
+				MetadataDirective:              aws.String(aws_s3.MetadataDirectiveReplace),
+				ServerSideEncryption:           sseTypes[sse.Type],
+				SSECustomerAlgorithm:           nilIfEmpty(sse.CustomerAlgorithm()),
+				SSECustomerKey:                 nilIfEmpty(sse.CustomerKey),
+				SSECustomerKeyMD5:              nilIfEmpty(sse.CustomerKeyMD5),
+				SSEKMSKeyId:                    nilIfEmpty(sse.KMSKeyID),
+				CopySourceSSECustomerAlgorithm: nilIfEmpty(sse.CustomerAlgorithm()),
+				CopySourceSSECustomerKey:       nilIfEmpty(sse.CustomerKey),
+				CopySourceSSECustomerKeyMD5:    nilIfEmpty(sse.CustomerKeyMD5),
+			},
+		)
+		return err
+	}
+
+	u.Log.Debugf("CreateMultipartUpload(dest=%s, sse=%v)", dest, sse.Type)
+	resp, err := u.S3.CreateMultipartUploadWithContext(
+		u.Ctx,
+		&aws_s3.CreateMultipartUploadInput{
+			ACL:                  &aclPrivate,
+			Bucket:               &u.Bucket,
+			Key:                  &dest,
+			Metadata:             metadata,
+			ServerSideEncryption: sseTypes[sse.Type],
+			SSECustomerAlgorithm: nilIfEmpty(sse.CustomerAlgorithm()),
+			SSECustomerKey:       nilIfEmpty(sse.CustomerKey),
+			SSECustomerKeyMD5:    nilIfEmpty(sse.CustomerKeyMD5),
+			SSEKMSKeyId:          nilIfEmpty(sse.KMSKeyID),
+		},
+	)
+	if err != nil {
+		return err
+	}
+	log := u.Log.WithField("uploadid", *resp.UploadId)
+	var parts []*aws_s3.CompletedPart
+	for off := int64(0); off < size && err == nil; off += s3CopyPartSize {
+		end := off + s3CopyPartSize
+		if end > size {
+			end = size
+		}
+		partNumber := int64(len(parts) + 1)
+		log.WithField("partnumber", partNumber).Debug("UploadPartCopy")
+		var upco *aws_s3.UploadPartCopyOutput
+		upco, err = u.S3.UploadPartCopyWithContext(
+			u.Ctx,
+			&aws_s3.UploadPartCopyInput{
+				Bucket:                         &u.Bucket,
+				CopySource:                     &copySource,
+				CopySourceRange:                aws.String(fmt.Sprintf("bytes=%d-%d", off, end-1)),
+				Key:                            &dest,
+				PartNumber:                     &partNumber,
+				UploadId:                       resp.UploadId,
+				SSECustomerAlgorithm:           nilIfEmpty(sse.CustomerAlgorithm()),
+				SSECustomerKey:                 nilIfEmpty(sse.CustomerKey),
+				SSECustomerKeyMD5:              nilIfEmpty(sse.CustomerKeyMD5),
+				CopySourceSSECustomerAlgorithm: nilIfEmpty(sse.CustomerAlgorithm()),
+				CopySourceSSECustomerKey:       nilIfEmpty(sse.CustomerKey),
+				CopySourceSSECustomerKeyMD5:    nilIfEmpty(sse.CustomerKeyMD5),
+			},
+		)
+		if err == nil {
+			parts = append(parts, &aws_s3.CompletedPart{ETag: upco.CopyPartResult.ETag, PartNumber: &partNumber})
+		}
+	}
+	if err == nil {
+		log.Debug("CompleteMultipartUpload")
+		_, err = u.S3.CompleteMultipartUploadWithContext(
+			u.Ctx,
+			&aws_s3.CompleteMultipartUploadInput{
+				Bucket:          &u.Bucket,
+				Key:             &dest,
+				UploadId:        resp.UploadId,
+				MultipartUpload: &aws_s3.CompletedMultipartUpload{Parts: parts},
+			},
+		)
+	}
+	if err != nil {
+		log.WithField("exception", err).Error("Error copying object")
+		if _, aerr := u.S3.AbortMultipartUploadWithContext(u.Ctx, &aws_s3.AbortMultipartUploadInput{Bucket: &u.Bucket, Key: &dest, UploadId: resp.UploadId}); aerr != nil {
+			log.WithField("exception", aerr).Error("Error aborting multipart upload")
+		}
+	}
+	return err
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+var expiryTimeFormats = []string{"20060102", "200601021504", "20060102150405"}
+
+// AuthorizedKey public key authorized to authenticate a user, along with the restrictions
+// given by the options present on its authorized_keys line
+type AuthorizedKey struct {
+	ssh.PublicKey
+	// From source address patterns the key may be used from (from="...")
+	From []string
+	// ExpiryTime time after which the key is no longer valid (expiry-time="..."). Zero if it never expires.
+	ExpiryTime time.Time
+	// PermsOverride permissions overridden when the key is used (read-only and write-only)
+	PermsOverride PermsOverride
+}
+
+func unquoteAuthorizedKeyOptionValue(v string) string {
+	if len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' {
+		v = strings.Replace(v[1:len(v)-1], `\"`, `"`, -1)
+	}
+	return v
+}
+
+func parseExpiryTime(v string) (time.Time, error) {
+	loc := time.Local
+	if strings.HasSuffix(v, "Z") {
+		loc = time.UTC
+		v = v[:len(v)-1]
+	}
+	for _, format := range expiryTimeFormats {
+		if len(v) == len(format) {
+			return time.ParseInLocation(format, v, loc)
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid expiry-time: %s", v)
+}
+
+// NewAuthorizedKey creates an authorized key from a public key and the options returned by ssh.ParseAuthorizedKey.
+// restrict makes the key read-only, while options not meaningful to an SFTP server (like no-pty) are ignored.
+func NewAuthorizedKey(pubKey ssh.PublicKey, options []string) (*AuthorizedKey, error) {
+	k := &AuthorizedKey{PublicKey: pubKey}
+	for _, option := range options {
+		name, value := option, ""
+		if i := strings.IndexByte(option, '='); i >= 0 {
+			name, value = option[:i], unquoteAuthorizedKeyOptionValue(option[i+1:])
+		}
+		switch strings.ToLower(name) {
+		case "from":
+			k.From = strings.Split(value, ",")
+		case "expiry-time":
+			expiryTime, err := parseExpiryTime(value)
+			if err != nil {
+				return nil, err
+			}
+			k.ExpiryTime = expiryTime
+		case "read-only", "restrict":
+			k.PermsOverride.Writable = &vFalse
+			k.PermsOverride.Deletable = &vFalse
+		case "write-only":
+			k.PermsOverride.Readable = &vFalse
+		case "cert-authority":
+			return nil, fmt.Errorf(`"cert-authority" keys are not supported, use trusted_user_ca_keys instead`)
+		}
+	}
+	return k, nil
+}
+
+// matchAddrPattern checks whether an IP address matches either a CIDR or a wildcard pattern
+func matchAddrPattern(ip net.IP, pattern string) bool {
+	if _, ipNet, err := net.ParseCIDR(pattern); err == nil {
+		return ipNet.Contains(ip)
+	}
+	ok, _ := path.Match(pattern, ip.String())
+	return ok
+}
+
+// matchAddrPatternList checks an IP address against a pattern list following authorized_keys semantics:
+// a negated pattern (starting with "!") matching the address rejects it regardless of the other patterns.
+func matchAddrPatternList(ip net.IP, patterns []string) bool {
+	matched := false
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		if strings.HasPrefix(pattern, "!") {
+			if matchAddrPattern(ip, pattern[1:]) {
+				return false
+			}
+		} else if matchAddrPattern(ip, pattern) {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// Check checks whether the key may be used from the given address at the given time
+func (k *AuthorizedKey) Check(addr net.Addr, now time.Time) error {
+	if !k.ExpiryTime.IsZero() && now.After(k.ExpiryTime) {
+		return fmt.Errorf("public key expired at %s", k.ExpiryTime)
+	}
+	if k.From != nil {
+		tcpAddr, ok := addr.(*net.TCPAddr)
+		if !ok {
+			return fmt.Errorf("unable to check source address %s", addr)
+		}
+		if !matchAddrPatternList(tcpAddr.IP, k.From) {
+			return fmt.Errorf("public key not allowed from %s", tcpAddr.IP)
+		}
+	}
+	return nil
+}
+
+func parseAuthorizedKeys(keys []*AuthorizedKey, pubKeyFileContent []byte) ([]*AuthorizedKey, error) {
+	for len(pubKeyFileContent) > 0 {
+		var pubKey ssh.PublicKey
+		var options []string
+		var err error
+		pubKey, _, options, pubKeyFileContent, err = ssh.ParseAuthorizedKey(pubKeyFileContent)
+		if err != nil {
+			return keys, err
+		}
+		k, err := NewAuthorizedKey(pubKey, options)
+		if err != nil {
+			return keys, errors.Wrapf(err, "public key %s", ssh.FingerprintSHA256(pubKey))
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAuthorizedKeysOptions(t *testing.T) {
+	keys, err := parseAuthorizedKeys(nil, []byte(`
+from="192.0.2.0/24,!192.0.2.100",expiry-time="20300101Z",read-only `+testAuthorizedKey+` automation
+no-pty,write-only `+testAuthorizedKey+`
+`+testAuthorizedKey+`
+restrict `+testAuthorizedKey+`
+`))
+	assert.NoError(t, err)
+	assert.Len(t, keys, 4)
+	assert.Equal(t, []string{"192.0.2.0/24", "!192.0.2.100"}, keys[0].From)
+	assert.Equal(t, time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC), keys[0].ExpiryTime)
+	assert.Equal(t, Perms{Readable: true, Listable: true}, Perms{Readable: true, Writable: true, Listable: true}.Apply(keys[0].PermsOverride))
+	assert.Nil(t, keys[1].From)
+	assert.True(t, keys[1].ExpiryTime.IsZero())
+	assert.Equal(t, Perms{Writable: true, Listable: true}, Perms{Readable: true, Writable: true, Listable: true}.Apply(keys[1].PermsOverride))
+	assert.Equal(t, Perms{Readable: true, Writable: true, Listable: true}, Perms{Readable: true, Writable: true, Listable: true}.Apply(keys[2].PermsOverride))
+	assert.Equal(t, Perms{Readable: true, Listable: true}, Perms{Readable: true, Writable: true, Listable: true}.Apply(keys[3].PermsOverride))
+
+	_, err = parseAuthorizedKeys(nil, []byte(`expiry-time="2030" `+testAuthorizedKey))
+	assert.Error(t, err)
+	_, err = parseAuthorizedKeys(nil, []byte(`cert-authority `+testAuthorizedKey))
+	assert.Error(t, err)
+}
+
+func TestAuthorizedKeyCheck(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		key      AuthorizedKey
+		ip       net.IP
+		expected bool
+	}{
+		{AuthorizedKey{}, net.IPv4(198, 51, 100, 1), true},
+		{AuthorizedKey{From: []string{"192.0.2.0/24"}}, net.IPv4(192, 0, 2, 1), true},
+		{AuthorizedKey{From: []string{"192.0.2.0/24"}}, net.IPv4(198, 51, 100, 1), false},
+		{AuthorizedKey{From: []string{"192.0.2.*", "!192.0.2.100"}}, net.IPv4(192, 0, 2, 1), true},
+		{AuthorizedKey{From: []string{"192.0.2.*", "!192.0.2.100"}}, net.IPv4(192, 0, 2, 100), false},
+		{AuthorizedKey{ExpiryTime: now.Add(time.Minute)}, net.IPv4(192, 0, 2, 1), true},
+		{AuthorizedKey{ExpiryTime: now.Add(-time.Minute)}, net.IPv4(192, 0, 2, 1), false},
+	}
+
+	for _, test := range tests {
+		err := test.key.Check(&net.TCPAddr{IP: test.ip, Port: 50000}, now)
+		assert.Equal(t, test.expected, err == nil, "%v from %s", test.key, test.ip)
+	}
+}
@@ -4,13 +4,20 @@ import (
 	"crypto"
 	"encoding/base64"
 	"fmt"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	aws "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	aws_creds "github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/request"
 	aws_session "github.com/aws/aws-sdk-go/aws/session"
 	s3 "github.com/aws/aws-sdk-go/service/s3"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // ServerSideEncryptionType server side encryption type
@@ -62,28 +69,158 @@ func (cfg *ServerSideEncryptionConfig) CustomerAlgorithm() string {
 
 // Perms permissions
 type Perms struct {
-	Readable bool
-	Writable bool
-	Listable bool
+	Readable  bool
+	Writable  bool
+	Listable  bool
+	Deletable bool
 }
 
-// S3Bucket S3 bucket
+// PermsOverride permissions overriding the ones present on a bucket. Unset values keep the bucket ones.
+type PermsOverride struct {
+	Readable  *bool `toml:"readable" json:"readable"`
+	Writable  *bool `toml:"writable" json:"writable"`
+	Listable  *bool `toml:"listable" json:"listable"`
+	Deletable *bool `toml:"deletable" json:"deletable"`
+}
+
+// Apply returns current permissions overridden by the ones passed as parameter
+func (p Perms) Apply(o PermsOverride) Perms {
+	if o.Readable != nil {
+		p.Readable = *o.Readable
+	}
+	if o.Writable != nil {
+		p.Writable = *o.Writable
+	}
+	if o.Listable != nil {
+		p.Listable = *o.Listable
+	}
+	if o.Deletable != nil {
+		p.Deletable = *o.Deletable
+	}
+	return p
+}
+
+// Merge returns current overrides along with the ones passed as parameter, which take precedence
+func (o PermsOverride) Merge(another PermsOverride) PermsOverride {
+	if another.Readable != nil {
+		o.Readable = another.Readable
+	}
+	if another.Writable != nil {
+		o.Writable = another.Writable
+	}
+	if another.Listable != nil {
+		o.Listable = another.Listable
+	}
+	if another.Deletable != nil {
+		o.Deletable = another.Deletable
+	}
+	return o
+}
+
+// String encodes overridden permissions as a string, prefixing by "+" the allowed ones and by "-" the
+// denied ones ("+r-w" allows reading and denies writing, keeping the listing permission)
+func (o PermsOverride) String() string {
+	s := ""
+	for _, v := range []struct {
+		c byte
+		v *bool
+	}{{'r', o.Readable}, {'w', o.Writable}, {'l', o.Listable}, {'d', o.Deletable}} {
+		if v.v == nil {
+			continue
+		}
+		if *v.v {
+			s += "+" + string(v.c)
+		} else {
+			s += "-" + string(v.c)
+		}
+	}
+	return s
+}
+
+// ParsePermsOverride decodes overridden permissions encoded with PermsOverride.String
+func ParsePermsOverride(s string) PermsOverride {
+	o := PermsOverride{}
+	for i := 0; i+1 < len(s); i += 2 {
+		v := &vFalse
+		if s[i] == '+' {
+			v = &vTrue
+		}
+		switch s[i+1] {
+		case 'r':
+			o.Readable = v
+		case 'w':
+			o.Writable = v
+		case 'l':
+			o.Listable = v
+		case 'd':
+			o.Deletable = v
+		}
+	}
+	return o
+}
+
+// AssumeRoleConfig IAM role the objects of a bucket are accessed under
+type AssumeRoleConfig struct {
+	RoleARN              string
+	ExternalID           string
+	SessionName          string
+	WebIdentityTokenFile string
+	STSEndpoint          string
+}
+
+// Credentials returns credentials of the role, which are obtained from STS with the session passed as parameter
+// and refreshed before they expire
+func (arCfg *AssumeRoleConfig) Credentials(sess *aws_session.Session) *aws_creds.Credentials {
+	sess = sess.Copy(aws.NewConfig().WithEndpoint(arCfg.STSEndpoint))
+	if arCfg.WebIdentityTokenFile != "" {
+		return stscreds.NewWebIdentityCredentials(sess, arCfg.RoleARN, arCfg.SessionName, arCfg.WebIdentityTokenFile)
+	}
+	return stscreds.NewCredentials(sess, arCfg.RoleARN, func(p *stscreds.AssumeRoleProvider) {
+		p.RoleSessionName = arCfg.SessionName
+		if arCfg.ExternalID != "" {
+			p.ExternalID = aws.String(arCfg.ExternalID)
+		}
+	})
+}
+
+// S3Bucket bucket config, whose objects are kept either on an S3 bucket or in a local directory.
+// Bucket holds the path of the directory in the latter case.
 type S3Bucket struct {
 	Name                           string
 	AWSConfig                      *aws.Config
 	Bucket                         string
 	KeyPrefix                      Path
 	MaxObjectSize                  int64
-	Users                          UserStore
+	StagingPrefix                  Path
+	Users                          *UserStore
 	Perms                          Perms
 	ServerSideEncryption           ServerSideEncryptionConfig
 	KeyboardInteractiveAuthEnabled bool
+	ACL                            ACL
+	AddrFilter                     *AddrFilter
+	Storage                        StorageBackend
+	AssumeRole                     *AssumeRoleConfig
+	s3                             *s3.S3
+	mtx                            sync.Mutex
+}
+
+// PathTemplateVars returns the values of the placeholders that may be present in the key prefix
+// and root paths, for the user passed as parameter
+func (b *S3Bucket) PathTemplateVars(user string) map[string]string {
+	vars := map[string]string{
+		"user":   user,
+		"bucket": b.Name,
+	}
+	if b.Users != nil {
+		vars["auth"] = b.Users.Name
+	}
+	return vars
 }
 
 // S3Buckets S3 buckets
 type S3Buckets struct {
-	Buckets         map[string]*S3Bucket
-	UserToBucketMap map[string]*S3Bucket
+	Buckets     map[string]*S3Bucket
+	bucketNames []string
 }
 
 // Get gets an S3 bucket given its name
@@ -92,8 +229,77 @@ func (s3bs *S3Buckets) Get(name string) *S3Bucket {
 	return b
 }
 
-// S3 creates a new instance of S3 client
+// LookupUser gets the bucket a user is assigned to and the user itself.
+// User stores may be reloaded on runtime, so users are looked up on every call.
+// Users present on local stores take precedence over remote ones.
+func (s3bs *S3Buckets) LookupUser(name string) (*S3Bucket, User) {
+	for _, remote := range []bool{false, true} {
+		for _, bucketName := range s3bs.bucketNames {
+			bucket := s3bs.Buckets[bucketName]
+			if bucket.Users.IsRemote() != remote {
+				continue
+			}
+			u := bucket.Users.Lookup(name)
+			if u != nil {
+				return bucket, u
+			}
+		}
+	}
+	return nil, nil
+}
+
+// LookupUserBuckets gets all the buckets a user is assigned to and the user itself.
+// Users present on local stores take precedence over remote ones, which are assigned to a single bucket.
+func (s3bs *S3Buckets) LookupUserBuckets(name string) ([]*S3Bucket, User) {
+	var buckets []*S3Bucket
+	var user User
+	for _, bucketName := range s3bs.bucketNames {
+		bucket := s3bs.Buckets[bucketName]
+		if bucket.Users.IsRemote() {
+			continue
+		}
+		u := bucket.Users.Lookup(name)
+		if u != nil {
+			if user == nil {
+				user = u
+			}
+			buckets = append(buckets, bucket)
+		}
+	}
+	if user == nil {
+		bucket, u := s3bs.LookupUser(name)
+		if u != nil {
+			return []*S3Bucket{bucket}, u
+		}
+	}
+	return buckets, user
+}
+
+// awsCredentialsErrorCodes error codes S3 answers with when credentials are invalid or expired
+var awsCredentialsErrorCodes = map[string]bool{
+	"InvalidAccessKeyId":    true,
+	"SignatureDoesNotMatch": true,
+	"ExpiredToken":          true,
+	"InvalidToken":          true,
+	"TokenRefreshRequired":  true,
+}
+
+func awsErrorCode(err error) string {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code()
+	}
+	return "unknown"
+}
+
+// S3 returns the S3 client of the bucket, which is created on first use and shared afterwards.
+// Credentials are retrieved and refreshed by the SDK when needed.
 func (s3b *S3Bucket) S3() (*s3.S3, error) {
+	s3b.mtx.Lock()
+	defer s3b.mtx.Unlock()
+	if s3b.s3 != nil {
+		return s3b.s3, nil
+	}
+
 	awsCfg := s3b.AWSConfig
 	var sess *aws_session.Session
 	var err error
@@ -109,7 +315,32 @@ func (s3b *S3Bucket) S3() (*s3.S3, error) {
 	if err != nil {
 		return nil, err
 	}
-	return s3.New(sess), nil
+	var client *s3.S3
+	if s3b.AssumeRole != nil {
+		// the session credentials are only used to assume the role
+		client = s3.New(sess, aws.NewConfig().WithCredentials(s3b.AssumeRole.Credentials(sess)))
+	} else {
+		client = s3.New(sess)
+	}
+	// credentials that can't be retrieved make signing fail, while the ones S3 doesn't accept make requests fail
+	client.Handlers.Sign.PushBackNamed(request.NamedHandler{
+		Name: "s3sftpproxy.CredentialsRetrievalErrors",
+		Fn: func(r *request.Request) {
+			if r.Error != nil {
+				mAWSCredentialsError.With(prometheus.Labels{"bucket": s3b.Name, "code": awsErrorCode(r.Error)}).Inc()
+			}
+		},
+	})
+	client.Handlers.Complete.PushBackNamed(request.NamedHandler{
+		Name: "s3sftpproxy.CredentialsRejectedErrors",
+		Fn: func(r *request.Request) {
+			if code := awsErrorCode(r.Error); r.Error != nil && awsCredentialsErrorCodes[code] {
+				mAWSCredentialsError.With(prometheus.Labels{"bucket": s3b.Name, "code": code}).Inc()
+			}
+		},
+	})
+	s3b.s3 = client
+	return client, nil
 }
 
 func buildS3Bucket(uStores UserStores, name string, bCfg *S3BucketConfig) (*S3Bucket, error) {
@@ -122,16 +353,26 @@ func buildS3Bucket(uStores UserStores, name string, bCfg *S3BucketConfig) (*S3Bu
 				"",
 			),
 		)
-	} else if bCfg.Profile != "" {
+	} else if bCfg.Profile != "" || bCfg.SharedCredentialsFile != "" {
 		awsCfg = awsCfg.WithCredentials(
 			aws_creds.NewSharedCredentials(
-				"", // TODO: assumes default
+				bCfg.SharedCredentialsFile, // defaults to ~/.aws/credentials
 				bCfg.Profile,
 			),
 		)
 	} else {
 		// credentials are retrieved through EC2 metadata on runtime
 	}
+	var assumeRole *AssumeRoleConfig
+	if bCfg.RoleARN != "" {
+		assumeRole = &AssumeRoleConfig{
+			RoleARN:              bCfg.RoleARN,
+			ExternalID:           bCfg.ExternalID,
+			SessionName:          bCfg.SessionName,
+			WebIdentityTokenFile: bCfg.WebIdentityTokenFile,
+			STSEndpoint:          bCfg.STSEndpoint,
+		}
+	}
 	if bCfg.Endpoint != "" {
 		awsCfg = awsCfg.WithEndpoint(bCfg.Endpoint)
 	}
@@ -144,6 +385,14 @@ func buildS3Bucket(uStores UserStores, name string, bCfg *S3BucketConfig) (*S3Bu
 	if bCfg.Region != "" {
 		awsCfg = awsCfg.WithRegion(bCfg.Region)
 	}
+	acl, err := ParseACL(bCfg.Rules)
+	if err != nil {
+		return nil, err
+	}
+	addrFilter, err := NewAddrFilter(bCfg.AllowFrom, bCfg.DenyFrom)
+	if err != nil {
+		return nil, err
+	}
 	users, ok := uStores[bCfg.Auth]
 	if !ok {
 		return nil, fmt.Errorf("no such auth config: %s", bCfg.Auth)
@@ -152,6 +401,13 @@ func buildS3Bucket(uStores UserStores, name string, bCfg *S3BucketConfig) (*S3Bu
 	if len(keyPrefix) > 0 && keyPrefix[0] == "" {
 		keyPrefix = keyPrefix[1:]
 	}
+	if err := validatePathTemplate(keyPrefix); err != nil {
+		return nil, errors.Wrapf(err, "key prefix %s", bCfg.KeyPrefix)
+	}
+	stagingPrefix := SplitIntoPath(bCfg.StagingPrefix)
+	if len(stagingPrefix) > 0 && stagingPrefix[0] == "" {
+		stagingPrefix = stagingPrefix[1:]
+	}
 	maxObjectSize := int64(-1)
 	if bCfg.MaxObjectSize != nil {
 		maxObjectSize = *bCfg.MaxObjectSize
@@ -171,17 +427,19 @@ func buildS3Bucket(uStores UserStores, name string, bCfg *S3BucketConfig) (*S3Bu
 	} else {
 		customerKey = []byte{}
 	}
-	return &S3Bucket{
+	b := &S3Bucket{
 		Name:          name,
 		AWSConfig:     awsCfg,
 		Bucket:        bCfg.Bucket,
 		KeyPrefix:     keyPrefix,
 		MaxObjectSize: maxObjectSize,
+		StagingPrefix: stagingPrefix,
 		Users:         users,
 		Perms: Perms{
-			Readable: *bCfg.Readable,
-			Writable: *bCfg.Writable,
-			Listable: *bCfg.Listable,
+			Readable:  *bCfg.Readable,
+			Writable:  *bCfg.Writable,
+			Listable:  *bCfg.Listable,
+			Deletable: *bCfg.Deletable,
 		},
 		ServerSideEncryption: ServerSideEncryptionConfig{
 			Type:           bCfg.ServerSideEncryption,
@@ -190,29 +448,68 @@ func buildS3Bucket(uStores UserStores, name string, bCfg *S3BucketConfig) (*S3Bu
 			KMSKeyID:       bCfg.SSEKMSKeyID,
 		},
 		KeyboardInteractiveAuthEnabled: bCfg.KeyboardInteractiveAuthEnabled,
-	}, nil
+		ACL:                            acl,
+		AddrFilter:                     addrFilter,
+		AssumeRole:                     assumeRole,
+	}
+	if bCfg.IsLocal() {
+		b.Storage, err = NewLocalStorage(bCfg.Bucket)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		b.Storage = &S3Storage{Bucket: b}
+	}
+	return b, nil
+}
+
+// ReloadableS3Buckets S3 buckets that may be replaced on runtime as a whole, when the configuration is reloaded
+type ReloadableS3Buckets struct {
+	v atomic.Value
+}
+
+// NewReloadableS3Buckets creates a new ReloadableS3Buckets holding the buckets passed as parameter
+func NewReloadableS3Buckets(buckets *S3Buckets) *ReloadableS3Buckets {
+	rb := &ReloadableS3Buckets{}
+	rb.Store(buckets)
+	return rb
+}
+
+// Load gets the current buckets. Callers should hold on to the returned value for the duration of an operation,
+// so that they see a consistent configuration.
+func (rb *ReloadableS3Buckets) Load() *S3Buckets {
+	return rb.v.Load().(*S3Buckets)
+}
+
+// Store replaces the current buckets
+func (rb *ReloadableS3Buckets) Store(buckets *S3Buckets) {
+	rb.v.Store(buckets)
 }
 
 // NewS3BucketFromConfig creates an S3Buckets from configuration
 func NewS3BucketFromConfig(uStores UserStores, cfg *S3SFTPProxyConfig) (*S3Buckets, error) {
 	buckets := map[string]*S3Bucket{}
+	bucketNames := make([]string, 0, len(cfg.Buckets))
 	userToBucketMap := map[string]*S3Bucket{}
 	for name, bCfg := range cfg.Buckets {
 		bucket, err := buildS3Bucket(uStores, name, bCfg)
 		if err != nil {
 			return nil, errors.Wrapf(err, "bucket config %s", name)
 		}
-		for _, user := range bucket.Users.Users {
+		for _, user := range bucket.Users.GetUsers() {
+			// users may be assigned to several buckets as long as they are authenticated the same way
 			_bucket, ok := userToBucketMap[user.GetName()]
-			if ok {
-				return nil, fmt.Errorf(`bucket config %s: user "%s" is already assigned to bucket config "%s"`, name, user.GetName(), _bucket.Name)
+			if ok && _bucket.Users != bucket.Users {
+				return nil, fmt.Errorf(`bucket config %s: user "%s" is already assigned to bucket config "%s" using a different auth config`, name, user.GetName(), _bucket.Name)
 			}
 			userToBucketMap[user.GetName()] = bucket
 		}
 		buckets[name] = bucket
+		bucketNames = append(bucketNames, name)
 	}
+	sort.Strings(bucketNames)
 	return &S3Buckets{
-		Buckets:         buckets,
-		UserToBucketMap: userToBucketMap,
+		Buckets:     buckets,
+		bucketNames: bucketNames,
 	}, nil
 }
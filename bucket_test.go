@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	aws "github.com/aws/aws-sdk-go/aws"
+	aws_creds "github.com/aws/aws-sdk-go/aws/credentials"
+	aws_s3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestS3Bucket(name string, endpoint string, creds *aws_creds.Credentials) *S3Bucket {
+	return &S3Bucket{
+		Name:   name,
+		Bucket: "test",
+		AWSConfig: aws.NewConfig().
+			WithCredentials(creds).
+			WithEndpoint(endpoint).
+			WithRegion("us-east-1").
+			WithS3ForcePathStyle(true).
+			WithDisableSSL(true),
+	}
+}
+
+func TestS3BucketClientCached(t *testing.T) {
+	bucket := newTestS3Bucket("cached", "http://127.0.0.1:1", aws_creds.NewStaticCredentials("test", "test", ""))
+	s3a, err := bucket.S3()
+	assert.NoError(t, err)
+	s3b, err := bucket.S3()
+	assert.NoError(t, err)
+	assert.True(t, s3a == s3b)
+}
+
+func TestS3BucketCredentialsErrors(t *testing.T) {
+	s3 := newFakeS3("test")
+	s3.AccessKeyID = "good"
+	s3Server := httptest.NewServer(s3)
+	defer s3Server.Close()
+
+	for _, c := range []struct {
+		name  string
+		creds *aws_creds.Credentials
+		code  string
+	}{
+		{"creds-empty", aws_creds.NewStaticCredentials("", "", ""), "EmptyStaticCreds"},
+		{"creds-rejected", aws_creds.NewStaticCredentials("bad", "bad", ""), "InvalidAccessKeyId"},
+		{"creds-good", aws_creds.NewStaticCredentials("good", "good", ""), ""},
+	} {
+		client, err := newTestS3Bucket(c.name, s3Server.URL, c.creds).S3()
+		assert.NoError(t, err)
+		_, err = client.ListObjectsV2(&aws_s3.ListObjectsV2Input{Bucket: aws.String("test")})
+		if c.code == "" {
+			assert.NoError(t, err)
+			continue
+		}
+		assert.Error(t, err)
+		assert.Equal(t, 1.0, testutil.ToFloat64(mAWSCredentialsError.With(prometheus.Labels{"bucket": c.name, "code": c.code})), c.name)
+	}
+}
+
+// fakeSTS answers AssumeRole and AssumeRoleWithWebIdentity requests with the credentials of an access key,
+// keeping the last request
+type fakeSTS struct {
+	AccessKeyID string
+	request     url.Values
+}
+
+func (f *fakeSTS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	f.request = r.PostForm
+	action := r.PostForm.Get("Action")
+	w.Header().Set("Content-Type", "text/xml")
+	fmt.Fprintf(w, `<%[1]sResponse><%[1]sResult><Credentials><AccessKeyId>%[2]s</AccessKeyId><SecretAccessKey>secret</SecretAccessKey><SessionToken>token</SessionToken><Expiration>2100-01-01T00:00:00Z</Expiration></Credentials></%[1]sResult></%[1]sResponse>`, action, f.AccessKeyID)
+}
+
+func TestS3BucketAssumeRole(t *testing.T) {
+	s3 := newFakeS3("test")
+	s3.AccessKeyID = "assumed"
+	s3Server := httptest.NewServer(s3)
+	defer s3Server.Close()
+	sts := &fakeSTS{AccessKeyID: "assumed"}
+	stsServer := httptest.NewServer(sts)
+	defer stsServer.Close()
+
+	tokenFile, err := ioutil.TempFile("", "s3-sftp-proxy")
+	assert.NoError(t, err)
+	defer os.Remove(tokenFile.Name())
+	tokenFile.WriteString("web-identity-token")
+	tokenFile.Close()
+
+	bucket := newTestS3Bucket("assume-role", s3Server.URL, aws_creds.NewStaticCredentials("base", "base", ""))
+	bucket.AssumeRole = &AssumeRoleConfig{
+		RoleARN:     "arn:aws:iam::123456789012:role/sftp",
+		ExternalID:  "customer",
+		SessionName: "s3-sftp-proxy",
+		STSEndpoint: stsServer.URL,
+	}
+	client, err := bucket.S3()
+	assert.NoError(t, err)
+	_, err = client.ListObjectsV2(&aws_s3.ListObjectsV2Input{Bucket: aws.String("test")})
+	assert.NoError(t, err)
+	assert.Equal(t, "AssumeRole", sts.request.Get("Action"))
+	assert.Equal(t, "arn:aws:iam::123456789012:role/sftp", sts.request.Get("RoleArn"))
+	assert.Equal(t, "customer", sts.request.Get("ExternalId"))
+	assert.Equal(t, "s3-sftp-proxy", sts.request.Get("RoleSessionName"))
+
+	bucket = newTestS3Bucket("web-identity", s3Server.URL, aws_creds.AnonymousCredentials)
+	bucket.AssumeRole = &AssumeRoleConfig{
+		RoleARN:              "arn:aws:iam::123456789012:role/sftp",
+		SessionName:          "s3-sftp-proxy",
+		WebIdentityTokenFile: tokenFile.Name(),
+		STSEndpoint:          stsServer.URL,
+	}
+	client, err = bucket.S3()
+	assert.NoError(t, err)
+	_, err = client.ListObjectsV2(&aws_s3.ListObjectsV2Input{Bucket: aws.String("test")})
+	assert.NoError(t, err)
+	assert.Equal(t, "AssumeRoleWithWebIdentity", sts.request.Get("Action"))
+	assert.Equal(t, "web-identity-token", sts.request.Get("WebIdentityToken"))
+}
+
+func TestValidateBucketConfigAssumeRole(t *testing.T) {
+	for _, c := range []struct {
+		bCfg S3BucketConfig
+		ok   bool
+	}{
+		{S3BucketConfig{RoleARN: "arn", ExternalID: "id"}, true},
+		{S3BucketConfig{RoleARN: "arn", Profile: "profile", SharedCredentialsFile: "/etc/aws/credentials"}, true},
+		{S3BucketConfig{RoleARN: "arn", WebIdentityTokenFile: "/var/run/token"}, true},
+		{S3BucketConfig{ExternalID: "id"}, false},
+		{S3BucketConfig{WebIdentityTokenFile: "/var/run/token"}, false},
+		{S3BucketConfig{RoleARN: "arn", WebIdentityTokenFile: "/var/run/token", Profile: "profile"}, false},
+		{S3BucketConfig{RoleARN: "arn", WebIdentityTokenFile: "/var/run/token", ExternalID: "id"}, false},
+		{S3BucketConfig{SharedCredentialsFile: "/etc/aws/credentials", Credentials: &AWSCredentialsConfig{}}, false},
+	} {
+		bCfg := c.bCfg
+		bCfg.Bucket = "test"
+		bCfg.Auth = "test"
+		err := validateAndFixupBucketConfig(&bCfg)
+		assert.Equal(t, c.ok, err == nil, "%+v: %v", c.bCfg, err)
+		if c.ok && bCfg.RoleARN != "" {
+			assert.Equal(t, "s3-sftp-proxy", bCfg.SessionName)
+		}
+	}
+}
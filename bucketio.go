@@ -11,6 +11,7 @@ import (
 
 	aws "github.com/aws/aws-sdk-go/aws"
 	aws_s3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
 	"github.com/pkg/sftp"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
@@ -39,26 +40,78 @@ func nilIfEmpty(s string) *string {
 	return &s
 }
 
-// S3GetObjectOutputReader used to implement a reader when a file is downloaded from S3 and sent to the client
+// S3GetObjectOutputReader used to implement a reader when a file is downloaded from S3 and sent to the client.
+// The object is streamed sequentially, keeping a lookback buffer so that slightly out-of-order reads are served
+// from memory. Reads behind the lookback buffer or far ahead of the stream reopen it from their offset
+// through a ranged GetObject. Upcoming ranges are also fetched concurrently when read-ahead is enabled.
 type S3GetObjectOutputReader struct {
-	Ctx          context.Context
-	Goo          *aws_s3.GetObjectOutput
-	Log          logrus.FieldLogger
-	Lookback     int
-	MinChunkSize int
-	mtx          sync.Mutex
-	spooled      []byte
-	spoolOffset  int
-	noMore       bool
+	Ctx                  context.Context
+	Goo                  *aws_s3.GetObjectOutput
+	S3                   *aws_s3.S3
+	Bucket               string
+	Key                  string
+	ServerSideEncryption *ServerSideEncryptionConfig
+	Log                  logrus.FieldLogger
+	Lookback             int
+	MinChunkSize         int
+	ReadAhead            *ReadAhead
+	mtx                  sync.Mutex
+	size                 int64
+	etag                 *string
+	spooled              []byte
+	spoolOffset          int
+	noMore               bool
+	readAheadChunks      map[int64]*readAheadChunk
+	readAheadCtx         context.Context
+	cancelReadAhead      context.CancelFunc
 }
 
-// Close closes current output reader
-func (oor *S3GetObjectOutputReader) Close() error {
-	if oor.Goo.Body != nil {
+// Open starts streaming the object from the offset passed as parameter, closing the current stream if any.
+// Later streams are requested for the same version of the object as the first one. The data spooled so far
+// is left to the caller.
+func (oor *S3GetObjectOutputReader) Open(off int) error {
+	oor.closeStream()
+	input := &aws_s3.GetObjectInput{
+		Bucket:               &oor.Bucket,
+		Key:                  &oor.Key,
+		IfMatch:              oor.etag,
+		SSECustomerAlgorithm: nilIfEmpty(oor.ServerSideEncryption.CustomerAlgorithm()),
+		SSECustomerKey:       nilIfEmpty(oor.ServerSideEncryption.CustomerKey),
+		SSECustomerKeyMD5:    nilIfEmpty(oor.ServerSideEncryption.CustomerKeyMD5),
+	}
+	if off > 0 {
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-", off))
+	}
+	oor.Log.Debugf("GetObject(Range=%s)", aws.StringValue(input.Range))
+	goo, err := oor.S3.GetObjectWithContext(oor.Ctx, input)
+	if err != nil {
+		return err
+	}
+	if oor.etag == nil {
+		oor.etag = goo.ETag
+		oor.size = -1
+		if off == 0 && goo.ContentLength != nil {
+			oor.size = *goo.ContentLength
+		}
+	}
+	oor.Goo = goo
+	return nil
+}
+
+func (oor *S3GetObjectOutputReader) closeStream() {
+	if oor.Goo != nil && oor.Goo.Body != nil {
 		oor.Log.Debug("Closing download")
 		oor.Goo.Body.Close()
 		oor.Goo.Body = nil
 	}
+}
+
+// Close closes current output reader
+func (oor *S3GetObjectOutputReader) Close() error {
+	oor.mtx.Lock()
+	defer oor.mtx.Unlock()
+	oor.closeStream()
+	oor.releaseReadAhead()
 	return nil
 }
 
@@ -68,13 +121,30 @@ func (oor *S3GetObjectOutputReader) ReadAt(buf []byte, off int64) (int, error) {
 	defer oor.mtx.Unlock()
 
 	oor.Log.Debugf("ReadAt len(buf)=%d, off=%d", len(buf), off)
+	if oor.size >= 0 && off >= oor.size {
+		return 0, io.EOF
+	}
+	if n, ok, err := oor.readAhead(buf, off); ok {
+		return n, err
+	}
 	_o, err := castInt64ToInt(off)
 	if err != nil {
 		return 0, err
 	}
-	if _o < oor.spoolOffset {
-		oor.Log.Error("Supplied position is out of range")
-		return 0, fmt.Errorf("supplied position is out of range")
+	// skipping the data in between is cheaper than a new request, unless it's more than a chunk away
+	skip := oor.Lookback
+	if skip < oor.MinChunkSize {
+		skip = oor.MinChunkSize
+	}
+	if _o < oor.spoolOffset || (!oor.noMore && _o > oor.spoolOffset+len(oor.spooled)+skip) {
+		oor.Log.Debugf("ReadAt seeking to %d", _o)
+		if err := oor.Open(_o); err != nil {
+			oor.Log.WithField("exception", err).Error("Error reopening download")
+			return 0, err
+		}
+		oor.spooled = oor.spooled[:0]
+		oor.spoolOffset = _o
+		oor.noMore = false
 	}
 
 	s := _o - oor.spoolOffset
@@ -104,6 +174,14 @@ func (oor *S3GetObjectOutputReader) ReadAt(buf []byte, off int64) (int, error) {
 		return i, nil
 	}
 
+	if oor.Goo.Body == nil {
+		// the stream broke on a previous read, so it's resumed where it stopped
+		if err := oor.Open(oor.spoolOffset + len(oor.spooled)); err != nil {
+			oor.Log.WithField("exception", err).Error("Error reopening download")
+			return 0, err
+		}
+	}
+
 	oor.Log.Debugf("ReadAt s=%d, len(oor.spooled)=%d, oor.Lookback=%d", s, len(oor.spooled), oor.Lookback)
 	if s <= len(oor.spooled) && s >= oor.Lookback {
 		oor.spooled = oor.spooled[s-oor.Lookback:]
@@ -129,14 +207,19 @@ func (oor *S3GetObjectOutputReader) ReadAt(buf []byte, off int64) (int, error) {
 		err error
 	}
 
+	body := oor.Goo.Body
 	resultChan := make(chan readResult)
 	go func() {
-		n, err := io.ReadFull(oor.Goo.Body, oor.spooled[len(oor.spooled):e])
+		n, err := io.ReadFull(body, oor.spooled[len(oor.spooled):e])
 		resultChan <- readResult{n, err}
 	}()
 	select {
 	case <-oor.Ctx.Done():
-		oor.Goo.Body.(ReadDeadlineSettable).SetReadDeadline(time.Unix(1, 0))
+		if settable, ok := body.(ReadDeadlineSettable); ok {
+			settable.SetReadDeadline(time.Unix(1, 0))
+		} else {
+			body.Close()
+		}
 		oor.Log.Debug("Read operation canceled")
 		return 0, fmt.Errorf("read operation canceled")
 	case res := <-resultChan:
@@ -145,16 +228,26 @@ func (oor *S3GetObjectOutputReader) ReadAt(buf []byte, off int64) (int, error) {
 		}
 		e = len(oor.spooled) + res.n
 		oor.spooled = oor.spooled[:e]
+		if res.err != nil && !oor.noMore {
+			oor.Log.WithField("exception", res.err).Error("Error reading download")
+			oor.closeStream()
+			if s >= e {
+				return 0, res.err
+			}
+		}
 		if s < e {
 			be := e
 			if be > s+r {
 				be = s + r
 			}
 			copy(buf[i:], oor.spooled[s:be])
-			mReadsBytesTotal.Add(float64(be - s))
-			return be - s, nil
+			i += be - s
 		}
-		return 0, io.EOF
+		if i == 0 {
+			return 0, io.EOF
+		}
+		mReadsBytesTotal.Add(float64(i))
+		return i, nil
 	}
 }
 
@@ -360,9 +453,10 @@ func (sol *S3ObjectLister) ListAt(result []os.FileInfo, o int64) (int, error) {
 		}
 	}
 	for _, obj := range out.Contents {
-		// if *obj.Key == sol.Prefix {
-		// 	continue
-		// }
+		// the object standing for the directory itself
+		if *obj.Key == prefix {
+			continue
+		}
 		sol.spooled = append(sol.spooled, &ObjectFileInfo{
 			_Name:         path.Base(*obj.Key),
 			_LastModified: *obj.LastModified,
@@ -472,17 +566,24 @@ func (sos *S3ObjectStat) ListAt(result []os.FileInfo, o int64) (int, error) {
 				result[0] = &objInfo
 			} else {
 				sos.Log.WithField("exception", err).Debug("Error getting object acl")
+				// directories exist as long as some object is found under them
+				prefix := key + "/"
 				sos.Log.Debug("ListObjectsV2WithContext")
 				out, err := sos.S3.ListObjectsV2WithContext(
 					sos.Ctx,
 					&aws_s3.ListObjectsV2Input{
 						Bucket:    &sos.Bucket,
-						Prefix:    &key,
-						MaxKeys:   aws.Int64(10000),
+						Prefix:    &prefix,
+						MaxKeys:   aws.Int64(1),
 						Delimiter: aws.String("/"),
 					},
 				)
-				if err != nil || (!sos.Root && len(out.CommonPrefixes) == 0) {
+				if err != nil {
+					sos.Log.WithField("exception", err).Error("Error listing S3 objects")
+					mOperationStatus.With(lFailure).Inc()
+					return 0, err
+				}
+				if !sos.Root && len(out.CommonPrefixes) == 0 && len(out.Contents) == 0 {
 					mOperationStatus.With(lNoObject).Inc()
 					return 0, os.ErrNotExist
 				}
@@ -499,62 +600,106 @@ func (sos *S3ObjectStat) ListAt(result []os.FileInfo, o int64) (int, error) {
 	return 1, nil
 }
 
-// S3BucketIO represents IO operations over an S3 bucket
-type S3BucketIO struct {
-	Ctx                      context.Context
-	Bucket                   *S3Bucket
+// S3BucketIOOptions resources and tunables the bucket IOs of a server share
+type S3BucketIOOptions struct {
 	ReaderLookbackBufferSize int
 	ReaderMinChunkSize       int
+	ReadAhead                *ReadAhead
 	ListerLookbackBufferSize int
 	UploadMemoryBufferPool   *MemoryBufferPool
+	UploadMaxPartBuffers     int
+	UploadSpill              *UploadSpill
+	ResumableUploads         *ResumableUploads
 	PhantomObjectMap         *PhantomObjectMap
-	Perms                    Perms
-	ServerSideEncryption     *ServerSideEncryptionConfig
 	Now                      func() time.Time
-	Log                      logrus.FieldLogger
-	UserInfo                 *UserInfo
 	UploadChan               chan<- *S3PartToUpload
-	keyPrefix                Path
 }
 
-// NewS3BucketIO creates a new instance of S3BucketIO
-func NewS3BucketIO(ctx context.Context, bucket *S3Bucket, readerLookbackBufferSize int, readerMinChunkSize int, listerLookbackBufferSize int, uploadMemoryBufferPool *MemoryBufferPool, log logrus.FieldLogger, phantomObjectMap *PhantomObjectMap, now func() time.Time, userInfo *UserInfo, uploadChan chan<- *S3PartToUpload) *S3BucketIO {
-	keyPrefix := bucket.KeyPrefix.Join(SplitIntoPath(userInfo.RootPath))
+// S3BucketIO represents IO operations over a bucket config, whose objects are kept in its storage backend
+type S3BucketIO struct {
+	S3BucketIOOptions
+	Ctx          context.Context
+	Bucket       *S3Bucket
+	SessionEnded <-chan struct{}
+	Perms        Perms
+	ACL          ACL
+	Log          logrus.FieldLogger
+	UserInfo     *UserInfo
+	keyPrefix    Path
+	mountPoint   Path
+}
+
+// NewS3BucketIO creates a new instance of S3BucketIO. The placeholders present in both the key prefix
+// of the bucket and the root path of the user are expanded here.
+func NewS3BucketIO(ctx context.Context, bucket *S3Bucket, userInfo *UserInfo, opts S3BucketIOOptions, log logrus.FieldLogger) (*S3BucketIO, error) {
+	vars := bucket.PathTemplateVars(userInfo.User)
+	keyPrefix, err := bucket.KeyPrefix.Expand(vars)
+	if err != nil {
+		return nil, errors.Wrapf(err, "key prefix %s", bucket.KeyPrefix)
+	}
+	rootPath, err := SplitIntoPath(userInfo.RootPath).Expand(vars)
+	if err != nil {
+		return nil, errors.Wrapf(err, "root path %s", userInfo.RootPath)
+	}
+	keyPrefix = keyPrefix.Join(rootPath)
+	if opts.PhantomObjectMap == nil {
+		opts.PhantomObjectMap = NewPhantomObjectMap()
+	}
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
 	return &S3BucketIO{
-		Ctx:                      ctx,
-		Bucket:                   bucket,
-		ReaderLookbackBufferSize: readerLookbackBufferSize,
-		ReaderMinChunkSize:       readerMinChunkSize,
-		ListerLookbackBufferSize: listerLookbackBufferSize,
-		UploadMemoryBufferPool:   uploadMemoryBufferPool,
-		Log:                      log,
-		PhantomObjectMap:         phantomObjectMap,
-		Perms:                    bucket.Perms,
-		ServerSideEncryption:     &bucket.ServerSideEncryption,
-		Now:                      now,
-		UserInfo:                 userInfo,
-		UploadChan:               uploadChan,
-		keyPrefix:                keyPrefix,
+		S3BucketIOOptions: opts,
+		Ctx:               ctx,
+		Bucket:            bucket,
+		Log:               log,
+		Perms:             bucket.Perms.Apply(userInfo.PermsOverride),
+		ACL:               append(append(ACL{}, userInfo.ACL...), bucket.ACL...),
+		UserInfo:          userInfo,
+		keyPrefix:         keyPrefix,
+	}, nil
+}
+
+// relPath returns a path requested by the client relative to the user root
+func (s3io *S3BucketIO) relPath(path string) Path {
+	p := SplitIntoPath(path)
+	if len(s3io.mountPoint) > 0 && p.IsPrefixed(s3io.mountPoint) {
+		p = p[len(s3io.mountPoint):]
+	} else if p.IsAbs() {
+		p = p[1:]
 	}
+	return p
 }
 
 func (s3io *S3BucketIO) buildKey(path string) Path {
-	return s3io.keyPrefix.Join(SplitIntoPath(path))
+	return s3io.keyPrefix.Join(s3io.relPath(path))
 }
 
-// Fileread downloads an S3 object and sends it to the client in streaming (using S3GetObjectOutputReader)
+// checkACL checks an operation over a path requested by the client against the access rules
+func (s3io *S3BucketIO) checkACL(method string, op string, path string) error {
+	allowed, rule := s3io.ACL.Check(op, s3io.relPath(path))
+	if allowed {
+		return nil
+	}
+	mPermissionsError.With(prometheus.Labels{"method": method, "rule": rule.String()}).Inc()
+	s3io.Log.WithFields(logrus.Fields{
+		"method": method,
+		"path":   path,
+		"rule":   rule.String(),
+	}).Error("Operation denied by access rule")
+	return permissionDenied("%s operation not allowed by access rule: %s", op, rule)
+}
+
+// Fileread opens a file for the client to download it
 func (s3io *S3BucketIO) Fileread(req *sftp.Request) (io.ReaderAt, error) {
 	lSuccess := prometheus.Labels{"method": req.Method, "status": "success"}
 	lFailure := prometheus.Labels{"method": req.Method, "status": "failure"}
 	if !s3io.Perms.Readable {
 		mOperationStatus.With(lFailure).Inc()
-		return nil, fmt.Errorf("read operation not allowed as per configuration")
+		return nil, permissionDenied("read operation not allowed as per configuration")
 	}
-	s3, err := s3io.Bucket.S3()
-	if err != nil {
-		s3io.Log.WithField("exception", err).Error("Error connecting to AWS")
+	if err := s3io.checkACL(req.Method, ACLOpRead, req.Filepath); err != nil {
 		mOperationStatus.With(lFailure).Inc()
-		mAWSSessionError.Inc()
 		return nil, err
 	}
 	key := s3io.buildKey(req.Filepath)
@@ -565,59 +710,32 @@ func (s3io *S3BucketIO) Fileread(req *sftp.Request) (io.ReaderAt, error) {
 		return nil, fmt.Errorf("trying to download an uploading file")
 	}
 
-	keyStr := key.String()
-	ctx := combineContext(s3io.Ctx, req.Context())
 	log := s3io.Log.WithFields(logrus.Fields{
 		"method": req.Method,
 		"bucket": s3io.Bucket.Bucket,
-		"key":    keyStr,
+		"key":    key.String(),
 	})
 	log.Info("User downloading key")
-	log.Debug("GetObject")
-	sse := s3io.ServerSideEncryption
-	goo, err := s3.GetObjectWithContext(
-		ctx,
-		&aws_s3.GetObjectInput{
-			Bucket:               &s3io.Bucket.Bucket,
-			Key:                  &keyStr,
-			SSECustomerAlgorithm: nilIfEmpty(sse.CustomerAlgorithm()),
-			SSECustomerKey:       nilIfEmpty(sse.CustomerKey),
-			SSECustomerKeyMD5:    nilIfEmpty(sse.CustomerKeyMD5),
-		},
-	)
+	r, err := s3io.Bucket.Storage.Open(combineContext(s3io.Ctx, req.Context()), s3io, key, log)
 	if err != nil {
 		mOperationStatus.With(lFailure).Inc()
 		return nil, err
 	}
-	oor := &S3GetObjectOutputReader{
-		Ctx:          ctx,
-		Goo:          goo,
-		Log:          log,
-		Lookback:     s3io.ReaderLookbackBufferSize,
-		MinChunkSize: s3io.ReaderMinChunkSize,
-	}
 	mOperationStatus.With(lSuccess).Inc()
-	return oor, nil
+	return r, nil
 }
 
-// Filewrite uploads a file to S3 (using S3MultipartUploadWriter)
+// Filewrite creates a file for the client to upload it
 func (s3io *S3BucketIO) Filewrite(req *sftp.Request) (io.WriterAt, error) {
 	lFailure := prometheus.Labels{"method": req.Method, "status": "failure"}
 	if !s3io.Perms.Writable {
 		mOperationStatus.With(lFailure).Inc()
-		return nil, fmt.Errorf("write operation not allowed as per configuration")
+		return nil, permissionDenied("write operation not allowed as per configuration")
 	}
-	s3, err := s3io.Bucket.S3()
-	if err != nil {
-		s3io.Log.WithField("exception", err).Error("Error connecting to AWS")
+	if err := s3io.checkACL(req.Method, ACLOpWrite, req.Filepath); err != nil {
 		mOperationStatus.With(lFailure).Inc()
-		mAWSSessionError.Inc()
 		return nil, err
 	}
-	maxObjectSize := s3io.Bucket.MaxObjectSize
-	if maxObjectSize < 0 {
-		maxObjectSize = int64(^uint(0) >> 1)
-	}
 	key := s3io.buildKey(req.Filepath)
 	info := &PhantomObjectInfo{
 		Key:          key,
@@ -630,23 +748,14 @@ func (s3io *S3BucketIO) Filewrite(req *sftp.Request) (io.WriterAt, error) {
 		"key":    key.String(),
 	})
 	log.Info("User uploading key")
-	log.Debug("S3MultipartUploadWriter.New")
-	oow := &S3MultipartUploadWriter{
-		Ctx:                    combineContext(s3io.Ctx, req.Context()),
-		Bucket:                 s3io.Bucket.Bucket,
-		Key:                    key,
-		S3:                     s3,
-		ServerSideEncryption:   s3io.ServerSideEncryption,
-		Log:                    log,
-		MaxObjectSize:          maxObjectSize,
-		UploadMemoryBufferPool: s3io.UploadMemoryBufferPool,
-		PhantomObjectMap:       s3io.PhantomObjectMap,
-		Info:                   info,
-		RequestMethod:          req.Method,
-		UploadChan:             s3io.UploadChan,
+	// clients resuming an upload open the file without truncating it
+	w, err := s3io.Bucket.Storage.Create(combineContext(s3io.Ctx, req.Context()), s3io, info, !req.Pflags().Trunc, req.Method, log)
+	if err != nil {
+		mOperationStatus.With(lFailure).Inc()
+		return nil, err
 	}
 	s3io.PhantomObjectMap.Add(info)
-	return oow, nil
+	return w, nil
 }
 
 // Filecmd executes a file command
@@ -661,7 +770,26 @@ func (s3io *S3BucketIO) Filecmd(req *sftp.Request) error {
 		if !s3io.Perms.Writable {
 			mOperationStatus.With(lFailure).Inc()
 			log.Error("Operation not allowed as per configuration")
-			return fmt.Errorf("write operation not allowed as per configuration")
+			return permissionDenied("write operation not allowed as per configuration")
+		}
+		if err := s3io.checkACL(req.Method, ACLOpWrite, req.Target); err != nil {
+			mOperationStatus.With(lFailure).Inc()
+			return err
+		}
+		// renaming a file deletes the original one, even if it's still being uploaded
+		if !s3io.Perms.Deletable {
+			mOperationStatus.With(lFailure).Inc()
+			log.Error("Operation not allowed as per configuration")
+			return permissionDenied("delete operation not allowed as per configuration")
+		}
+		if err := s3io.checkACL(req.Method, ACLOpDelete, req.Filepath); err != nil {
+			mOperationStatus.With(lFailure).Inc()
+			return err
+		}
+		// nor may files that can't be read be renamed to a name they could be read under
+		if err := s3io.checkACL(req.Method, ACLOpRead, req.Filepath); err != nil {
+			mOperationStatus.With(lFailure).Inc()
+			return err
 		}
 		src := s3io.buildKey(req.Filepath)
 		dest := s3io.buildKey(req.Target)
@@ -669,90 +797,37 @@ func (s3io *S3BucketIO) Filecmd(req *sftp.Request) error {
 			mOperationStatus.With(lIgnored).Inc()
 			return nil
 		}
-		s3, err := s3io.Bucket.S3()
-		if err != nil {
-			s3io.Log.WithField("exception", err).Error("Error connecting to AWS")
-			mOperationStatus.With(lFailure).Inc()
-			mAWSSessionError.Inc()
-			return err
-		}
-		srcStr := src.String()
-		destStr := dest.String()
-		copySource := s3io.Bucket.Bucket + "/" + srcStr
-		sse := s3io.ServerSideEncryption
 		log = log.WithFields(logrus.Fields{
 			"bucket": s3io.Bucket.Bucket,
-			"key":    srcStr,
+			"key":    src.String(),
 		})
-		log.Infof("Renaming key to: %s", destStr)
-		log.Debugf("CopyObject(dest=%s, Sse=%v)", destStr, sse.Type)
-		_, err = s3.CopyObjectWithContext(
-			combineContext(s3io.Ctx, req.Context()),
-			&aws_s3.CopyObjectInput{
-				ACL:                  &aclPrivate,
-				Bucket:               &s3io.Bucket.Bucket,
-				CopySource:           &copySource,
-				Key:                  &destStr,
-				ServerSideEncryption: sseTypes[sse.Type],
-				SSECustomerAlgorithm: nilIfEmpty(sse.CustomerAlgorithm()),
-				SSECustomerKey:       nilIfEmpty(sse.CustomerKey),
-				SSECustomerKeyMD5:    nilIfEmpty(sse.CustomerKeyMD5),
-				SSEKMSKeyId:          nilIfEmpty(sse.KMSKeyID),
-			},
-		)
-		if err != nil {
-			log.WithField("exception", err).Error("Error copying object")
-			mOperationStatus.With(lFailure).Inc()
-			return err
-		}
-		log.Debug("DeleteObject")
-		_, err = s3.DeleteObjectWithContext(
-			combineContext(s3io.Ctx, req.Context()),
-			&aws_s3.DeleteObjectInput{
-				Bucket: &s3io.Bucket.Bucket,
-				Key:    &srcStr,
-			},
-		)
-		if err != nil {
-			log.WithField("exception", err).Error("Error deleting object")
+		log.Infof("Renaming key to: %s", dest.String())
+		if err := s3io.Bucket.Storage.Rename(combineContext(s3io.Ctx, req.Context()), src, dest, log); err != nil {
 			mOperationStatus.With(lFailure).Inc()
 			return err
 		}
 		mOperationStatus.With(lSuccess).Inc()
 	case "Remove":
-		if !s3io.Perms.Writable {
+		if !s3io.Perms.Deletable {
 			mOperationStatus.With(lFailure).Inc()
 			log.Error("Operation not allowed as per configuration")
-			return fmt.Errorf("write operation not allowed as per configuration")
+			return permissionDenied("delete operation not allowed as per configuration")
+		}
+		if err := s3io.checkACL(req.Method, ACLOpDelete, req.Filepath); err != nil {
+			mOperationStatus.With(lFailure).Inc()
+			return err
 		}
 		key := s3io.buildKey(req.Filepath)
 		if s3io.PhantomObjectMap.Remove(key) != nil {
 			mOperationStatus.With(lIgnored).Inc()
 			return nil
 		}
-		s3, err := s3io.Bucket.S3()
-		if err != nil {
-			s3io.Log.WithField("exception", err).Error("Error connecting to AWS")
-			mOperationStatus.With(lFailure).Inc()
-			mAWSSessionError.Inc()
-			return err
-		}
-		keyStr := key.String()
 		log = log.WithFields(logrus.Fields{
 			"bucket": s3io.Bucket.Bucket,
-			"key":    keyStr,
+			"key":    key.String(),
 		})
 		log.Info("Deleting key")
-		log.Debug("DeleteObject")
-		_, err = s3.DeleteObjectWithContext(
-			combineContext(s3io.Ctx, req.Context()),
-			&aws_s3.DeleteObjectInput{
-				Bucket: &s3io.Bucket.Bucket,
-				Key:    &keyStr,
-			},
-		)
-		if err != nil {
-			log.WithField("exception", err).Error("Error deleting object")
+		if err := s3io.Bucket.Storage.Remove(combineContext(s3io.Ctx, req.Context()), key, log); err != nil {
 			mOperationStatus.With(lFailure).Inc()
 			return err
 		}
@@ -761,64 +836,40 @@ func (s3io *S3BucketIO) Filecmd(req *sftp.Request) error {
 		if !s3io.Perms.Writable {
 			mOperationStatus.With(lFailure).Inc()
 			log.Error("Operation not allowed as per configuration")
-			return fmt.Errorf("write operation not allowed as per configuration")
+			return permissionDenied("write operation not allowed as per configuration")
 		}
-		key := s3io.buildKey(req.Filepath)
-		keyStr := fmt.Sprintf("%s/", key.String())
-		s3, err := s3io.Bucket.S3()
-		if err != nil {
-			s3io.Log.WithField("exception", err).Error("Error connecting to AWS")
+		if err := s3io.checkACL(req.Method, ACLOpWrite, req.Filepath); err != nil {
 			mOperationStatus.With(lFailure).Inc()
-			mAWSSessionError.Inc()
 			return err
 		}
+		key := s3io.buildKey(req.Filepath)
 		log = log.WithFields(logrus.Fields{
 			"bucket": s3io.Bucket.Bucket,
-			"key":    keyStr,
+			"key":    key.String(),
 		})
 		log.Info("Creating directory")
-		log.Debug("Mkdir")
-		_, err = s3.PutObject(
-			&aws_s3.PutObjectInput{
-				Bucket: &s3io.Bucket.Bucket,
-				Key:    &keyStr,
-			},
-		)
-		if err != nil {
-			log.WithField("exception", err).Error("Error creating directory")
+		if err := s3io.Bucket.Storage.Mkdir(combineContext(s3io.Ctx, req.Context()), key, log); err != nil {
 			mOperationStatus.With(lFailure).Inc()
 			return err
 		}
 		mOperationStatus.With(lSuccess).Inc()
 	case "Rmdir":
-		if !s3io.Perms.Writable {
+		if !s3io.Perms.Deletable {
 			mOperationStatus.With(lFailure).Inc()
 			log.Error("Operation not allowed as per configuration")
-			return fmt.Errorf("write operation not allowed as per configuration")
+			return permissionDenied("delete operation not allowed as per configuration")
 		}
-		key := s3io.buildKey(req.Filepath)
-		keyStr := fmt.Sprintf("%s/", key.String())
-		s3, err := s3io.Bucket.S3()
-		if err != nil {
-			s3io.Log.WithField("exception", err).Error("Error connecting to AWS")
+		if err := s3io.checkACL(req.Method, ACLOpDelete, req.Filepath); err != nil {
 			mOperationStatus.With(lFailure).Inc()
-			mAWSSessionError.Inc()
 			return err
 		}
+		key := s3io.buildKey(req.Filepath)
 		log = log.WithFields(logrus.Fields{
 			"bucket": s3io.Bucket.Bucket,
-			"key":    keyStr,
+			"key":    key.String(),
 		})
 		log.Info("Deleting directory")
-		log.Debug("Rmdir")
-		_, err = s3.DeleteObject(
-			&aws_s3.DeleteObjectInput{
-				Bucket: &s3io.Bucket.Bucket,
-				Key:    &keyStr,
-			},
-		)
-		if err != nil {
-			log.WithField("exception", err).Error("Error deleting directory")
+		if err := s3io.Bucket.Storage.Rmdir(combineContext(s3io.Ctx, req.Context()), key, log); err != nil {
 			mOperationStatus.With(lFailure).Inc()
 			return err
 		}
@@ -830,19 +881,19 @@ func (s3io *S3BucketIO) Filecmd(req *sftp.Request) error {
 // Filelist executes a list operation
 func (s3io *S3BucketIO) Filelist(req *sftp.Request) (sftp.ListerAt, error) {
 	log := s3io.Log.WithField("method", req.Method)
-	lPermErr := prometheus.Labels{"method": req.Method}
-	s3, err := s3io.Bucket.S3()
-	if err != nil {
-		s3io.Log.WithField("exception", err).Error("Error connecting to AWS")
-		mAWSSessionError.Inc()
-		return nil, err
-	}
+	lPermErr := prometheus.Labels{"method": req.Method, "rule": ""}
 	switch req.Method {
 	case "Stat", "ReadLink":
 		if !s3io.Perms.Readable && !s3io.Perms.Listable {
 			mPermissionsError.With(lPermErr).Inc()
 			log.Error("Operation not allowed as per configuration")
-			return nil, fmt.Errorf("stat operation not allowed as per configuration")
+			return nil, permissionDenied("stat operation not allowed as per configuration")
+		}
+		// stats are allowed when the path may be either read or listed
+		if allowed, _ := s3io.ACL.Check(ACLOpRead, s3io.relPath(req.Filepath)); !allowed {
+			if err := s3io.checkACL(req.Method, ACLOpList, req.Filepath); err != nil {
+				return nil, err
+			}
 		}
 		key := s3io.buildKey(req.Filepath)
 		log = log.WithFields(logrus.Fields{
@@ -850,20 +901,15 @@ func (s3io *S3BucketIO) Filelist(req *sftp.Request) (sftp.ListerAt, error) {
 			"key":    key.String(),
 		})
 		log.Info("User read path stats")
-		return &S3ObjectStat{
-			Log:              log,
-			Ctx:              combineContext(s3io.Ctx, req.Context()),
-			Bucket:           s3io.Bucket.Bucket,
-			Root:             key.Equal(s3io.Bucket.KeyPrefix),
-			Key:              key,
-			S3:               s3,
-			PhantomObjectMap: s3io.PhantomObjectMap,
-		}, nil
+		return s3io.Bucket.Storage.Stat(combineContext(s3io.Ctx, req.Context()), s3io, key, log)
 	case "List":
 		if !s3io.Perms.Listable {
 			mPermissionsError.With(lPermErr).Inc()
 			log.Error("Operation not allowed as per configuration")
-			return nil, fmt.Errorf("listing operation not allowed as per configuration")
+			return nil, permissionDenied("listing operation not allowed as per configuration")
+		}
+		if err := s3io.checkACL(req.Method, ACLOpList, req.Filepath); err != nil {
+			return nil, err
 		}
 		prefix := s3io.buildKey(req.Filepath)
 		log = log.WithFields(logrus.Fields{
@@ -871,15 +917,7 @@ func (s3io *S3BucketIO) Filelist(req *sftp.Request) (sftp.ListerAt, error) {
 			"prefix": prefix.String(),
 		})
 		log.Info("User listed path stats")
-		return &S3ObjectLister{
-			Log:              s3io.Log,
-			Ctx:              combineContext(s3io.Ctx, req.Context()),
-			Bucket:           s3io.Bucket.Bucket,
-			Prefix:           prefix,
-			S3:               s3,
-			Lookback:         s3io.ListerLookbackBufferSize,
-			PhantomObjectMap: s3io.PhantomObjectMap,
-		}, nil
+		return s3io.Bucket.Storage.List(combineContext(s3io.Ctx, req.Context()), s3io, prefix, log)
 	default:
 		mPermissionsError.With(lPermErr).Inc()
 		log.Error("Unsupported method")
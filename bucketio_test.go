@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	fake_log "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestS3BucketIODeletePermission(t *testing.T) {
+	log, _ := fake_log.NewNullLogger()
+	bucket := &S3Bucket{
+		Name:   "test",
+		Bucket: "test",
+		Perms:  Perms{Readable: true, Writable: true, Listable: true, Deletable: true},
+	}
+	userInfo := &UserInfo{User: "user1", PermsOverride: PermsOverride{Deletable: &vFalse}}
+	s3io, err := NewS3BucketIO(context.Background(), bucket, userInfo, S3BucketIOOptions{}, log)
+	assert.NoError(t, err)
+	assert.Equal(t, Perms{Readable: true, Writable: true, Listable: true, Deletable: false}, s3io.Perms)
+
+	assert.Error(t, s3io.Filecmd(sftp.NewRequest("Remove", "/file")))
+	assert.Error(t, s3io.Filecmd(sftp.NewRequest("Rmdir", "/dir")))
+	req := sftp.NewRequest("Rename", "/file")
+	req.Target = "/file2"
+	assert.Error(t, s3io.Filecmd(req))
+
+	// neither may files being uploaded be renamed
+	s3io.PhantomObjectMap.Add(&PhantomObjectInfo{Key: s3io.buildKey("/uploading"), LastModified: time.Now()})
+	req = sftp.NewRequest("Rename", "/uploading")
+	req.Target = "/uploaded"
+	assert.Error(t, s3io.Filecmd(req))
+	assert.NotNil(t, s3io.PhantomObjectMap.Get(s3io.buildKey("/uploading")))
+}
+
+func TestS3BucketIOTemplatedKeyPrefix(t *testing.T) {
+	log, _ := fake_log.NewNullLogger()
+	bucket := &S3Bucket{
+		Name:      "test",
+		Bucket:    "test",
+		KeyPrefix: Path{"{bucket}"},
+		Users:     &UserStore{Name: "partners"},
+	}
+	s3io, err := NewS3BucketIO(context.Background(), bucket, &UserInfo{User: "user1", RootPath: "{auth}/{user}"}, S3BucketIOOptions{}, log)
+	assert.NoError(t, err)
+	assert.Equal(t, "test/partners/user1/file", s3io.buildKey("/file").String())
+
+	_, err = NewS3BucketIO(context.Background(), bucket, &UserInfo{User: "..", RootPath: "{user}"}, S3BucketIOOptions{}, log)
+	assert.Error(t, err)
+}
@@ -14,11 +14,21 @@ var (
 	minReaderLookbackBufferSize          = 1048576
 	minReaderMinChunkSize                = 262144
 	minListerLookbackBufferSize          = 100
-	defaultUploadMemoryBufferSize        = 5 * 1024 * 1024 // 5 MB
+	defaultReadAheadChunks               = 0
+	defaultReadAheadChunkSize            = 8 * 1024 * 1024   // 8 MB
+	defaultReadAheadMemoryBudget         = 256 * 1024 * 1024 // 256 MB
+	defaultUploadMemoryBufferSize        = 5 * 1024 * 1024   // 5 MB
 	defaultUploadMemoryBufferPoolSize    = 10
 	defaultUploadMemoryBufferPoolTimeout = 5 * time.Second
+	defaultUploadSpillQuota              = int64(10 * 1024 * 1024 * 1024) // 10 GB
 	defaultUploadWorkersCount            = 2
+	defaultWebhookTimeout                = 10 * time.Second
+	defaultLoginMaxFailuresPerIP         = 10
+	defaultLoginMaxFailuresPerUser       = 5
+	defaultLoginFailureWindow            = 10 * time.Minute
+	defaultLoginBanDuration              = 30 * time.Minute
 	vTrue                                = true
+	vFalse                               = false
 )
 
 // URL used in configuration
@@ -50,7 +60,13 @@ type AWSCredentialsConfig struct {
 // S3BucketConfig S3 bucket configuration
 type S3BucketConfig struct {
 	Profile                        string                   `toml:"profile"`
+	SharedCredentialsFile          string                   `toml:"shared_credentials_file"`
 	Credentials                    *AWSCredentialsConfig    `toml:"credentials"`
+	RoleARN                        string                   `toml:"role_arn"`
+	ExternalID                     string                   `toml:"external_id"`
+	SessionName                    string                   `toml:"session_name"`
+	WebIdentityTokenFile           string                   `toml:"web_identity_token_file"`
+	STSEndpoint                    string                   `toml:"sts_endpoint"`
 	Region                         string                   `toml:"region"`
 	Endpoint                       string                   `toml:"endpoint"`
 	DisableSSL                     *bool                    `toml:"disable_ssl"`
@@ -60,29 +76,55 @@ type S3BucketConfig struct {
 	BucketURL                      *URL                     `toml:"bucket_url"`
 	Auth                           string                   `toml:"auth"`
 	MaxObjectSize                  *int64                   `toml:"max_object_size"`
+	StagingPrefix                  string                   `toml:"staging_prefix"`
 	Readable                       *bool                    `toml:"readable"`
 	Writable                       *bool                    `toml:"writable"`
 	Listable                       *bool                    `toml:"listable"`
+	Deletable                      *bool                    `toml:"deletable"`
 	ServerSideEncryption           ServerSideEncryptionType `toml:"server_side_encryption"`
 	SSECustomerKey                 string                   `toml:"sse_customer_key"`
 	SSEKMSKeyID                    string                   `toml:"sse_kms_key_id"`
 	KeyboardInteractiveAuthEnabled bool                     `toml:"keyboard_interactive_auth"`
+	Rules                          []string                 `toml:"rules"`
+	AllowFrom                      []string                 `toml:"allow_from"`
+	DenyFrom                       []string                 `toml:"deny_from"`
 }
 
 // AuthUser information about user authentication
 type AuthUser struct {
-	Password             string `toml:"password"`
-	AuthenticationMethod string `toml:"authentication_method"`
-	RootPath             string `toml:"root_path"`
-	PublicKeys           string `toml:"public_keys"`
-	PublicKeyFile        string `toml:"public_key_file"`
+	Password             string     `toml:"password"`
+	AuthenticationMethod string     `toml:"authentication_method"`
+	RootPath             string     `toml:"root_path"`
+	PublicKeys           string     `toml:"public_keys"`
+	PublicKeyFile        string     `toml:"public_key_file"`
+	Rules                []string   `toml:"rules"`
+	TOTPSecret           string     `toml:"totp_secret"`
+	ExpiresAt            *timestamp `toml:"expires_at"`
+	Disabled             bool       `toml:"disabled"`
+	Schedule             []string   `toml:"schedule"`
+	ScheduleTimezone     string     `toml:"schedule_timezone"`
+	AllowFrom            []string   `toml:"allow_from"`
+	DenyFrom             []string   `toml:"deny_from"`
+	PermsOverride
 }
 
 // AuthConfig authentication configuration
 type AuthConfig struct {
-	Type       string              `toml:"type"`
-	UserDBFile string              `toml:"user_db_file"`
-	Users      map[string]AuthUser `toml:"users"`
+	Type                 string              `toml:"type"`
+	UserDBFile           string              `toml:"user_db_file"`
+	Users                map[string]AuthUser `toml:"users"`
+	Endpoint             *URL                `toml:"endpoint"`
+	Timeout              *duration           `toml:"timeout"`
+	TrustedUserCAKeys    string              `toml:"trusted_user_ca_keys"`
+	TrustedUserCAKeyFile string              `toml:"trusted_user_ca_key_file"`
+}
+
+// LoginLimiterConfig brute-force protection configuration
+type LoginLimiterConfig struct {
+	MaxFailuresPerIP   *int      `toml:"max_failures_per_ip"`
+	MaxFailuresPerUser *int      `toml:"max_failures_per_user"`
+	Window             *duration `toml:"window"`
+	BanDuration        *duration `toml:"ban_duration"`
 }
 
 // S3SFTPProxyConfig app global configuration
@@ -92,21 +134,51 @@ type S3SFTPProxyConfig struct {
 	Banner                        string                     `toml:"banner"`
 	ReaderLookbackBufferSize      *int                       `toml:"reader_lookback_buffer_size"`
 	ReaderMinChunkSize            *int                       `toml:"reader_min_chunk_size"`
+	ReadAheadChunks               *int                       `toml:"read_ahead_chunks"`
+	ReadAheadChunkSize            *int                       `toml:"read_ahead_chunk_size"`
+	ReadAheadMemoryBudget         *int                       `toml:"read_ahead_memory_budget"`
 	ListerLookbackBufferSize      *int                       `toml:"lister_lookback_buffer_size"`
 	UploadMemoryBufferSize        *int                       `toml:"upload_memory_buffer_size"`
 	UploadMemoryBufferPoolSize    *int                       `toml:"upload_memory_buffer_pool_size"`
 	UploadMemoryBufferPoolTimeout *duration                  `toml:"upload_memory_buffer_pool_timeout"`
+	UploadMaxPartBuffers          *int                       `toml:"upload_max_part_buffers"`
+	UploadSpillDir                string                     `toml:"upload_spill_dir"`
+	UploadSpillQuota              *int64                     `toml:"upload_spill_quota"`
+	UploadResumeTimeout           *duration                  `toml:"upload_resume_timeout"`
 	UploadWorkersCount            *int                       `toml:"upload_workers_count"`
 	Buckets                       map[string]*S3BucketConfig `toml:"buckets"`
 	AuthConfigs                   map[string]*AuthConfig     `toml:"auth"`
 	MetricsBind                   string                     `toml:"metrics_bind"`
 	MetricsEndpoint               string                     `toml:"metrics_endpoint"`
+	LoginLimiter                  *LoginLimiterConfig        `toml:"login_limiter"`
+}
+
+// IsLocal returns true if the objects of the bucket config are kept in a local directory rather than on S3
+func (bCfg *S3BucketConfig) IsLocal() bool {
+	return bCfg.BucketURL != nil && bCfg.BucketURL.Scheme == "file"
 }
 
 func validateAndFixupBucketConfig(bCfg *S3BucketConfig) error {
-	if bCfg.Profile != "" {
+	if bCfg.Profile != "" || bCfg.SharedCredentialsFile != "" {
 		if bCfg.Credentials != nil {
-			return fmt.Errorf("no credentials may be specified if profile is given")
+			return fmt.Errorf("no credentials may be specified if profile or shared_credentials_file is given")
+		}
+	}
+	if bCfg.RoleARN == "" {
+		if bCfg.ExternalID != "" || bCfg.SessionName != "" || bCfg.WebIdentityTokenFile != "" || bCfg.STSEndpoint != "" {
+			return fmt.Errorf("external_id, session_name, web_identity_token_file and sts_endpoint may only be specified if role_arn is given")
+		}
+	} else {
+		if bCfg.WebIdentityTokenFile != "" {
+			if bCfg.Credentials != nil || bCfg.Profile != "" || bCfg.SharedCredentialsFile != "" {
+				return fmt.Errorf("no credentials or profile may be specified if web_identity_token_file is given")
+			}
+			if bCfg.ExternalID != "" {
+				return fmt.Errorf("external_id may not be specified if web_identity_token_file is given")
+			}
+		}
+		if bCfg.SessionName == "" {
+			bCfg.SessionName = "s3-sftp-proxy"
 		}
 	}
 	if bCfg.BucketURL != nil {
@@ -116,14 +188,31 @@ func validateAndFixupBucketConfig(bCfg *S3BucketConfig) error {
 		if bCfg.KeyPrefix != "" {
 			return fmt.Errorf("root path may not be specified if bucket_url is given")
 		}
-		if bCfg.BucketURL.Host == "" {
-			return fmt.Errorf("bucket name is empty")
-		}
-		if bCfg.BucketURL.Scheme != "s3" {
-			return fmt.Errorf("bucket URL scheme must be \"s3\"")
+		switch bCfg.BucketURL.Scheme {
+		case "s3":
+			if bCfg.BucketURL.Host == "" {
+				return fmt.Errorf("bucket name is empty")
+			}
+			bCfg.Bucket = bCfg.BucketURL.Host
+			bCfg.KeyPrefix = bCfg.BucketURL.Path
+		case "file":
+			if bCfg.BucketURL.Host != "" && bCfg.BucketURL.Host != "localhost" {
+				return fmt.Errorf("file URL must refer to a local directory")
+			}
+			if bCfg.BucketURL.Path == "" {
+				return fmt.Errorf("directory is empty")
+			}
+			if bCfg.ServerSideEncryption != ServerSideEncryptionTypeNone {
+				return fmt.Errorf("server side encryption is not supported on local directories")
+			}
+			if bCfg.StagingPrefix != "" {
+				return fmt.Errorf("staging_prefix is not supported on local directories")
+			}
+			// the directory takes the place of the bucket name
+			bCfg.Bucket = bCfg.BucketURL.Path
+		default:
+			return fmt.Errorf("bucket URL scheme must be \"s3\" or \"file\"")
 		}
-		bCfg.Bucket = bCfg.BucketURL.Host
-		bCfg.KeyPrefix = bCfg.BucketURL.Path
 	} else {
 		if bCfg.Bucket == "" {
 			return fmt.Errorf("bucket name is empty")
@@ -141,6 +230,34 @@ func validateAndFixupBucketConfig(bCfg *S3BucketConfig) error {
 	if bCfg.Listable == nil {
 		bCfg.Listable = &vTrue
 	}
+	if bCfg.Deletable == nil {
+		// objects could only be deleted by writable buckets before deletable was introduced
+		bCfg.Deletable = bCfg.Writable
+	}
+	return nil
+}
+
+func validateAndFixupLoginLimiterConfig(lCfg *LoginLimiterConfig) error {
+	if lCfg.MaxFailuresPerIP == nil {
+		lCfg.MaxFailuresPerIP = &defaultLoginMaxFailuresPerIP
+	} else if *lCfg.MaxFailuresPerIP < 0 {
+		return fmt.Errorf("max_failures_per_ip may not be negative")
+	}
+	if lCfg.MaxFailuresPerUser == nil {
+		lCfg.MaxFailuresPerUser = &defaultLoginMaxFailuresPerUser
+	} else if *lCfg.MaxFailuresPerUser < 0 {
+		return fmt.Errorf("max_failures_per_user may not be negative")
+	}
+	if lCfg.Window == nil {
+		lCfg.Window = &duration{defaultLoginFailureWindow}
+	} else if lCfg.Window.Duration <= 0 {
+		return fmt.Errorf("window must be positive")
+	}
+	if lCfg.BanDuration == nil {
+		lCfg.BanDuration = &duration{defaultLoginBanDuration}
+	} else if lCfg.BanDuration.Duration <= 0 {
+		return fmt.Errorf("ban_duration must be positive")
+	}
 	return nil
 }
 
@@ -155,10 +272,43 @@ func validateAndFixupAuthConfigInplace(aCfg *AuthConfig) error {
 	return nil
 }
 
+func validateAndFixupAuthConfigFile(aCfg *AuthConfig) error {
+	if aCfg.UserDBFile == "" {
+		return fmt.Errorf(`no "user_db_file" present`)
+	}
+	if len(aCfg.Users) > 0 {
+		return fmt.Errorf(`users may not be specified when auth type is "file"`)
+	}
+	return nil
+}
+
+func validateAndFixupAuthConfigWebhook(aCfg *AuthConfig) error {
+	if aCfg.UserDBFile != "" {
+		return fmt.Errorf(`user_db_file may not be specified when auth type is "webhook"`)
+	}
+	if len(aCfg.Users) > 0 {
+		return fmt.Errorf(`users may not be specified when auth type is "webhook"`)
+	}
+	if aCfg.Endpoint == nil {
+		return fmt.Errorf(`no "endpoint" present`)
+	}
+	if aCfg.Endpoint.Scheme != "http" && aCfg.Endpoint.Scheme != "https" {
+		return fmt.Errorf(`endpoint URL scheme must be "http" or "https"`)
+	}
+	if aCfg.Timeout == nil {
+		aCfg.Timeout = &duration{defaultWebhookTimeout}
+	}
+	return nil
+}
+
 func validateAndFixupAuthConfig(aCfg *AuthConfig) error {
 	switch aCfg.Type {
 	case "inplace":
 		return validateAndFixupAuthConfigInplace(aCfg)
+	case "file":
+		return validateAndFixupAuthConfigFile(aCfg)
+	case "webhook":
+		return validateAndFixupAuthConfigWebhook(aCfg)
 	default:
 		return fmt.Errorf("unknown auth type: %s", aCfg.Type)
 	}
@@ -204,6 +354,24 @@ func ReadConfig(tomlStr string) (*S3SFTPProxyConfig, error) {
 		return nil, fmt.Errorf("reader_min_chunk_size must be equal to or greater than %d", minReaderMinChunkSize)
 	}
 
+	if cfg.ReadAheadChunks == nil {
+		cfg.ReadAheadChunks = &defaultReadAheadChunks
+	} else if *cfg.ReadAheadChunks < 0 {
+		return nil, fmt.Errorf("read_ahead_chunks may not be negative")
+	}
+
+	if cfg.ReadAheadChunkSize == nil {
+		cfg.ReadAheadChunkSize = &defaultReadAheadChunkSize
+	} else if *cfg.ReadAheadChunkSize < minReaderMinChunkSize {
+		return nil, fmt.Errorf("read_ahead_chunk_size must be equal to or greater than %d", minReaderMinChunkSize)
+	}
+
+	if cfg.ReadAheadMemoryBudget == nil {
+		cfg.ReadAheadMemoryBudget = &defaultReadAheadMemoryBudget
+	} else if *cfg.ReadAheadMemoryBudget < *cfg.ReadAheadChunkSize {
+		return nil, fmt.Errorf("read_ahead_memory_budget must be equal to or greater than read_ahead_chunk_size")
+	}
+
 	if cfg.ListerLookbackBufferSize == nil {
 		cfg.ListerLookbackBufferSize = &minListerLookbackBufferSize
 	} else if *cfg.ListerLookbackBufferSize < minListerLookbackBufferSize {
@@ -222,10 +390,37 @@ func ReadConfig(tomlStr string) (*S3SFTPProxyConfig, error) {
 		cfg.UploadMemoryBufferPoolTimeout = &duration{defaultUploadMemoryBufferPoolTimeout}
 	}
 
+	if cfg.UploadSpillDir == "" {
+		if cfg.UploadSpillQuota != nil {
+			return nil, fmt.Errorf("upload_spill_quota may only be specified if upload_spill_dir is given")
+		}
+	} else if cfg.UploadSpillQuota == nil {
+		cfg.UploadSpillQuota = &defaultUploadSpillQuota
+	} else if *cfg.UploadSpillQuota < int64(*cfg.UploadMemoryBufferSize) {
+		return nil, fmt.Errorf("upload_spill_quota must be equal to or greater than upload_memory_buffer_size")
+	}
+
+	if cfg.UploadResumeTimeout == nil {
+		cfg.UploadResumeTimeout = &duration{}
+	} else if cfg.UploadResumeTimeout.Duration < 0 {
+		return nil, fmt.Errorf("upload_resume_timeout may not be negative")
+	}
+
 	if cfg.UploadWorkersCount == nil {
 		cfg.UploadWorkersCount = &defaultUploadWorkersCount
 	}
 
+	if cfg.UploadMaxPartBuffers == nil {
+		// enough for every worker to upload a part while the next one is filled
+		maxPartBuffers := 1
+		if workers := *cfg.UploadWorkersCount; workers > 0 && *cfg.UploadMemoryBufferPoolSize > 2*workers {
+			maxPartBuffers = *cfg.UploadMemoryBufferPoolSize / (2 * workers)
+		}
+		cfg.UploadMaxPartBuffers = &maxPartBuffers
+	} else if *cfg.UploadMaxPartBuffers < 1 || *cfg.UploadMaxPartBuffers > *cfg.UploadMemoryBufferPoolSize {
+		return nil, fmt.Errorf("upload_max_part_buffers must be between 1 and upload_memory_buffer_pool_size")
+	}
+
 	for name, bCfg := range cfg.Buckets {
 		err := validateAndFixupBucketConfig(bCfg)
 		if err != nil {
@@ -240,6 +435,13 @@ func ReadConfig(tomlStr string) (*S3SFTPProxyConfig, error) {
 		}
 	}
 
+	if cfg.LoginLimiter != nil {
+		err := validateAndFixupLoginLimiterConfig(cfg.LoginLimiter)
+		if err != nil {
+			return nil, errors.Wrapf(err, "login_limiter")
+		}
+	}
+
 	return cfg, err
 }
 
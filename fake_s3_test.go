@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeS3Object object kept by fakeS3
+type fakeS3Object struct {
+	data         []byte
+	lastModified time.Time
+	metadata     map[string]string
+}
+
+func (o *fakeS3Object) etag() string {
+	sum := md5.Sum(o.data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// fakeS3 in-memory stand-in for S3, serving the subset of its REST API the proxy uses with path-style addressing
+type fakeS3 struct {
+	Bucket string
+	// AccessKeyID access key requests must be signed with, if not empty
+	AccessKeyID    string
+	mtx            sync.Mutex
+	objects        map[string]*fakeS3Object
+	uploads        map[string]map[int][]byte
+	uploadMetadata map[string]map[string]string
+	nextUploadID   int
+	deniedPrefix   string
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	return &fakeS3{
+		Bucket:         bucket,
+		objects:        map[string]*fakeS3Object{},
+		uploads:        map[string]map[int][]byte{},
+		uploadMetadata: map[string]map[string]string{},
+	}
+}
+
+// Get returns the content of an object, or nil if there's no such object
+func (f *fakeS3) Get(key string) []byte {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if o, ok := f.objects[key]; ok {
+		return o.data
+	}
+	return nil
+}
+
+// Metadata returns the user metadata of an object, or nil if there's no such object
+func (f *fakeS3) Metadata(key string) map[string]string {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if o, ok := f.objects[key]; ok {
+		return o.metadata
+	}
+	return nil
+}
+
+// Put stores an object
+func (f *fakeS3) Put(key string, data []byte) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.objects[key] = &fakeS3Object{data: data, lastModified: time.Now()}
+}
+
+// Deny makes requests on the keys under a prefix fail with AccessDenied
+func (f *fakeS3) Deny(prefix string) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.deniedPrefix = prefix
+}
+
+// Keys returns the keys of all the objects, sorted
+func (f *fakeS3) Keys() []string {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	keys := make([]string, 0, len(f.objects))
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func s3Timestamp(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+// metadataFromHeader returns the user metadata sent along with a request
+func metadataFromHeader(h http.Header) map[string]string {
+	metadata := map[string]string{}
+	for name := range h {
+		if strings.HasPrefix(name, "X-Amz-Meta-") {
+			metadata[strings.ToLower(name[len("X-Amz-Meta-"):])] = h.Get(name)
+		}
+	}
+	return metadata
+}
+
+// copySource returns the object a copy request refers to
+func (f *fakeS3) copySource(r *http.Request) (*fakeS3Object, bool) {
+	src, _ := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	src = strings.TrimPrefix(strings.TrimPrefix(src, "/"), f.Bucket+"/")
+	o, ok := f.objects[src]
+	return o, ok
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func writeS3Result(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(v)
+}
+
+type fakeS3ListContent struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int
+}
+
+type fakeS3CommonPrefix struct {
+	Prefix string
+}
+
+type fakeS3ListResult struct {
+	XMLName        xml.Name `xml:"ListBucketResult"`
+	Name           string
+	Prefix         string
+	Delimiter      string
+	KeyCount       int
+	IsTruncated    bool
+	Contents       []fakeS3ListContent
+	CommonPrefixes []fakeS3CommonPrefix
+}
+
+type fakeS3Grantee struct {
+	ID string
+}
+
+type fakeS3Grant struct {
+	Grantee    fakeS3Grantee
+	Permission string
+}
+
+type fakeS3ACLResult struct {
+	XMLName           xml.Name `xml:"AccessControlPolicy"`
+	Owner             fakeS3Grantee
+	AccessControlList []fakeS3Grant `xml:"AccessControlList>Grant"`
+}
+
+type fakeS3CopyResult struct {
+	XMLName      xml.Name `xml:"CopyObjectResult"`
+	ETag         string
+	LastModified string
+}
+
+type fakeS3CopyPartResult struct {
+	XMLName      xml.Name `xml:"CopyPartResult"`
+	ETag         string
+	LastModified string
+}
+
+type fakeS3InitiateResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Bucket   string
+	Key      string
+	UploadId string
+}
+
+type fakeS3CompleteRequest struct {
+	Parts []struct {
+		PartNumber int
+	} `xml:"Part"`
+}
+
+type fakeS3CompleteResult struct {
+	XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+	Bucket  string
+	Key     string
+	ETag    string
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, q url.Values) {
+	prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+	result := &fakeS3ListResult{Name: f.Bucket, Prefix: prefix, Delimiter: delimiter}
+	seen := map[string]bool{}
+	keys := make([]string, 0, len(f.objects))
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			commonPrefix := key[:len(prefix)+i+len(delimiter)]
+			if !seen[commonPrefix] {
+				seen[commonPrefix] = true
+				result.CommonPrefixes = append(result.CommonPrefixes, fakeS3CommonPrefix{commonPrefix})
+			}
+			continue
+		}
+		o := f.objects[key]
+		result.Contents = append(result.Contents, fakeS3ListContent{
+			Key:          key,
+			LastModified: s3Timestamp(o.lastModified),
+			ETag:         o.etag(),
+			Size:         len(o.data),
+		})
+	}
+	result.KeyCount = len(result.Contents) + len(result.CommonPrefixes)
+	writeS3Result(w, result)
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	bucket, key := path, ""
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		bucket, key = path[:i], path[i+1:]
+	}
+	if f.AccessKeyID != "" && !strings.Contains(r.Header.Get("Authorization"), "Credential="+f.AccessKeyID+"/") {
+		writeS3Error(w, http.StatusForbidden, "InvalidAccessKeyId")
+		return
+	}
+	if bucket != f.Bucket {
+		writeS3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	if f.deniedPrefix != "" && strings.HasPrefix(key+r.URL.Query().Get("prefix"), f.deniedPrefix) {
+		writeS3Error(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+	q := r.URL.Query()
+	_, isACL := q["acl"]
+	_, isUploads := q["uploads"]
+	uploadID := q.Get("uploadId")
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		f.list(w, q)
+	case r.Method == http.MethodPost && isUploads:
+		f.nextUploadID++
+		uploadID = strconv.Itoa(f.nextUploadID)
+		f.uploads[uploadID] = map[int][]byte{}
+		f.uploadMetadata[uploadID] = metadataFromHeader(r.Header)
+		writeS3Result(w, &fakeS3InitiateResult{Bucket: bucket, Key: key, UploadId: uploadID})
+	case r.Method == http.MethodPut && uploadID != "":
+		parts, ok := f.uploads[uploadID]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		partNumber, _ := strconv.Atoi(q.Get("partNumber"))
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			srcObj, ok := f.copySource(r)
+			if !ok {
+				writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+				return
+			}
+			var start, end int
+			fmt.Sscanf(r.Header.Get("X-Amz-Copy-Source-Range"), "bytes=%d-%d", &start, &end)
+			data := srcObj.data[start : end+1]
+			parts[partNumber] = data
+			writeS3Result(w, &fakeS3CopyPartResult{ETag: (&fakeS3Object{data: data}).etag(), LastModified: s3Timestamp(time.Now())})
+			return
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		parts[partNumber] = data
+		w.Header().Set("ETag", (&fakeS3Object{data: data}).etag())
+	case r.Method == http.MethodPost && uploadID != "":
+		parts, ok := f.uploads[uploadID]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		var req fakeS3CompleteRequest
+		if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeS3Error(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		buf := &bytes.Buffer{}
+		for _, part := range req.Parts {
+			data, ok := parts[part.PartNumber]
+			if !ok {
+				writeS3Error(w, http.StatusBadRequest, "InvalidPart")
+				return
+			}
+			buf.Write(data)
+		}
+		o := &fakeS3Object{data: buf.Bytes(), lastModified: time.Now(), metadata: f.uploadMetadata[uploadID]}
+		delete(f.uploads, uploadID)
+		delete(f.uploadMetadata, uploadID)
+		f.objects[key] = o
+		writeS3Result(w, &fakeS3CompleteResult{Bucket: bucket, Key: key, ETag: o.etag()})
+	case r.Method == http.MethodDelete && uploadID != "":
+		delete(f.uploads, uploadID)
+		delete(f.uploadMetadata, uploadID)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		srcObj, ok := f.copySource(r)
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		o := &fakeS3Object{data: srcObj.data, lastModified: time.Now(), metadata: srcObj.metadata}
+		if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+			o.metadata = metadataFromHeader(r.Header)
+		}
+		f.objects[key] = o
+		writeS3Result(w, &fakeS3CopyResult{ETag: o.etag(), LastModified: s3Timestamp(o.lastModified)})
+	case r.Method == http.MethodPut:
+		data, _ := ioutil.ReadAll(r.Body)
+		o := &fakeS3Object{data: data, lastModified: time.Now(), metadata: metadataFromHeader(r.Header)}
+		f.objects[key] = o
+		w.Header().Set("ETag", o.etag())
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet && isACL:
+		if _, ok := f.objects[key]; !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		writeS3Result(w, &fakeS3ACLResult{
+			Owner:             fakeS3Grantee{ID: "owner"},
+			AccessControlList: []fakeS3Grant{{Grantee: fakeS3Grantee{ID: "owner"}, Permission: "FULL_CONTROL"}},
+		})
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		o, ok := f.objects[key]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", o.etag())
+		w.Header().Set("Content-Type", "application/octet-stream")
+		for name, value := range o.metadata {
+			w.Header().Set("X-Amz-Meta-"+name, value)
+		}
+		// the body may not be read for a while, which must not hold other requests
+		f.mtx.Unlock()
+		defer f.mtx.Lock()
+		http.ServeContent(w, r, key, o.lastModified, bytes.NewReader(o.data))
+	default:
+		writeS3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
@@ -12,5 +12,5 @@ require (
 	github.com/prometheus/client_golang v1.3.0
 	github.com/sirupsen/logrus v1.4.2
 	github.com/stretchr/testify v1.4.0
-	golang.org/x/crypto v0.0.0-20191001170739-f9e2070545dc
+	golang.org/x/crypto v0.22.0
 )
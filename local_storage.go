@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// localUploadPrefix prefix of the temporary files uploads are written to until they're complete.
+// They are hidden from listings.
+const localUploadPrefix = ".s3-sftp-proxy-upload-"
+
+// LocalStorage storage backed by a directory of the local filesystem. Keys are paths relative to the directory.
+type LocalStorage struct {
+	Root string
+}
+
+// NewLocalStorage creates a new local storage rooted at the directory passed as parameter, which must exist
+func NewLocalStorage(root string) (*LocalStorage, error) {
+	st, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !st.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+	return &LocalStorage{Root: root}, nil
+}
+
+// path returns the local path of a key. Keys are built from cleaned paths, but they're checked anyway
+// so that nothing outside the root directory may be reached.
+func (ls *LocalStorage) path(key Path) (string, error) {
+	for _, c := range key {
+		if c == "" || c == "." || c == ".." || strings.ContainsRune(c, filepath.Separator) {
+			return "", fmt.Errorf("invalid key: %s", key)
+		}
+	}
+	return filepath.Join(append([]string{ls.Root}, key...)...), nil
+}
+
+// LocalFileReader reader of a local file, counting the bytes read
+type LocalFileReader struct {
+	*os.File
+}
+
+// ReadAt reads data present on offset in the file and inserts on buffer passed as parameter
+func (r *LocalFileReader) ReadAt(buf []byte, off int64) (int, error) {
+	n, err := r.File.ReadAt(buf, off)
+	mReadsBytesTotal.Add(float64(n))
+	return n, err
+}
+
+// Open opens a local file
+func (ls *LocalStorage) Open(ctx context.Context, s3io *S3BucketIO, key Path, log logrus.FieldLogger) (io.ReaderAt, error) {
+	p, err := ls.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	st, err := f.Stat()
+	if err == nil && st.IsDir() {
+		err = fmt.Errorf("%s is a directory", key)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &LocalFileReader{File: f}, nil
+}
+
+// LocalFileWriter writes an upload into a temporary file, which is renamed after the phantom object
+// of the upload when closed
+type LocalFileWriter struct {
+	Storage          *LocalStorage
+	File             *os.File
+	Log              logrus.FieldLogger
+	MaxObjectSize    int64
+	Info             *PhantomObjectInfo
+	PhantomObjectMap *PhantomObjectMap
+	RequestMethod    string
+	mtx              sync.Mutex
+	err              error
+}
+
+// WriteAt writes data on offset in the temporary file
+func (w *LocalFileWriter) WriteAt(buf []byte, off int64) (int, error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if w.err == nil && w.MaxObjectSize >= 0 && off+int64(len(buf)) > w.MaxObjectSize {
+		w.err = quotaExceeded("file too large: maximum allowed size is %d bytes", w.MaxObjectSize)
+	}
+	if w.err != nil {
+		w.Log.WithField("exception", w.err).Error("Error on WriteAt")
+		return 0, w.err
+	}
+	n, err := w.File.WriteAt(buf, off)
+	if err != nil {
+		w.Log.WithField("exception", err).Error("Error on WriteAt")
+		w.err = err
+		return n, err
+	}
+	w.Info.SetSizeIfGreater(off + int64(n))
+	mWritesBytesTotal.Add(float64(n))
+	return n, nil
+}
+
+// Close closes the temporary file and moves it to its final place
+func (w *LocalFileWriter) Close() error {
+	w.PhantomObjectMap.RemoveByInfoPtr(w.Info)
+
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	err := w.File.Close()
+	if w.err != nil {
+		err = w.err
+	}
+	var dest string
+	if err == nil {
+		dest, err = w.Storage.path(w.Info.GetOne().Key)
+	}
+	if err == nil {
+		err = os.Rename(w.File.Name(), dest)
+	}
+	if err != nil {
+		w.Log.WithField("exception", err).Debug("Error closing upload")
+		os.Remove(w.File.Name())
+		mOperationStatus.With(prometheus.Labels{"method": w.RequestMethod, "status": "failure"}).Inc()
+		return err
+	}
+	mOperationStatus.With(prometheus.Labels{"method": w.RequestMethod, "status": "success"}).Inc()
+	return nil
+}
+
+// Create creates a temporary file next to the one to be uploaded. Interrupted uploads are not resumed.
+func (ls *LocalStorage) Create(ctx context.Context, s3io *S3BucketIO, info *PhantomObjectInfo, resume bool, requestMethod string, log logrus.FieldLogger) (io.WriterAt, error) {
+	p, err := ls.path(info.Key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(p), localUploadPrefix)
+	if err != nil {
+		log.WithField("exception", err).Error("Error creating temporary file")
+		return nil, err
+	}
+	return &LocalFileWriter{
+		Storage:          ls,
+		File:             f,
+		Log:              log,
+		MaxObjectSize:    s3io.Bucket.MaxObjectSize,
+		Info:             info,
+		PhantomObjectMap: s3io.PhantomObjectMap,
+		RequestMethod:    requestMethod,
+	}, nil
+}
+
+// Rename renames a local file or directory
+func (ls *LocalStorage) Rename(ctx context.Context, src Path, dest Path, log logrus.FieldLogger) error {
+	srcPath, err := ls.path(src)
+	if err != nil {
+		return err
+	}
+	destPath, err := ls.path(dest)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(srcPath, destPath); err != nil {
+		log.WithField("exception", err).Error("Error renaming file")
+		return err
+	}
+	return nil
+}
+
+// Remove removes a local file. Directories are removed through Rmdir.
+func (ls *LocalStorage) Remove(ctx context.Context, key Path, log logrus.FieldLogger) error {
+	p, err := ls.path(key)
+	if err != nil {
+		return err
+	}
+	st, err := os.Lstat(p)
+	if err == nil && st.IsDir() {
+		err = fmt.Errorf("%s is a directory", key)
+	}
+	if err == nil {
+		err = os.Remove(p)
+	}
+	if err != nil {
+		log.WithField("exception", err).Error("Error deleting file")
+		return err
+	}
+	return nil
+}
+
+// Mkdir creates a local directory
+func (ls *LocalStorage) Mkdir(ctx context.Context, key Path, log logrus.FieldLogger) error {
+	p, err := ls.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Mkdir(p, 0755); err != nil {
+		log.WithField("exception", err).Error("Error creating directory")
+		return err
+	}
+	return nil
+}
+
+// Rmdir removes an empty local directory
+func (ls *LocalStorage) Rmdir(ctx context.Context, key Path, log logrus.FieldLogger) error {
+	p, err := ls.path(key)
+	if err != nil {
+		return err
+	}
+	st, err := os.Lstat(p)
+	if err == nil && !st.IsDir() {
+		err = fmt.Errorf("%s is not a directory", key)
+	}
+	if err == nil {
+		err = os.Remove(p)
+	}
+	if err != nil {
+		log.WithField("exception", err).Error("Error deleting directory")
+		return err
+	}
+	return nil
+}
+
+func localFileInfo(name string, st os.FileInfo) *ObjectFileInfo {
+	return &ObjectFileInfo{
+		_Name:         name,
+		_LastModified: st.ModTime(),
+		_Size:         st.Size(),
+		_Mode:         st.Mode() & (os.ModeDir | os.ModePerm),
+	}
+}
+
+func phantomFileInfo(phInfo *PhantomObjectInfo) *ObjectFileInfo {
+	_phInfo := phInfo.GetOne()
+	return &ObjectFileInfo{
+		_Name:         _phInfo.Key.Base(),
+		_LastModified: _phInfo.LastModified,
+		_Size:         _phInfo.Size,
+		_Mode:         0600, // TODO
+	}
+}
+
+// Stat obtains the file information of a local file or directory
+func (ls *LocalStorage) Stat(ctx context.Context, s3io *S3BucketIO, key Path, log logrus.FieldLogger) (sftp.ListerAt, error) {
+	if phInfo := s3io.PhantomObjectMap.Get(key); phInfo != nil {
+		return FileInfoLister{phantomFileInfo(phInfo)}, nil
+	}
+	p, err := ls.path(key)
+	if err != nil {
+		return nil, err
+	}
+	st, err := os.Stat(p)
+	if err != nil {
+		mOperationStatus.With(prometheus.Labels{"method": "Stat", "status": "noSuchObject"}).Inc()
+		return nil, os.ErrNotExist
+	}
+	name := key.Base()
+	if key.Equal(s3io.keyPrefix) {
+		name = "/"
+	}
+	return FileInfoLister{localFileInfo(name, st)}, nil
+}
+
+// List lists a local directory, along with the files being uploaded into it
+func (ls *LocalStorage) List(ctx context.Context, s3io *S3BucketIO, prefix Path, log logrus.FieldLogger) (sftp.ListerAt, error) {
+	lFailure := prometheus.Labels{"method": "Ls", "status": "failure"}
+	p, err := ls.path(prefix)
+	if err != nil {
+		mOperationStatus.With(lFailure).Inc()
+		return nil, err
+	}
+	sts, err := ioutil.ReadDir(p)
+	if err != nil {
+		log.WithField("exception", err).Error("Error listing directory")
+		mOperationStatus.With(lFailure).Inc()
+		return nil, err
+	}
+	result := FileInfoLister{
+		&ObjectFileInfo{_Name: ".", _LastModified: time.Unix(1, 0), _Mode: 0755 | os.ModeDir},
+		&ObjectFileInfo{_Name: "..", _LastModified: time.Unix(1, 0), _Mode: 0755 | os.ModeDir},
+	}
+	for _, phInfo := range s3io.PhantomObjectMap.List(prefix) {
+		result = append(result, phantomFileInfo(phInfo))
+	}
+	for _, st := range sts {
+		if strings.HasPrefix(st.Name(), localUploadPrefix) {
+			continue
+		}
+		result = append(result, localFileInfo(st.Name(), st))
+	}
+	mOperationStatus.With(prometheus.Labels{"method": "Ls", "status": "success"}).Inc()
+	return result, nil
+}
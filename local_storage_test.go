@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/pkg/sftp"
+	fake_log "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func newLocalS3BucketIO(t *testing.T, root string) *S3BucketIO {
+	log, _ := fake_log.NewNullLogger()
+	storage, err := NewLocalStorage(root)
+	assert.NoError(t, err)
+	bucket := &S3Bucket{
+		Name:          "local",
+		Bucket:        root,
+		MaxObjectSize: 16,
+		Perms:         Perms{Readable: true, Writable: true, Listable: true, Deletable: true},
+		Storage:       storage,
+	}
+	s3io, err := NewS3BucketIO(context.Background(), bucket, &UserInfo{User: "user1"}, S3BucketIOOptions{}, log)
+	assert.NoError(t, err)
+	return s3io
+}
+
+func listNames(t *testing.T, s3io *S3BucketIO, path string) []string {
+	lister, err := s3io.Filelist(sftp.NewRequest("List", path))
+	assert.NoError(t, err)
+	result := make([]os.FileInfo, 10)
+	n, err := lister.ListAt(result, 0)
+	assert.Equal(t, io.EOF, err)
+	var names []string
+	for _, fi := range result[:n] {
+		names = append(names, fi.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestLocalStorage(t *testing.T) {
+	root, err := ioutil.TempDir("", "s3-sftp-proxy")
+	assert.NoError(t, err)
+	defer os.RemoveAll(root)
+	s3io := newLocalS3BucketIO(t, root)
+
+	assert.NoError(t, s3io.Filecmd(sftp.NewRequest("Mkdir", "/dir")))
+	w, err := s3io.Filewrite(sftp.NewRequest("Put", "/dir/file"))
+	assert.NoError(t, err)
+	_, err = w.WriteAt([]byte("world"), 6)
+	assert.NoError(t, err)
+	_, err = w.WriteAt([]byte("hello "), 0)
+	assert.NoError(t, err)
+
+	// uploads only show up once complete, but the file being uploaded is listed
+	_, err = os.Stat(filepath.Join(root, "dir", "file"))
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, []string{".", "..", "file"}, listNames(t, s3io, "/dir"))
+	assert.NoError(t, w.(io.Closer).Close())
+	assert.Equal(t, []string{".", "..", "file"}, listNames(t, s3io, "/dir"))
+
+	lister, err := s3io.Filelist(sftp.NewRequest("Stat", "/dir/file"))
+	assert.NoError(t, err)
+	result := make([]os.FileInfo, 1)
+	n, _ := lister.ListAt(result, 0)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, int64(11), result[0].Size())
+	assert.False(t, result[0].IsDir())
+
+	r, err := s3io.Fileread(sftp.NewRequest("Get", "/dir/file"))
+	assert.NoError(t, err)
+	buf := make([]byte, 5)
+	n, err = r.ReadAt(buf, 6)
+	assert.NoError(t, err)
+	assert.Equal(t, "world", string(buf[:n]))
+	r.(io.Closer).Close()
+
+	req := sftp.NewRequest("Rename", "/dir/file")
+	req.Target = "/file2"
+	assert.NoError(t, s3io.Filecmd(req))
+	assert.Equal(t, []string{".", "..", "dir", "file2"}, listNames(t, s3io, "/"))
+
+	assert.Error(t, s3io.Filecmd(sftp.NewRequest("Remove", "/dir")))
+	assert.NoError(t, s3io.Filecmd(sftp.NewRequest("Rmdir", "/dir")))
+	assert.NoError(t, s3io.Filecmd(sftp.NewRequest("Remove", "/file2")))
+	assert.Equal(t, []string{".", ".."}, listNames(t, s3io, "/"))
+
+	_, err = s3io.Filelist(sftp.NewRequest("Stat", "/file2"))
+	assert.Equal(t, os.ErrNotExist, err)
+}
+
+func TestLocalStorageMaxObjectSize(t *testing.T) {
+	root, err := ioutil.TempDir("", "s3-sftp-proxy")
+	assert.NoError(t, err)
+	defer os.RemoveAll(root)
+	s3io := newLocalS3BucketIO(t, root)
+
+	w, err := s3io.Filewrite(sftp.NewRequest("Put", "/file"))
+	assert.NoError(t, err)
+	_, err = w.WriteAt(make([]byte, 17), 0)
+	assert.Error(t, err)
+	assert.Error(t, w.(io.Closer).Close())
+	// the temporary file is cleaned up
+	names, err := ioutil.ReadDir(root)
+	assert.NoError(t, err)
+	assert.Empty(t, names)
+}
+
+func TestLocalStoragePath(t *testing.T) {
+	ls := &LocalStorage{Root: "/srv/sftp"}
+	p, err := ls.path(Path{"dir", "file"})
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join("/srv/sftp", "dir", "file"), p)
+	_, err = ls.path(Path{"dir", "..", "..", "etc"})
+	assert.Error(t, err)
+}
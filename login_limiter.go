@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// Kinds of keys failures are tracked by
+const (
+	loginLimiterKindIP   = "ip"
+	loginLimiterKindUser = "user"
+)
+
+// loginFailureError error of a login attempt whose credentials were checked and didn't match. Attempts failing
+// for any other reason, such as an authentication method not being enabled, are not counted as failures.
+type loginFailureError struct {
+	error
+	// userUnknown whether the user name is unknown or has no credentials of the kind offered, in which case the
+	// failure only counts against the source address, so that nobody may lock such accounts out
+	userUnknown bool
+}
+
+// Cause returns the underlying error
+func (e *loginFailureError) Cause() error {
+	return e.error
+}
+
+// credentialsMismatch returns an error for credentials not matching the ones of the user
+func credentialsMismatch(err error) error {
+	return &loginFailureError{error: err}
+}
+
+// loginUserUnknown returns an error for a user name that is unknown or has no credentials of the kind offered
+func loginUserUnknown(err error) error {
+	return &loginFailureError{error: err, userUnknown: true}
+}
+
+// loginFailures failed login attempts of a source address or user name within the sliding window
+type loginFailures struct {
+	times       []time.Time
+	bannedUntil time.Time
+}
+
+// prune forgets the failures that happened before the time passed as parameter
+func (lf *loginFailures) prune(since time.Time) {
+	i := 0
+	for i < len(lf.times) && !lf.times[i].After(since) {
+		i++
+	}
+	lf.times = lf.times[i:]
+}
+
+// loginFailuresMap failed login attempts by key, along with the threshold that triggers a ban
+type loginFailuresMap struct {
+	kind        string
+	maxFailures int
+	entries     map[string]*loginFailures
+}
+
+func (m *loginFailuresMap) bannedUntil(key string, now time.Time) time.Time {
+	if lf, ok := m.entries[key]; ok && now.Before(lf.bannedUntil) {
+		return lf.bannedUntil
+	}
+	return time.Time{}
+}
+
+// LoginLimiter tracks failed login attempts per source address and per user name within a sliding window,
+// and temporarily bans the ones exceeding the configured thresholds
+type LoginLimiter struct {
+	Window      time.Duration
+	BanDuration time.Duration
+	Now         func() time.Time
+	Log         logrus.FieldLogger
+	ips         loginFailuresMap
+	users       loginFailuresMap
+	lastSweep   time.Time
+	mtx         sync.Mutex
+}
+
+// NewLoginLimiter creates a new login limiter. Zero thresholds disable tracking of the corresponding kind.
+func NewLoginLimiter(maxFailuresPerIP int, maxFailuresPerUser int, window time.Duration, banDuration time.Duration, log logrus.FieldLogger) *LoginLimiter {
+	return &LoginLimiter{
+		Window:      window,
+		BanDuration: banDuration,
+		Now:         time.Now,
+		Log:         log,
+		ips:         loginFailuresMap{kind: loginLimiterKindIP, maxFailures: maxFailuresPerIP, entries: map[string]*loginFailures{}},
+		users:       loginFailuresMap{kind: loginLimiterKindUser, maxFailures: maxFailuresPerUser, entries: map[string]*loginFailures{}},
+	}
+}
+
+// NewLoginLimiterFromConfig creates a new login limiter from the configuration, or nil if none is configured
+func NewLoginLimiterFromConfig(cfg *S3SFTPProxyConfig, log logrus.FieldLogger) *LoginLimiter {
+	lCfg := cfg.LoginLimiter
+	if lCfg == nil {
+		return nil
+	}
+	return NewLoginLimiter(*lCfg.MaxFailuresPerIP, *lCfg.MaxFailuresPerUser, lCfg.Window.Duration, lCfg.BanDuration.Duration, log)
+}
+
+func remoteIP(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	return addr.String()
+}
+
+// sweep forgets the entries with neither recent failures nor active bans, and updates the ban gauges.
+// It runs at most once per window.
+func (l *LoginLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.Window {
+		return
+	}
+	l.lastSweep = now
+	for _, m := range []*loginFailuresMap{&l.ips, &l.users} {
+		banned := 0
+		for key, lf := range m.entries {
+			lf.prune(now.Add(-l.Window))
+			if now.Before(lf.bannedUntil) {
+				banned++
+			} else if len(lf.times) == 0 {
+				delete(m.entries, key)
+			}
+		}
+		mLoginBanned.With(prometheus.Labels{"kind": m.kind}).Set(float64(banned))
+	}
+}
+
+// Check returns an error if either the source address or the user name of the connection is banned
+func (l *LoginLimiter) Check(c ssh.ConnMetadata, method string) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	now := l.Now()
+	l.sweep(now)
+	ip := remoteIP(c.RemoteAddr())
+	for _, kv := range []struct {
+		m   *loginFailuresMap
+		key string
+	}{{&l.ips, ip}, {&l.users, c.User()}} {
+		if until := kv.m.bannedUntil(kv.key, now); !until.IsZero() {
+			mLoginRejected.With(prometheus.Labels{"kind": kv.m.kind}).Inc()
+			l.Log.WithFields(logrus.Fields{
+				"event":        "login_rejected",
+				"remote_ip":    ip,
+				"user":         c.User(),
+				"method":       method,
+				"ban_kind":     kv.m.kind,
+				"banned_until": until,
+			}).Warn("Login attempt rejected as banned")
+			return fmt.Errorf("too many failed login attempts")
+		}
+	}
+	return nil
+}
+
+func (l *LoginLimiter) recordFailure(m *loginFailuresMap, key string, now time.Time, fields logrus.Fields) {
+	if m.maxFailures <= 0 {
+		return
+	}
+	lf, ok := m.entries[key]
+	if !ok {
+		lf = &loginFailures{}
+		m.entries[key] = lf
+	}
+	lf.prune(now.Add(-l.Window))
+	lf.times = append(lf.times, now)
+	if len(lf.times) < m.maxFailures || now.Before(lf.bannedUntil) {
+		return
+	}
+	lf.bannedUntil = now.Add(l.BanDuration)
+	lf.times = nil
+	mLoginBans.With(prometheus.Labels{"kind": m.kind}).Inc()
+	mLoginBanned.With(prometheus.Labels{"kind": m.kind}).Inc()
+	l.Log.WithFields(fields).WithFields(logrus.Fields{
+		"event":        "login_ban",
+		"ban_kind":     m.kind,
+		"failures":     m.maxFailures,
+		"window":       l.Window.String(),
+		"banned_until": lf.bannedUntil,
+	}).Warn("Banned after too many failed login attempts")
+}
+
+// Fail records a failed login attempt, banning the source address or the user name when they exceed their thresholds.
+// Attempts for unknown user names only count against the source address.
+func (l *LoginLimiter) Fail(c ssh.ConnMetadata, method string, err error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	now := l.Now()
+	ip := remoteIP(c.RemoteAddr())
+	fields := logrus.Fields{
+		"remote_ip": ip,
+		"user":      c.User(),
+		"method":    method,
+	}
+	mLoginFailures.With(prometheus.Labels{"method": method}).Inc()
+	l.Log.WithFields(fields).WithFields(logrus.Fields{
+		"event":     "login_failure",
+		"exception": err,
+	}).Warn("Login attempt failed")
+	l.recordFailure(&l.ips, ip, now, fields)
+	if lfe, ok := err.(*loginFailureError); !ok || !lfe.userUnknown {
+		l.recordFailure(&l.users, c.User(), now, fields)
+	}
+}
+
+// Succeed records a successful login, which clears the failures of the user name and takes one off the ones of
+// the source address, so that the users sharing an address don't get it banned by mistyping their passwords
+func (l *LoginLimiter) Succeed(c ssh.ConnMetadata) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	now := l.Now()
+	if lf, ok := l.users.entries[c.User()]; ok && !now.Before(lf.bannedUntil) {
+		delete(l.users.entries, c.User())
+	}
+	if lf, ok := l.ips.entries[remoteIP(c.RemoteAddr())]; ok && len(lf.times) > 0 {
+		lf.times = lf.times[:len(lf.times)-1]
+	}
+}
+
+func (l *LoginLimiter) track(c ssh.ConnMetadata, method string, perms *ssh.Permissions, err error) (*ssh.Permissions, error) {
+	if partialSuccess, ok := err.(*ssh.PartialSuccessError); ok {
+		// further steps are tracked as well, so that second factors may not be brute-forced
+		if partialSuccess.Next.KeyboardInteractiveCallback != nil {
+			partialSuccess.Next.KeyboardInteractiveCallback = l.WrapKeyboardInteractiveCallback(partialSuccess.Next.KeyboardInteractiveCallback)
+		}
+		if partialSuccess.Next.PasswordCallback != nil {
+			partialSuccess.Next.PasswordCallback = l.WrapPasswordCallback(partialSuccess.Next.PasswordCallback)
+		}
+		return perms, err
+	}
+	if err == nil {
+		l.Succeed(c)
+	} else if _, ok := err.(*loginFailureError); ok {
+		l.Fail(c, method, err)
+	}
+	return perms, err
+}
+
+// WrapPasswordCallback wraps a password callback so that banned attempts are rejected and failures are recorded
+func (l *LoginLimiter) WrapPasswordCallback(cb func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error)) func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) {
+	return func(c ssh.ConnMetadata, passwd []byte) (*ssh.Permissions, error) {
+		if err := l.Check(c, "password"); err != nil {
+			return nil, err
+		}
+		perms, err := cb(c, passwd)
+		return l.track(c, "password", perms, err)
+	}
+}
+
+// WrapKeyboardInteractiveCallback wraps a keyboard interactive callback so that banned attempts are rejected
+// and failures are recorded
+func (l *LoginLimiter) WrapKeyboardInteractiveCallback(cb func(ssh.ConnMetadata, ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error)) func(ssh.ConnMetadata, ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	return func(c ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+		if err := l.Check(c, "keyboard-interactive"); err != nil {
+			return nil, err
+		}
+		perms, err := cb(c, client)
+		return l.track(c, "keyboard-interactive", perms, err)
+	}
+}
+
+// WrapPublicKeyCallback wraps a public key callback so that banned attempts are rejected. Failures are not recorded,
+// as clients routinely offer several keys before the right one.
+func (l *LoginLimiter) WrapPublicKeyCallback(cb func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error)) func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+	return func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		if err := l.Check(c, "publickey"); err != nil {
+			return nil, err
+		}
+		perms, err := cb(c, key)
+		if _, ok := err.(*ssh.PartialSuccessError); ok {
+			return l.track(c, "publickey", perms, err)
+		}
+		return perms, err
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	fake_log "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestLoginLimiter(t *testing.T) {
+	log, hook := fake_log.NewNullLogger()
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := NewLoginLimiter(3, 2, time.Minute, 10*time.Minute, log)
+	l.Now = func() time.Time { return now }
+	cb := l.WrapPasswordCallback(func(c ssh.ConnMetadata, passwd []byte) (*ssh.Permissions, error) {
+		if string(passwd) == "test" {
+			return nil, nil
+		}
+		return nil, credentialsMismatch(fmt.Errorf("passwords do not match"))
+	})
+	addr := func(i byte) net.Addr { return &net.TCPAddr{IP: net.IPv4(192, 0, 2, i), Port: 50000} }
+
+	// failures out of the window are forgotten
+	_, err := cb(&fakeConnMetadata{user: "user1", addr: addr(1)}, []byte("wrong"))
+	assert.Error(t, err)
+	now = now.Add(2 * time.Minute)
+	_, err = cb(&fakeConnMetadata{user: "user1", addr: addr(1)}, []byte("wrong"))
+	assert.Error(t, err)
+	_, err = cb(&fakeConnMetadata{user: "user1", addr: addr(1)}, []byte("test"))
+	assert.NoError(t, err)
+
+	// user names are banned regardless of the address
+	_, err = cb(&fakeConnMetadata{user: "user1", addr: addr(2)}, []byte("wrong"))
+	assert.Error(t, err)
+	_, err = cb(&fakeConnMetadata{user: "user1", addr: addr(3)}, []byte("wrong"))
+	assert.Error(t, err)
+	assert.Equal(t, "login_ban", hook.LastEntry().Data["event"])
+	assert.Equal(t, loginLimiterKindUser, hook.LastEntry().Data["ban_kind"])
+	_, err = cb(&fakeConnMetadata{user: "user1", addr: addr(4)}, []byte("test"))
+	assert.EqualError(t, err, "too many failed login attempts")
+
+	// addresses are banned regardless of the user name
+	for _, user := range []string{"user2", "user3", "user4"} {
+		_, err = cb(&fakeConnMetadata{user: user, addr: addr(5)}, []byte("wrong"))
+		assert.Error(t, err)
+	}
+	assert.Equal(t, loginLimiterKindIP, hook.LastEntry().Data["ban_kind"])
+	_, err = cb(&fakeConnMetadata{user: "user5", addr: addr(5)}, []byte("test"))
+	assert.Error(t, err)
+	_, err = cb(&fakeConnMetadata{user: "user5", addr: addr(6)}, []byte("test"))
+	assert.NoError(t, err)
+
+	// bans expire
+	now = now.Add(11 * time.Minute)
+	_, err = cb(&fakeConnMetadata{user: "user1", addr: addr(5)}, []byte("test"))
+	assert.NoError(t, err)
+	assert.Empty(t, l.ips.entries)
+	assert.Empty(t, l.users.entries)
+}
+
+func TestLoginLimiterCountsCredentialMismatchesOnly(t *testing.T) {
+	log, _ := fake_log.NewNullLogger()
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := NewLoginLimiter(2, 2, time.Minute, 10*time.Minute, log)
+	l.Now = func() time.Time { return now }
+	cb := l.WrapPasswordCallback(func(c ssh.ConnMetadata, passwd []byte) (*ssh.Permissions, error) {
+		switch {
+		case c.User() == "unknown":
+			return nil, loginUserUnknown(fmt.Errorf("unknown user: %s", c.User()))
+		case string(passwd) == "":
+			return nil, fmt.Errorf("keyboard interactive authentication not enabled")
+		case string(passwd) != "test":
+			return nil, credentialsMismatch(fmt.Errorf("passwords do not match"))
+		}
+		return nil, nil
+	})
+	addr := func(i byte) net.Addr { return &net.TCPAddr{IP: net.IPv4(192, 0, 2, i), Port: 50000} }
+
+	// attempts failing before any credentials are checked are not counted
+	for i := 0; i < 3; i++ {
+		_, err := cb(&fakeConnMetadata{user: "user1", addr: addr(1)}, nil)
+		assert.Error(t, err)
+	}
+	_, err := cb(&fakeConnMetadata{user: "user1", addr: addr(1)}, []byte("test"))
+	assert.NoError(t, err)
+	assert.Empty(t, l.ips.entries)
+	assert.Empty(t, l.users.entries)
+
+	// successful logins make up for the failures of other users sharing the address
+	for _, user := range []string{"user2", "user3", "user4"} {
+		_, err = cb(&fakeConnMetadata{user: user, addr: addr(1)}, []byte("wrong"))
+		assert.Error(t, err)
+		_, err = cb(&fakeConnMetadata{user: user, addr: addr(1)}, []byte("test"))
+		assert.NoError(t, err)
+	}
+	assert.Empty(t, l.ips.entries[remoteIP(addr(1))].times)
+
+	// unknown user names only count against the address
+	for _, i := range []byte{2, 3, 3} {
+		_, err = cb(&fakeConnMetadata{user: "unknown", addr: addr(i)}, []byte("test"))
+		assert.EqualError(t, err, "unknown user: unknown")
+	}
+	assert.NotContains(t, l.users.entries, "unknown")
+	_, err = cb(&fakeConnMetadata{user: "unknown", addr: addr(3)}, []byte("test"))
+	assert.EqualError(t, err, "too many failed login attempts")
+	_, err = cb(&fakeConnMetadata{user: "unknown", addr: addr(2)}, []byte("test"))
+	assert.EqualError(t, err, "unknown user: unknown")
+}
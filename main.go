@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -17,6 +18,8 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
+var totpQuestion = "Verification code: "
+
 var (
 	configFile string
 	bind       string
@@ -31,7 +34,7 @@ func init() {
 	flag.StringVar(&logFormat, "log-format", "text", "Log format. Available options are: text (default), or json")
 }
 
-func buildSSHServerConfig(buckets *S3Buckets, cfg *S3SFTPProxyConfig) (*ssh.ServerConfig, error) {
+func buildSSHServerConfig(buckets *ReloadableS3Buckets, cfg *S3SFTPProxyConfig, limiter *LoginLimiter, log logrus.FieldLogger) (*ssh.ServerConfig, error) {
 	pem, err := ioutil.ReadFile(cfg.HostKeyFile)
 	if err != nil {
 		return nil, errors.Wrapf(err, `failed to open "%s"`, cfg.HostKeyFile)
@@ -42,54 +45,90 @@ func buildSSHServerConfig(buckets *S3Buckets, cfg *S3SFTPProxyConfig) (*ssh.Serv
 	}
 	c := &ssh.ServerConfig{
 		PasswordCallback: func(c ssh.ConnMetadata, passwd []byte) (*ssh.Permissions, error) {
-			bucket, ok := buckets.UserToBucketMap[c.User()]
-			if !ok {
-				return nil, fmt.Errorf("unknown user: %s", c.User())
+			s3Buckets := buckets.Load()
+			bucket, u, err := lookupLoginUser(s3Buckets, c, log)
+			if err != nil {
+				return nil, err
+			}
+			if ru, ok := u.(RemoteUser); ok {
+				return authenticateRemoteUser(s3Buckets, bucket, ru, c.RemoteAddr(), log, passwd, nil)
+			}
+			if !u.HasPassword() {
+				return nil, loginUserUnknown(fmt.Errorf("no credentials are present"))
+			}
+			if !u.ValidatePassword(passwd) {
+				return nil, credentialsMismatch(fmt.Errorf("passwords do not match"))
 			}
-			u := bucket.Users.Lookup(c.User())
-			if u.ValidatePassword(passwd) {
-				return nil, nil
+			if u.GetTOTP() != nil {
+				return nil, requireTOTP(bucket.Users, u, nil)
 			}
-			return nil, fmt.Errorf("passwords do not match")
+			return nil, nil
 		},
 		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
-			bucket, ok := buckets.UserToBucketMap[c.User()]
-			if !ok {
-				return nil, fmt.Errorf("unknown user: %s", c.User())
+			s3Buckets := buckets.Load()
+			bucket, u, err := lookupLoginUser(s3Buckets, c, log)
+			if err != nil {
+				return nil, err
+			}
+			if cert, ok := key.(*ssh.Certificate); ok {
+				return authenticateCertificate(s3Buckets, bucket, u, c, log, cert)
+			}
+			if ru, ok := u.(RemoteUser); ok {
+				return authenticateRemoteUser(s3Buckets, bucket, ru, c.RemoteAddr(), log, nil, key)
 			}
-			u := bucket.Users.Lookup(c.User())
 			if u.HasPublicKeys() {
 				keyMarshaled := key.Marshal()
 				for _, herKey := range u.GetPublicKeys() {
 					if herKey.Type() == key.Type() && len(herKey.Marshal()) == len(keyMarshaled) && bytes.Compare(herKey.Marshal(), keyMarshaled) == 0 {
-						return &ssh.Permissions{
+						if err := herKey.Check(c.RemoteAddr(), time.Now()); err != nil {
+							return nil, err
+						}
+						perms := &ssh.Permissions{
 							Extensions: map[string]string{
-								"pubkey-fp": ssh.FingerprintSHA256(key),
+								"pubkey-fp":      ssh.FingerprintSHA256(key),
+								"perms-override": herKey.PermsOverride.String(),
 							},
-						}, nil
+						}
+						if u.GetTOTP() != nil {
+							return nil, requireTOTP(bucket.Users, u, perms)
+						}
+						return perms, nil
 					}
 				}
 			}
 			return nil, fmt.Errorf("public keys do not match")
 		},
 		KeyboardInteractiveCallback: func(c ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
-			bucket, ok := buckets.UserToBucketMap[c.User()]
-			if !ok {
-				return nil, fmt.Errorf("unknown user: %s", c.User())
+			s3Buckets := buckets.Load()
+			bucket, u, err := lookupLoginUser(s3Buckets, c, log)
+			if err != nil {
+				return nil, err
 			}
 			if !bucket.KeyboardInteractiveAuthEnabled {
 				return nil, fmt.Errorf("keyboard interactive authentication not enabled")
 			}
-			u := bucket.Users.Lookup(c.User())
 			if !u.HasPassword() {
-				return nil, fmt.Errorf("no credentials are present")
+				return nil, loginUserUnknown(fmt.Errorf("no credentials are present"))
+			}
+			questions, echos := []string{"Password: "}, []bool{false}
+			if u.GetTOTP() != nil {
+				questions, echos = append(questions, totpQuestion), append(echos, false)
 			}
-			answers, err := client(u.GetName(), "", []string{"Password: "}, []bool{false})
+			answers, err := client(u.GetName(), "", questions, echos)
 			if err != nil {
 				return nil, errors.Wrapf(err, "keyboard interactive conversation failed")
 			}
+			if len(answers) != len(questions) {
+				return nil, fmt.Errorf("keyboard interactive conversation failed: %d answers given", len(answers))
+			}
+			if ru, ok := u.(RemoteUser); ok {
+				return authenticateRemoteUser(s3Buckets, bucket, ru, c.RemoteAddr(), log, []byte(answers[0]), nil)
+			}
 			if !u.ValidatePassword([]byte(answers[0])) {
-				return nil, fmt.Errorf("passwords do not match")
+				return nil, credentialsMismatch(fmt.Errorf("passwords do not match"))
+			}
+			if u.GetTOTP() != nil && !bucket.Users.ValidateTOTP(u, answers[1], time.Now()) {
+				return nil, credentialsMismatch(fmt.Errorf("verification codes do not match"))
 			}
 			return nil, nil
 		},
@@ -97,6 +136,11 @@ func buildSSHServerConfig(buckets *S3Buckets, cfg *S3SFTPProxyConfig) (*ssh.Serv
 			return cfg.Banner
 		},
 	}
+	if limiter != nil {
+		c.PasswordCallback = limiter.WrapPasswordCallback(c.PasswordCallback)
+		c.PublicKeyCallback = limiter.WrapPublicKeyCallback(c.PublicKeyCallback)
+		c.KeyboardInteractiveCallback = limiter.WrapKeyboardInteractiveCallback(c.KeyboardInteractiveCallback)
+	}
 	sgn, err := ssh.NewSignerFromKey(key)
 	if err != nil {
 		return nil, err
@@ -105,6 +149,136 @@ func buildSSHServerConfig(buckets *S3Buckets, cfg *S3SFTPProxyConfig) (*ssh.Serv
 	return c, nil
 }
 
+// requireTOTP asks for the one-time password of a user through keyboard interactive authentication,
+// once the first factor has succeeded. The permissions passed as parameter are granted when it matches.
+func requireTOTP(us *UserStore, u User, perms *ssh.Permissions) error {
+	return &ssh.PartialSuccessError{
+		Next: ssh.ServerAuthCallbacks{
+			KeyboardInteractiveCallback: func(c ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+				answers, err := client(u.GetName(), "", []string{totpQuestion}, []bool{false})
+				if err != nil {
+					return nil, errors.Wrapf(err, "keyboard interactive conversation failed")
+				}
+				if len(answers) != 1 || !us.ValidateTOTP(u, answers[0], time.Now()) {
+					return nil, credentialsMismatch(fmt.Errorf("verification codes do not match"))
+				}
+				return perms, nil
+			},
+		},
+	}
+}
+
+// checkSourceAddress checks the address a user logs in from against an allow and deny list
+func checkSourceAddress(f *AddrFilter, scope string, user string, addr net.Addr, log logrus.FieldLogger) error {
+	if ok, rule := f.Check(addr); !ok {
+		log.WithFields(logrus.Fields{
+			"user":        user,
+			"remote_addr": addr.String(),
+			"scope":       scope,
+			"rule":        rule,
+		}).Warn("Login refused from source address")
+		return fmt.Errorf("login not allowed from %s", addr)
+	}
+	return nil
+}
+
+// lookupLoginUser looks up a user logging in, and checks that the account may log in at this time and from
+// the address of the connection, as per the user and the buckets it's assigned to
+func lookupLoginUser(buckets *S3Buckets, c ssh.ConnMetadata, log logrus.FieldLogger) (*S3Bucket, User, error) {
+	bucket, u := buckets.LookupUser(c.User())
+	if u == nil {
+		return nil, nil, loginUserUnknown(fmt.Errorf("unknown user: %s", c.User()))
+	}
+	if err := u.GetAccountPolicy().Check(time.Now()); err != nil {
+		return nil, nil, err
+	}
+	if err := checkSourceAddress(u.GetAddrFilter(), "user", c.User(), c.RemoteAddr(), log); err != nil {
+		return nil, nil, err
+	}
+	userBuckets, _ := buckets.LookupUserBuckets(c.User())
+	for _, b := range userBuckets {
+		if err := checkSourceAddress(b.AddrFilter, "bucket "+b.Name, c.User(), c.RemoteAddr(), log); err != nil {
+			return nil, nil, err
+		}
+	}
+	return bucket, u, nil
+}
+
+// authenticateCertificate validates a user certificate against the trusted user CA keys of the store the user
+// belongs to. Users of remote stores must be accepted by the external service as well, whose permissions are
+// added to the ones of the certificate.
+func authenticateCertificate(buckets *S3Buckets, bucket *S3Bucket, u User, c ssh.ConnMetadata, log logrus.FieldLogger, cert *ssh.Certificate) (*ssh.Permissions, error) {
+	if !bucket.Users.HasTrustedUserCAKeys() {
+		return nil, fmt.Errorf("no trusted user CA keys are present")
+	}
+	perms, err := bucket.Users.CheckCertificate(c, cert)
+	if err != nil {
+		return nil, err
+	}
+	if ru, ok := u.(RemoteUser); ok {
+		remotePerms, err := authenticateRemoteUser(buckets, bucket, ru, c.RemoteAddr(), log, nil, cert)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range remotePerms.Extensions {
+			perms.Extensions[k] = v
+		}
+	}
+	if u.GetTOTP() != nil {
+		return nil, requireTOTP(bucket.Users, u, perms)
+	}
+	return perms, nil
+}
+
+// authenticateRemoteUser validates the credentials of a remote user and stores the bucket,
+// root path and permission overrides given by the external service into the SSH permissions
+func authenticateRemoteUser(buckets *S3Buckets, bucket *S3Bucket, u RemoteUser, addr net.Addr, log logrus.FieldLogger, passwd []byte, key ssh.PublicKey) (*ssh.Permissions, error) {
+	res, err := u.Authenticate(addr, passwd, key)
+	if err == errWebhookDenied {
+		return nil, credentialsMismatch(err)
+	} else if err != nil {
+		return nil, err
+	}
+	if res.Bucket != "" {
+		bucket = buckets.Get(res.Bucket)
+		if bucket == nil {
+			return nil, fmt.Errorf("no such bucket config: %s", res.Bucket)
+		}
+		if err := checkSourceAddress(bucket.AddrFilter, "bucket "+bucket.Name, u.GetName(), addr, log); err != nil {
+			return nil, err
+		}
+	}
+	perms := &ssh.Permissions{
+		Extensions: map[string]string{
+			"bucket":         bucket.Name,
+			"root-path":      res.RootPath,
+			"perms-override": res.PermsOverride.String(),
+		},
+	}
+	if key != nil {
+		perms.Extensions["pubkey-fp"] = ssh.FingerprintSHA256(key)
+	}
+	return perms, nil
+}
+
+// reloadBuckets reads the configuration file again and builds the users and buckets out of it.
+// Settings other than the users and buckets are left as they are. The state kept by the user stores of the
+// buckets in use, if any, is carried over.
+func reloadBuckets(configFile string, prev *S3Buckets, log logrus.FieldLogger) (*S3Buckets, error) {
+	cfg, err := ReadConfigFromFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	uStores, err := NewUserStoresFromConfig(cfg, log)
+	if err != nil {
+		return nil, err
+	}
+	if prev != nil {
+		uStores.keepTOTPSteps(prev)
+	}
+	return NewS3BucketFromConfig(uStores, cfg)
+}
+
 func bail(msg string, status ...interface{}) {
 	os.Stderr.Write([]byte(msg + "\n"))
 	statusCode := 1
@@ -125,21 +299,43 @@ func main() {
 		bail(err.Error())
 	}
 
-	uStores, err := NewUserStoresFromConfig(cfg)
+	logger := logrus.New()
+	if debug {
+		logger.SetLevel(logrus.DebugLevel)
+	}
+	switch logFormat {
+	case "text":
+		logger.SetFormatter(&logrus.TextFormatter{})
+	case "json":
+		logger.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		panic(fmt.Sprintf("Invalid log format %s", logFormat))
+	}
+
+	uStores, err := NewUserStoresFromConfig(cfg, logger)
 	if err != nil {
 		bail(err.Error())
 	}
 
-	buckets, err := NewS3BucketFromConfig(uStores, cfg)
+	s3Buckets, err := NewS3BucketFromConfig(uStores, cfg)
 	if err != nil {
 		bail(err.Error())
 	}
+	buckets := NewReloadableS3Buckets(s3Buckets)
 
-	sCfg, err := buildSSHServerConfig(buckets, cfg)
+	sCfg, err := buildSSHServerConfig(buckets, cfg, NewLoginLimiterFromConfig(cfg, logger), logger)
 	if err != nil {
 		bail(err.Error())
 	}
 
+	var uploadSpill *UploadSpill
+	if cfg.UploadSpillDir != "" {
+		uploadSpill, err = NewUploadSpill(cfg.UploadSpillDir, *cfg.UploadSpillQuota)
+		if err != nil {
+			bail(fmt.Sprintf("upload_spill_dir: %s", err))
+		}
+	}
+
 	_bind := bind
 	if _bind == "" {
 		_bind = cfg.Bind
@@ -148,19 +344,6 @@ func main() {
 		}
 	}
 
-	logger := logrus.New()
-	if debug {
-		logger.SetLevel(logrus.DebugLevel)
-	}
-	switch logFormat {
-	case "text":
-		logger.SetFormatter(&logrus.TextFormatter{})
-	case "json":
-		logger.SetFormatter(&logrus.JSONFormatter{})
-	default:
-		panic(fmt.Sprintf("Invalid log format %s", logFormat))
-	}
-
 	lsnr, err := net.Listen("tcp", _bind)
 	if err != nil {
 		bail(err.Error())
@@ -188,8 +371,12 @@ func main() {
 
 	ctx, cancel := context.WithCancel(context.Background())
 
-	sigChan := make(chan os.Signal)
+	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt)
+	reloadChan := make(chan os.Signal, 1)
+	if len(reloadSignals) > 0 {
+		signal.Notify(reloadChan, reloadSignals...)
+	}
 
 	uploadWorkers := NewS3UploadWorkers(ctx, *cfg.UploadWorkersCount, logger)
 	uploadChan := uploadWorkers.Start()
@@ -206,12 +393,20 @@ func main() {
 			buckets,
 			sCfg,
 			logger,
-			*cfg.ReaderLookbackBufferSize,
-			*cfg.ReaderMinChunkSize,
-			*cfg.ListerLookbackBufferSize,
-			*cfg.UploadMemoryBufferSize,
-			*cfg.UploadMemoryBufferPoolSize,
-			(*cfg.UploadMemoryBufferPoolTimeout).Duration,
+			ServerOptions{
+				ReaderLookbackBufferSize:      *cfg.ReaderLookbackBufferSize,
+				ReaderMinChunkSize:            *cfg.ReaderMinChunkSize,
+				ReadAheadChunks:               *cfg.ReadAheadChunks,
+				ReadAheadChunkSize:            *cfg.ReadAheadChunkSize,
+				ReadAheadMemoryBudget:         *cfg.ReadAheadMemoryBudget,
+				ListerLookbackBufferSize:      *cfg.ListerLookbackBufferSize,
+				UploadMemoryBufferSize:        *cfg.UploadMemoryBufferSize,
+				UploadMemoryBufferPoolSize:    *cfg.UploadMemoryBufferPoolSize,
+				UploadMemoryBufferPoolTimeout: (*cfg.UploadMemoryBufferPoolTimeout).Duration,
+				UploadMaxPartBuffers:          *cfg.UploadMaxPartBuffers,
+				UploadSpill:                   uploadSpill,
+				UploadResumeTimeout:           (*cfg.UploadResumeTimeout).Duration,
+			},
 			uploadChan,
 		).RunListenerEventLoop(ctx, lsnr.(*net.TCPListener))
 	}()
@@ -226,6 +421,14 @@ outer:
 			break outer
 		case <-sigChan:
 			cancel()
+		case <-reloadChan:
+			newBuckets, err := reloadBuckets(configFile, buckets.Load(), logger)
+			if err != nil {
+				logger.WithField("exception", err).Errorf("Error reloading configuration file %s, keeping running configuration", configFile)
+				continue
+			}
+			buckets.Store(newBuckets)
+			logger.Infof("Reloaded %d buckets from configuration file %s", len(newBuckets.Buckets), configFile)
 		}
 	}
 }
@@ -3,53 +3,147 @@ package main
 import (
 	"context"
 	"fmt"
+	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
+// memoryBufferPoolMetrics metrics a memory buffer pool reports its usage through. Timeouts may be nil
+// for pools whose buffers are only taken through TryGet.
+type memoryBufferPoolMetrics struct {
+	Max      prometheus.Gauge
+	Used     prometheus.Gauge
+	Timeouts prometheus.Counter
+}
+
+var uploadMemoryBufferPoolMetrics = memoryBufferPoolMetrics{
+	Max:      mMemoryBufferPoolMax,
+	Used:     mMemoryBufferPoolUsed,
+	Timeouts: mMemoryBufferPoolTimeouts,
+}
+
 // MemoryBufferPool pool of memory buffers
 // Used to reduce the GC generated when a memory buffer of the same size is needed
 type MemoryBufferPool struct {
 	BufSize int
 	Used    int32
 	ch      chan []byte
+	getMtx  sync.Mutex
 	ctx     context.Context
 	timeout time.Duration
+	metrics memoryBufferPoolMetrics
 }
 
 // NewMemoryBufferPool creates a new partition pool giving its size
 func NewMemoryBufferPool(ctx context.Context, bufSize int, poolSize int, timeout time.Duration) *MemoryBufferPool {
+	return newMemoryBufferPool(ctx, bufSize, poolSize, timeout, uploadMemoryBufferPoolMetrics)
+}
+
+func newMemoryBufferPool(ctx context.Context, bufSize int, poolSize int, timeout time.Duration, metrics memoryBufferPoolMetrics) *MemoryBufferPool {
 	mbp := &MemoryBufferPool{
 		BufSize: bufSize,
 		ch:      make(chan []byte, poolSize),
 		ctx:     ctx,
 		timeout: timeout,
+		metrics: metrics,
 	}
-	mMemoryBufferPoolMax.Add(float64(poolSize))
+	mbp.metrics.Max.Add(float64(poolSize))
 	for ; poolSize > 0; poolSize-- {
 		mbp.ch <- make([]byte, mbp.BufSize)
 	}
 	return mbp
 }
 
+// Cap returns the number of buffers of the pool
+func (mbp *MemoryBufferPool) Cap() int {
+	return cap(mbp.ch)
+}
+
 // Get gets a buffer from the pool
 func (mbp *MemoryBufferPool) Get() ([]byte, error) {
 	select {
 	case <-mbp.ctx.Done():
 		return nil, fmt.Errorf("partition pool get canceled")
 	case <-time.After(mbp.timeout):
-		mMemoryBufferPoolTimeouts.Inc()
+		if mbp.metrics.Timeouts != nil {
+			mbp.metrics.Timeouts.Inc()
+		}
 		return nil, fmt.Errorf("timeout getting partition from pool")
 	case res := <-mbp.ch:
-		mMemoryBufferPoolUsed.Inc()
+		mbp.metrics.Used.Inc()
 		atomic.AddInt32(&mbp.Used, 1)
 		return res, nil
 	}
 }
 
+// TryGet gets a buffer from the pool if one is available right away, or returns nil otherwise
+func (mbp *MemoryBufferPool) TryGet() []byte {
+	select {
+	case res := <-mbp.ch:
+		mbp.metrics.Used.Inc()
+		atomic.AddInt32(&mbp.Used, 1)
+		return res
+	default:
+		return nil
+	}
+}
+
+// GetN gets n buffers from the pool at once, waiting for them up to the timeout of the pool. Callers take
+// their buffers one after the other, so that none of them is left waiting while holding part of them.
+func (mbp *MemoryBufferPool) GetN(n int) ([][]byte, error) {
+	mbp.getMtx.Lock()
+	defer mbp.getMtx.Unlock()
+	timer := time.NewTimer(mbp.timeout)
+	defer timer.Stop()
+	bufs := make([][]byte, 0, n)
+	for len(bufs) < n {
+		select {
+		case <-mbp.ctx.Done():
+			mbp.PutN(bufs)
+			return nil, fmt.Errorf("partition pool get canceled")
+		case <-timer.C:
+			if mbp.metrics.Timeouts != nil {
+				mbp.metrics.Timeouts.Inc()
+			}
+			mbp.PutN(bufs)
+			return nil, fmt.Errorf("timeout getting partition from pool")
+		case res := <-mbp.ch:
+			mbp.metrics.Used.Inc()
+			atomic.AddInt32(&mbp.Used, 1)
+			bufs = append(bufs, res)
+		}
+	}
+	return bufs, nil
+}
+
+// TryGetN gets n buffers from the pool if they are available right away, or returns nil otherwise
+func (mbp *MemoryBufferPool) TryGetN(n int) [][]byte {
+	mbp.getMtx.Lock()
+	defer mbp.getMtx.Unlock()
+	bufs := make([][]byte, 0, n)
+	for len(bufs) < n {
+		buf := mbp.TryGet()
+		if buf == nil {
+			mbp.PutN(bufs)
+			return nil
+		}
+		bufs = append(bufs, buf)
+	}
+	return bufs
+}
+
+// PutN returns several buffers into the pool
+func (mbp *MemoryBufferPool) PutN(bufs [][]byte) {
+	for _, buf := range bufs {
+		mbp.Put(buf)
+	}
+}
+
 // Put returns a buffer into the pool
 func (mbp *MemoryBufferPool) Put(buf []byte) {
 	mbp.ch <- buf
 	atomic.AddInt32(&mbp.Used, -1)
-	mMemoryBufferPoolUsed.Dec()
+	mbp.metrics.Used.Dec()
 }
@@ -36,3 +36,23 @@ func TestMemoryBufferPoolGetCanceled(t *testing.T) {
 	assert.Error(t, err)
 	assert.Regexp(t, ".*canceled.*", err.Error())
 }
+
+func TestMemoryBufferPoolGetN(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := NewMemoryBufferPool(ctx, 10, 3, 100*time.Millisecond)
+	bufs, err := p.GetN(2)
+	assert.NoError(t, err)
+	assert.Len(t, bufs, 2)
+
+	// buffers taken before timing out are given back
+	_, err = p.GetN(2)
+	assert.Error(t, err)
+	assert.Equal(t, int32(2), p.Used)
+	assert.Nil(t, p.TryGetN(2))
+	assert.Equal(t, int32(2), p.Used)
+
+	p.PutN(bufs)
+	assert.Len(t, p.TryGetN(3), 3)
+	assert.Equal(t, int32(3), p.Used)
+}
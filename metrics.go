@@ -17,11 +17,23 @@ var (
 		Help: "The total number of session errors",
 	},
 	)
+	mAWSCredentialsError = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sftp_aws_credentials_errors_total",
+		Help: "The total number of AWS requests failed because credentials could not be retrieved or were rejected",
+	},
+		[]string{"bucket", "code"},
+	)
 	mPermissionsError = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "sftp_permissions_error",
 		Help: "The total number of permission errors",
 	},
-		[]string{"method"},
+		[]string{"method", "rule"},
+	)
+	mErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sftp_errors_total",
+		Help: "The total number of errors reported to clients, by kind",
+	},
+		[]string{"method", "kind"},
 	)
 	mUsersConnected = promauto.NewGauge(prometheus.GaugeOpts{
 		Name: "sftp_users_connected",
@@ -43,6 +55,62 @@ var (
 		Help: "The total number of timeouts produced in the pool",
 	},
 	)
+	mUploadSpillBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "sftp_upload_spill_bytes",
+		Help: "The number of bytes of the upload spill quota taken by parts staged on disk",
+	},
+	)
+	mUploadSpillParts = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "sftp_upload_spill_parts",
+		Help: "The number of parts of uploads staged on disk now",
+	},
+	)
+	mUploadSpillTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftp_upload_spill_parts_total",
+		Help: "The total number of parts of uploads staged on disk",
+	},
+	)
+	mUploadSpillRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftp_upload_spill_rejected_total",
+		Help: "The total number of parts of uploads that could not be staged on disk because the quota was exceeded",
+	},
+	)
+	mUploadsSuspended = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "sftp_uploads_suspended",
+		Help: "The number of interrupted uploads kept for their clients to resume them",
+	},
+	)
+	mUploadsResumed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftp_uploads_resumed_total",
+		Help: "The total number of interrupted uploads resumed by their clients",
+	},
+	)
+	mUploadsResumeExpired = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftp_uploads_resume_expired_total",
+		Help: "The total number of interrupted uploads aborted because they were not resumed in time",
+	},
+	)
+	mReadAheadBuffersMax = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "sftp_read_ahead_buffers_max",
+		Help: "The number of read-ahead buffers the memory budget allows",
+	},
+	)
+	mReadAheadBuffersUsed = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "sftp_read_ahead_buffers_used",
+		Help: "The number of read-ahead buffers holding data of downloads",
+	},
+	)
+	mReadAheadFetches = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "sftp_read_ahead_fetches",
+		Help: "The number of ranges of downloads being fetched concurrently now",
+	},
+	)
+	mReadAheadReads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sftp_read_ahead_reads_total",
+		Help: "The total number of reads of downloads eligible for read-ahead",
+	},
+		[]string{"result"},
+	)
 	mReadsBytesTotal = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "sftp_reads_bytes_total",
 		Help: "The total number of bytes read",
@@ -53,4 +121,28 @@ var (
 		Help: "The total number of bytes written",
 	},
 	)
+	mLoginFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sftp_login_failures_total",
+		Help: "The total number of failed login attempts",
+	},
+		[]string{"method"},
+	)
+	mLoginBans = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sftp_login_bans_total",
+		Help: "The total number of bans issued after too many failed login attempts",
+	},
+		[]string{"kind"},
+	)
+	mLoginBanned = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sftp_login_banned",
+		Help: "The number of source addresses or users banned now",
+	},
+		[]string{"kind"},
+	)
+	mLoginRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sftp_login_rejected_total",
+		Help: "The total number of login attempts rejected as banned",
+	},
+		[]string{"kind"},
+	)
 )
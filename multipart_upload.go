@@ -4,16 +4,28 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"hash"
+	"io"
 	"sync"
 
 	"github.com/moriyoshi/s3-sftp-proxy/util"
 	"github.com/sirupsen/logrus"
 
+	aws "github.com/aws/aws-sdk-go/aws"
 	aws_s3 "github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+const (
+	// s3MaxParts maximum number of parts of a multipart upload
+	s3MaxParts = 10000
+	// s3MaxPartSize maximum size of a part of a multipart upload
+	s3MaxPartSize = 5 * 1024 * 1024 * 1024
+	// partsPerSizeStep number of parts uploaded before the part size doubles
+	partsPerSizeStep = 1000
+)
+
 // S3PartUploadState state in which a part upload is
 type S3PartUploadState int
 
@@ -32,10 +44,16 @@ const (
 
 // S3PartToUpload S3 part to be uploaded
 type S3PartToUpload struct {
-	// Part content
-	content []byte
+	// Part content, made of memory buffers taken from the pool
+	content [][]byte
+	// File the part is staged in instead, when there were no memory buffers left
+	spilled *spillFile
 	// Part number (starting from 1)
 	partNumber int64
+	// Offset of the part in the object
+	offset int64
+	// Multipart upload the part is uploaded into, set when enqueued
+	uploadID *string
 	// Offset ranges already filled
 	o *util.OffsetRanges
 	// S3MultipartUploadWriter that contains this part
@@ -46,17 +64,71 @@ type S3PartToUpload struct {
 	state S3PartUploadState
 }
 
-func (part *S3PartToUpload) getContent() ([]byte, error) {
+func (part *S3PartToUpload) getContent() (io.ReadSeeker, error) {
 	end := part.o.GetMaxValidOffset()
 	if end == -1 {
 		return nil, fmt.Errorf("Trying to obtain content of incomplete part %d", part.partNumber)
 	}
-	return part.content[0:end], nil
+	if part.spilled != nil {
+		return io.NewSectionReader(part.spilled, 0, end), nil
+	}
+	if len(part.content) == 1 {
+		return bytes.NewReader(part.content[0][0:end]), nil
+	}
+	return &buffersReader{bufs: part.content, size: end}, nil
 }
 
-func (part *S3PartToUpload) copy(buf []byte, start int64, end int64) {
-	copy(part.content[start:end], buf)
+func (part *S3PartToUpload) copy(buf []byte, start int64, end int64) error {
+	if part.spilled != nil {
+		if _, err := part.spilled.WriteAt(buf, start); err != nil {
+			return err
+		}
+	} else {
+		bufSize := int64(len(part.content[0]))
+		for o := start; o < end; {
+			o += int64(copy(part.content[o/bufSize][o%bufSize:], buf[o-start:end-start]))
+		}
+	}
 	part.o.Add(start, end)
+	return nil
+}
+
+// buffersReader reader of the first size bytes of the concatenation of buffers of the same size
+type buffersReader struct {
+	bufs [][]byte
+	size int64
+	off  int64
+}
+
+// Read reads data from the current offset
+func (r *buffersReader) Read(p []byte) (int, error) {
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+	bufSize := int64(len(r.bufs[0]))
+	i := r.off / bufSize
+	end := bufSize
+	if rest := r.size - i*bufSize; rest < end {
+		end = rest
+	}
+	n := copy(p, r.bufs[i][r.off%bufSize:end])
+	r.off += int64(n)
+	return n, nil
+}
+
+// Seek sets the offset for the next Read
+func (r *buffersReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset: %d", offset)
+	}
+	r.off = offset
+	return offset, nil
 }
 
 func (part *S3PartToUpload) isFull() bool {
@@ -68,18 +140,29 @@ type S3MultipartUploadWriter struct {
 	Ctx                    context.Context
 	Bucket                 string
 	Key                    Path
+	User                   string
 	S3                     s3iface.S3API
 	ServerSideEncryption   *ServerSideEncryptionConfig
 	Log                    logrus.FieldLogger
 	MaxObjectSize          int64
 	UploadMemoryBufferPool *MemoryBufferPool
+	MaxPartBuffers         int
+	UploadSpill            *UploadSpill
+	StagingKey             string
+	ResumableUploads       *ResumableUploads
+	SessionEnded           <-chan struct{}
 	Info                   *PhantomObjectInfo
 	PhantomObjectMap       *PhantomObjectMap
 	RequestMethod          string
 	mtx                    sync.Mutex
 	completedParts         []*aws_s3.CompletedPart
+	completedPartsMtx      sync.Mutex
+	checksum               hash.Hash
+	checksumOffset         int64
+	checksumMtx            sync.Mutex
 	parts                  []*S3PartToUpload
 	multiPartUploadID      *string
+	resumedSize            int64
 	err                    error
 	uploadGroup            sync.WaitGroup
 	UploadChan             chan<- *S3PartToUpload
@@ -96,6 +179,11 @@ func (u *S3MultipartUploadWriter) TransferError(err error) {
 func (u *S3MultipartUploadWriter) Close() error {
 	u.Log.Debug("S3MultipartUploadWriter.Close")
 
+	if u.interrupted() && u.suspend() {
+		mOperationStatus.With(prometheus.Labels{"method": u.RequestMethod, "status": "suspended"}).Inc()
+		return nil
+	}
+
 	u.PhantomObjectMap.RemoveByInfoPtr(u.Info)
 
 	u.mtx.Lock()
@@ -107,11 +195,12 @@ func (u *S3MultipartUploadWriter) Close() error {
 		if len(u.parts) == 1 && u.multiPartUploadID == nil {
 			part := u.parts[0]
 
-			var content []byte
+			var content io.ReadSeeker
 			content, err = part.getContent()
 			if err == nil {
+				u.hashPart(part)
 				err = u.s3PutObject(content)
-				u.UploadMemoryBufferPool.Put(part.content)
+				u.putPartBuffers(part)
 
 				if err == nil {
 					part.state = S3PartUploadStateSent
@@ -119,19 +208,24 @@ func (u *S3MultipartUploadWriter) Close() error {
 					part.state = S3PartUploadErrorSending
 				}
 			} else {
-				u.UploadMemoryBufferPool.Put(part.content)
+				u.putPartBuffers(part)
 				part.state = S3PartUploadErrorSending
 			}
 		} else {
 			// More than 1 part -> MultiPartUpload used before, we have to send latest part, wait until all parts will be uploaded and then complete the job
+			last := u.parts[len(u.parts)-1]
 			u.mtx.Unlock()
 
-			err = u.enqueueUpload(u.parts[len(u.parts)-1])
+			if last != nil {
+				last.mtx.Lock()
+				err = u.enqueueUpload(last)
+				last.mtx.Unlock()
+			}
 			u.uploadGroup.Wait()
 
 			u.mtx.Lock()
 			if err == nil {
-				pending := u.closePartsInStateAdding()
+				pending := u.closePartsInStateAdding() + u.missingParts()
 				if pending > 0 {
 					err = fmt.Errorf("Closing upload and having %d pending parts to fill", pending)
 				} else {
@@ -144,6 +238,10 @@ func (u *S3MultipartUploadWriter) Close() error {
 		}
 	}
 
+	if err == nil && u.StagingKey != "" {
+		err = u.commit()
+	}
+
 	if err != nil {
 		u.Log.WithField("exception", err).Debug("Error closing upload")
 		u.s3AbortMultipartUpload()
@@ -155,21 +253,201 @@ func (u *S3MultipartUploadWriter) Close() error {
 	return err
 }
 
+// interrupted returns true if the writer is closed because its client went away, rather than closing the file,
+// and the upload may be resumed later
+func (u *S3MultipartUploadWriter) interrupted() bool {
+	if u.ResumableUploads == nil || u.SessionEnded == nil {
+		return false
+	}
+	select {
+	case <-u.SessionEnded:
+		return true
+	default:
+		return false
+	}
+}
+
+// suspend keeps the parts uploaded so far for the client to resume the upload. The data of the parts that
+// weren't uploaded yet is lost, so the object shows up with the size of the parts uploaded in a row from its
+// start. It returns false if there's nothing worth resuming.
+func (u *S3MultipartUploadWriter) suspend() bool {
+	u.uploadGroup.Wait()
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	if u.err != nil || u.multiPartUploadID == nil {
+		return false
+	}
+	sent, size := 0, int64(0)
+	for _, part := range u.parts {
+		if part == nil || part.state != S3PartUploadStateSent {
+			break
+		}
+		_, start, partSize := u.partAt(size)
+		size = start + partSize
+		sent++
+	}
+	if size == 0 {
+		return false
+	}
+
+	u.closePartsInStateAdding()
+	for _, part := range u.parts[sent:] {
+		if part != nil {
+			part.mtx.Lock()
+			u.putPartBuffers(part)
+			part.mtx.Unlock()
+		}
+	}
+	u.parts = u.parts[:sent]
+	// parts uploaded past the first gap are uploaded again when the client resumes
+	u.completedPartsMtx.Lock()
+	if len(u.completedParts) > sent {
+		u.completedParts = u.completedParts[:sent]
+	}
+	u.completedPartsMtx.Unlock()
+	u.Info.Mtx.Lock()
+	u.Info.Size = size
+	u.Info.Mtx.Unlock()
+	u.Log = u.Log.WithFields(logrus.Fields{
+		"uploadid": *u.multiPartUploadID,
+		"size":     size,
+	})
+	u.ResumableUploads.Suspend(u)
+	return true
+}
+
+// resume continues an upload suspended earlier on the same key
+func (u *S3MultipartUploadWriter) resume(su *S3MultipartUploadWriter) {
+	su.mtx.Lock()
+	defer su.mtx.Unlock()
+	u.multiPartUploadID = su.multiPartUploadID
+	u.StagingKey = su.StagingKey
+	u.checksum = su.checksum
+	u.checksumOffset = su.checksumOffset
+	u.completedParts = su.completedParts
+	u.parts = su.parts
+	for _, part := range u.parts {
+		part.uw = u
+	}
+	size := su.Info.GetOne().Size
+	u.resumedSize = size
+	u.Info.SetSizeIfGreater(size)
+	u.PhantomObjectMap.RemoveByInfoPtr(su.Info)
+	u.Log.WithFields(logrus.Fields{
+		"uploadid": *u.multiPartUploadID,
+		"size":     size,
+	}).Info("Resuming interrupted upload")
+	mUploadsResumed.Inc()
+}
+
+// discard aborts an upload suspended earlier
+func (u *S3MultipartUploadWriter) discard() {
+	u.mtx.Lock()
+	u.s3AbortMultipartUpload()
+	u.mtx.Unlock()
+	u.PhantomObjectMap.RemoveByInfoPtr(u.Info)
+}
+
+// partAt returns the index, the offset and the size of the part an offset of the object falls into. Parts are
+// made of memory buffers, and their size doubles every partsPerSizeStep parts so that large objects fit in the
+// maximum number of parts, up to MaxPartBuffers buffers.
+func (u *S3MultipartUploadWriter) partAt(off int64) (int, int64, int64) {
+	bufSize := int64(u.UploadMemoryBufferPool.BufSize)
+	maxBufs := int64(u.MaxPartBuffers)
+	if maxBufs < 1 {
+		maxBufs = 1
+	}
+	if maxBufs > s3MaxPartSize/bufSize {
+		maxBufs = s3MaxPartSize / bufSize
+	}
+	index, start, bufs := 0, int64(0), int64(1)
+	for {
+		size := bufs * bufSize
+		if bufs >= maxBufs || off < start+size*partsPerSizeStep {
+			i := (off - start) / size
+			return index + int(i), start + i*size, size
+		}
+		index += partsPerSizeStep
+		start += size * partsPerSizeStep
+		bufs *= 2
+		if bufs > maxBufs {
+			bufs = maxBufs
+		}
+	}
+}
+
+// getPartBuffers gets the memory buffers of a part of the size passed as parameter from the pool, all at once.
+// When parts may be spilled to disk, buffers are not waited for.
+func (u *S3MultipartUploadWriter) getPartBuffers(size int64) ([][]byte, error) {
+	n := int(size / int64(u.UploadMemoryBufferPool.BufSize))
+	if u.UploadSpill != nil {
+		if bufs := u.UploadMemoryBufferPool.TryGetN(n); bufs != nil {
+			return bufs, nil
+		}
+		return nil, fmt.Errorf("no memory buffer left in pool")
+	}
+	return u.UploadMemoryBufferPool.GetN(n)
+}
+
+// newPart creates a part whose content is kept in memory buffers, or in a file of the spill directory
+// when there are no buffers left
+func (u *S3MultipartUploadWriter) newPart(partNumber int, partStart int64, partSize int64) (*S3PartToUpload, error) {
+	part := &S3PartToUpload{
+		offset:     partStart,
+		o:          util.NewOffsetRanges(partSize),
+		uw:         u,
+		state:      S3PartUploadStateAdding,
+		partNumber: int64(partNumber + 1),
+	}
+	u.Log.Debug("Getting memory buffers from pool")
+	bufs, err := u.getPartBuffers(partSize)
+	if err == nil {
+		part.content = bufs
+		return part, nil
+	}
+	if u.UploadSpill == nil {
+		return nil, err
+	}
+	u.Log.WithField("partnumber", part.partNumber).Debug("Spilling part to disk")
+	part.spilled, err = u.UploadSpill.Create(partSize)
+	if err != nil {
+		return nil, err
+	}
+	return part, nil
+}
+
+// putPartBuffers returns the memory buffers of a part into the pool, or removes the file it's staged in.
+// Parts whose buffers were returned already are left as they are.
+func (u *S3MultipartUploadWriter) putPartBuffers(part *S3PartToUpload) {
+	if part.spilled != nil {
+		part.spilled.Remove()
+		part.spilled = nil
+		return
+	}
+	u.UploadMemoryBufferPool.PutN(part.content)
+	part.content = nil
+}
+
 // WriteAt stores on memory the data sent to be uploaded and uploads it when a part
 // is completed
 func (u *S3MultipartUploadWriter) WriteAt(buf []byte, off int64) (int, error) {
 	pending := int64(len(buf))
 	offFinal := off + pending
-	partSize := int64(u.UploadMemoryBufferPool.BufSize)
-	partNumberInitial := int(off / partSize)
-	partOffsetInitial := off % partSize
 	bufOffset := int64(0)
 
 	var err error
 	u.mtx.Lock()
 	err = u.err
 	if err == nil && u.MaxObjectSize >= 0 && offFinal > u.MaxObjectSize {
-		err = fmt.Errorf("file too large: maximum allowed size is %d bytes", u.MaxObjectSize)
+		err = quotaExceeded("file too large: maximum allowed size is %d bytes", u.MaxObjectSize)
+	}
+	partNumberFinal, _, _ := u.partAt(offFinal - 1)
+	if err == nil && partNumberFinal >= s3MaxParts {
+		err = quotaExceeded("file too large: more than %d parts would be needed", s3MaxParts)
+	}
+	if err == nil && off < u.resumedSize {
+		// the parts uploaded before the upload was interrupted can't be changed anymore
+		err = fmt.Errorf("resumed upload written at offset %d, before its size of %d bytes", off, u.resumedSize)
 	}
 
 	if err != nil {
@@ -182,8 +460,7 @@ func (u *S3MultipartUploadWriter) WriteAt(buf []byte, off int64) (int, error) {
 		return 0, err
 	}
 
-	partNumberFinal := int((off + pending - 1) / partSize)
-	u.Log.Debugf("WriteAt len(buf)=%d, off=%d, partNumberInitial=%d, partOffsetInitial=%d", len(buf), off, partNumberInitial, partOffsetInitial)
+	u.Log.Debugf("WriteAt len(buf)=%d, off=%d, partNumberFinal=%d", len(buf), off, partNumberFinal)
 	u.Info.SetSizeIfGreater(offFinal)
 	if len(u.parts) <= partNumberFinal {
 		newParts := make([]*S3PartToUpload, partNumberFinal+1)
@@ -192,16 +469,15 @@ func (u *S3MultipartUploadWriter) WriteAt(buf []byte, off int64) (int, error) {
 	}
 	u.mtx.Unlock()
 
-	partNumber := partNumberInitial
-	partOffset := partOffsetInitial
 	for pending > 0 {
+		partNumber, partStart, partSize := u.partAt(off)
+		partOffset := off - partStart
 		u.mtx.Lock()
 		part := u.parts[partNumber]
 		if part == nil {
-			u.Log.Debug("Getting memory buffer from pool")
-			buf, err := u.UploadMemoryBufferPool.Get()
+			part, err = u.newPart(partNumber, partStart, partSize)
 			if err != nil {
-				u.Log.WithField("exception", err).Error("Error getting a memory buffer from pool")
+				u.Log.WithField("exception", err).Error("Error getting room for a part")
 				u.s3AbortMultipartUpload()
 				u.closePartsInStateAdding()
 				u.err = err
@@ -209,14 +485,6 @@ func (u *S3MultipartUploadWriter) WriteAt(buf []byte, off int64) (int, error) {
 				mOperationStatus.With(prometheus.Labels{"method": u.RequestMethod, "status": "failure"}).Inc()
 				return 0, err
 			}
-
-			part = &S3PartToUpload{
-				content:    buf,
-				o:          util.NewOffsetRanges(partSize),
-				uw:         u,
-				state:      S3PartUploadStateAdding,
-				partNumber: int64(partNumber + 1),
-			}
 			u.parts[partNumber] = part
 		}
 		u.mtx.Unlock()
@@ -229,28 +497,29 @@ func (u *S3MultipartUploadWriter) WriteAt(buf []byte, off int64) (int, error) {
 
 		part.mtx.Lock()
 		if part.state < S3PartUploadStateFull {
-			part.copy(buf[bufOffset:bufOffset+partCopied], partOffset, partOffsetFinal)
-			if part.isFull() {
+			err = part.copy(buf[bufOffset:bufOffset+partCopied], partOffset, partOffsetFinal)
+			if err != nil {
+				u.Log.WithField("exception", err).Error("Error writing to spilled part")
+			} else if part.isFull() {
 				err = u.enqueueUpload(part)
-				if err != nil {
-					part.mtx.Unlock()
-					u.mtx.Lock()
-					u.s3AbortMultipartUpload()
-					u.closePartsInStateAdding()
-					u.err = err
-					u.mtx.Unlock()
-					mOperationStatus.With(prometheus.Labels{"method": u.RequestMethod, "status": "failure"}).Inc()
-					return 0, err
-				}
+			}
+			if err != nil {
+				part.mtx.Unlock()
+				u.mtx.Lock()
+				u.s3AbortMultipartUpload()
+				u.closePartsInStateAdding()
+				u.err = err
+				u.mtx.Unlock()
+				mOperationStatus.With(prometheus.Labels{"method": u.RequestMethod, "status": "failure"}).Inc()
+				return 0, err
 			}
 		} else {
 			u.Log.WithField("partnumber", partNumber).Warn("Trying to add more data to an already full part")
 		}
 		part.mtx.Unlock()
-		partNumber++
 		pending -= partCopied
 		bufOffset += partCopied
-		partOffset = 0
+		off += partCopied
 	}
 	mWritesBytesTotal.Add(float64(len(buf)))
 	return len(buf), nil
@@ -265,18 +534,24 @@ func (u *S3MultipartUploadWriter) enqueueUpload(part *S3PartToUpload) error {
 				return err
 			}
 		}
+		// the writer forgets the upload if it's aborted, while the part may still be uploading
+		part.uploadID = u.multiPartUploadID
 		u.mtx.Unlock()
 
 		log := u.Log.WithFields(logrus.Fields{
-			"uploadid":   *u.multiPartUploadID,
+			"uploadid":   *part.uploadID,
 			"partnumber": part.partNumber,
 		})
 		log.Debugf("Enqueuing part to be uploaded")
+		u.hashPart(part)
 		part.state = S3PartUploadStateFull
 		u.uploadGroup.Add(1)
 		select {
 		case <-u.Ctx.Done():
 			log.Debug("Enqueue upload cancelled")
+			u.uploadGroup.Done()
+			u.putPartBuffers(part)
+			part.state = S3PartUploadCancelled
 			return fmt.Errorf("Enqueue upload cancelled")
 		case u.UploadChan <- part:
 		}
@@ -292,7 +567,7 @@ func (u *S3MultipartUploadWriter) closePartsInStateAdding() int {
 			if part != nil {
 				part.mtx.Lock()
 				if part.state == S3PartUploadStateAdding {
-					u.UploadMemoryBufferPool.Put(part.content)
+					u.putPartBuffers(part)
 					part.state = S3PartUploadCancelled
 					pending++
 				}
@@ -303,9 +578,20 @@ func (u *S3MultipartUploadWriter) closePartsInStateAdding() int {
 	return pending
 }
 
+// missingParts returns the number of parts never written in between the parts of the object
+func (u *S3MultipartUploadWriter) missingParts() int {
+	missing := 0
+	for _, part := range u.parts {
+		if part == nil {
+			missing++
+		}
+	}
+	return missing
+}
+
 // S3 related actions
 func (u *S3MultipartUploadWriter) s3CreateMultipartUpload() error {
-	key := u.Info.GetOne().Key.String()
+	key := u.uploadKey()
 	sse := u.ServerSideEncryption
 	u.Log.Debugf("CreateMultipartUpload(sse=%v)", sse)
 
@@ -330,14 +616,14 @@ func (u *S3MultipartUploadWriter) s3CreateMultipartUpload() error {
 	return nil
 }
 
-func (u *S3MultipartUploadWriter) s3PutObject(content []byte) error {
-	key := u.Info.GetOne().Key.String()
+func (u *S3MultipartUploadWriter) s3PutObject(content io.ReadSeeker) error {
+	key := u.uploadKey()
 	sse := u.ServerSideEncryption
 	u.Log.Debugf("PutObject(sse=%v)", sse)
 
 	params := &aws_s3.PutObjectInput{
 		ACL:                  &aclPrivate,
-		Body:                 bytes.NewReader(content),
+		Body:                 content,
 		Bucket:               &u.Bucket,
 		Key:                  &key,
 		ServerSideEncryption: sseTypes[sse.Type],
@@ -355,7 +641,7 @@ func (u *S3MultipartUploadWriter) s3PutObject(content []byte) error {
 
 func (u *S3MultipartUploadWriter) s3AbortMultipartUpload() error {
 	if u.multiPartUploadID != nil {
-		key := u.Info.GetOne().Key.String()
+		key := u.uploadKey()
 		sse := u.ServerSideEncryption
 		log := u.Log.WithField("uploadid", *u.multiPartUploadID)
 		log.Debugf("AbortMultipartUpload(sse=%v)", sse)
@@ -376,7 +662,7 @@ func (u *S3MultipartUploadWriter) s3AbortMultipartUpload() error {
 }
 
 func (u *S3MultipartUploadWriter) s3CompleteMultipartUpload() error {
-	key := u.Info.GetOne().Key.String()
+	key := u.uploadKey()
 	sse := u.ServerSideEncryption
 	log := u.Log.WithField("uploadid", *u.multiPartUploadID)
 	log.Debugf("CompleteMultipartUpload(sse=%v)", sse)
@@ -395,15 +681,15 @@ func (u *S3MultipartUploadWriter) s3CompleteMultipartUpload() error {
 }
 
 func (u *S3MultipartUploadWriter) s3UploadPart(part *S3PartToUpload) error {
-	key := u.Info.GetOne().Key.String()
+	key := u.uploadKey()
 	sse := u.ServerSideEncryption
 	log := u.Log.WithFields(logrus.Fields{
-		"uploadid":   *u.multiPartUploadID,
+		"uploadid":   *part.uploadID,
 		"partnumber": part.partNumber,
 	})
 	log.Debugf("UploadPart(sse=%v)", sse)
 
-	var content []byte
+	var content io.ReadSeeker
 	var err error
 
 	content, err = part.getContent()
@@ -414,8 +700,8 @@ func (u *S3MultipartUploadWriter) s3UploadPart(part *S3PartToUpload) error {
 	params := &aws_s3.UploadPartInput{
 		Bucket:               &u.Bucket,
 		Key:                  &key,
-		Body:                 bytes.NewReader(content),
-		UploadId:             u.multiPartUploadID,
+		Body:                 content,
+		UploadId:             part.uploadID,
 		SSECustomerAlgorithm: nilIfEmpty(sse.CustomerAlgorithm()),
 		SSECustomerKey:       nilIfEmpty(sse.CustomerKey),
 		SSECustomerKeyMD5:    nilIfEmpty(sse.CustomerKeyMD5),
@@ -429,8 +715,11 @@ func (u *S3MultipartUploadWriter) s3UploadPart(part *S3PartToUpload) error {
 		return err
 	}
 
-	if len(u.completedParts) < len(u.parts) {
-		newCompletedParts := make([]*aws_s3.CompletedPart, len(u.parts))
+	// several parts of the upload may be uploaded at once
+	u.completedPartsMtx.Lock()
+	defer u.completedPartsMtx.Unlock()
+	if int64(len(u.completedParts)) < part.partNumber {
+		newCompletedParts := make([]*aws_s3.CompletedPart, part.partNumber)
 		copy(newCompletedParts, u.completedParts)
 		u.completedParts = newCompletedParts
 	}
@@ -509,14 +798,14 @@ func (w *S3UploadWorkers) uploadPart(part *S3PartToUpload) {
 
 	if part.state != S3PartUploadStateFull {
 		u.Log.WithFields(logrus.Fields{
-			"uploadid":   *u.multiPartUploadID,
+			"uploadid":   aws.StringValue(part.uploadID),
 			"partnumber": part.partNumber,
 		}).Warnf("Invalid state: %d", part.state)
 		return
 	}
 
 	err := u.s3UploadPart(part)
-	u.UploadMemoryBufferPool.Put(part.content)
+	u.putPartBuffers(part)
 
 	if err != nil {
 		part.state = S3PartUploadErrorSending
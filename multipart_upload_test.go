@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"testing"
 	"time"
 
@@ -27,6 +28,7 @@ type mockedS3 struct {
 	errorAbortMultipartUploadCalls    int
 
 	partSize                     int
+	partOffset                   func(partNumber int64) int
 	uploadPartCalls              int
 	putObjectCalls               int
 	createMultipartUploadCalls   int
@@ -74,6 +76,9 @@ func (m *mockedS3) UploadPartWithContext(_ aws.Context, input *aws_s3.UploadPart
 	}
 
 	off := int((*input.PartNumber)-1) * m.partSize
+	if m.partOffset != nil {
+		off = m.partOffset(*input.PartNumber)
+	}
 	b, err := ioutil.ReadAll(input.Body)
 	if err != nil {
 		return nil, err
@@ -749,6 +754,255 @@ func TestMultipartUploadErrorasdf(t *testing.T) {
 	assertPartsWithState(t, u, 0, S3PartUploadStateAdding)
 }
 
+func TestMultipartUploadPartAt(t *testing.T) {
+	u := &S3MultipartUploadWriter{
+		UploadMemoryBufferPool: NewMemoryBufferPool(context.Background(), 10, 8, 5*time.Second),
+		MaxPartBuffers:         4,
+	}
+	for _, c := range []struct {
+		off   int64
+		index int
+		start int64
+		size  int64
+	}{
+		{0, 0, 0, 10},
+		{9999, 999, 9990, 10},
+		{10000, 1000, 10000, 20},
+		{30000, 2000, 30000, 40},
+		// MaxPartBuffers buffers at most
+		{70000, 3000, 70000, 40},
+		{110039, 4000, 110000, 40},
+	} {
+		index, start, size := u.partAt(c.off)
+		assert.Equal(t, c.index, index, "%d", c.off)
+		assert.Equal(t, c.start, start, "%d", c.off)
+		assert.Equal(t, c.size, size, "%d", c.off)
+	}
+}
+
+func TestMultipartUploadGrowingParts(t *testing.T) {
+	log, _ := fake_log.NewNullLogger()
+	w := NewS3UploadWorkers(context.Background(), 1, log)
+	ch := w.Start()
+	m := &mockedS3{
+		partOffset: func(partNumber int64) int {
+			if partNumber <= partsPerSizeStep {
+				return int(partNumber - 1)
+			}
+			return partsPerSizeStep + int(partNumber-partsPerSizeStep-1)*2
+		},
+	}
+	u := &S3MultipartUploadWriter{
+		Ctx:                    context.Background(),
+		S3:                     m,
+		UploadMemoryBufferPool: NewMemoryBufferPool(context.Background(), 1, 4, 5*time.Second),
+		MaxPartBuffers:         2,
+		RequestMethod:          "read",
+		Log:                    log,
+		PhantomObjectMap:       NewPhantomObjectMap(),
+		Info:                   &PhantomObjectInfo{Key: Path{"", "a", "b"}},
+		UploadChan:             ch,
+		MaxObjectSize:          -1,
+		ServerSideEncryption:   &ServerSideEncryptionConfig{},
+	}
+	buf := make([]byte, partsPerSizeStep+21)
+	for i := range buf {
+		buf[i] = byte(i%10 + 48)
+	}
+	_, err := u.WriteAt(buf, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, u.Close())
+	close(ch)
+	w.WaitForCompletion()
+	assert.Equal(t, 0, m.putObjectCalls)
+	assert.Equal(t, partsPerSizeStep+11, m.uploadPartCalls)
+	assert.Equal(t, 1, m.completeMultipartUploadCalls)
+	assert.Equal(t, 0, m.abortMultipartUploadCalls)
+	assert.Equal(t, len(buf), m.totalBytes)
+	assert.Equal(t, int32(0), u.UploadMemoryBufferPool.Used)
+}
+
+func TestMultipartUploadConcurrentUploads(t *testing.T) {
+	log, _ := fake_log.NewNullLogger()
+	w := NewS3UploadWorkers(context.Background(), 1, log)
+	ch := w.Start()
+	// parts grow up to 2 buffers, the default upload_max_part_buffers for a pool of 4 buffers and 1 worker
+	pool := NewMemoryBufferPool(context.Background(), 1, 4, 200*time.Millisecond)
+	buf := make([]byte, partsPerSizeStep+21)
+	for i := range buf {
+		buf[i] = byte(i%10 + 48)
+	}
+	partOffset := func(partNumber int64) int {
+		if partNumber <= partsPerSizeStep {
+			return int(partNumber - 1)
+		}
+		return partsPerSizeStep + int(partNumber-partsPerSizeStep-1)*2
+	}
+	ms := []*mockedS3{{partOffset: partOffset}, {partOffset: partOffset}}
+	errs := make(chan error, len(ms))
+	for _, m := range ms {
+		u := &S3MultipartUploadWriter{
+			Ctx:                    context.Background(),
+			S3:                     m,
+			UploadMemoryBufferPool: pool,
+			MaxPartBuffers:         2,
+			RequestMethod:          "read",
+			Log:                    log,
+			PhantomObjectMap:       NewPhantomObjectMap(),
+			Info:                   &PhantomObjectInfo{Key: Path{"", "a", "b"}},
+			UploadChan:             ch,
+			MaxObjectSize:          -1,
+			ServerSideEncryption:   &ServerSideEncryptionConfig{},
+		}
+		go func() {
+			for off := 0; off < len(buf); off++ {
+				if _, err := u.WriteAt(buf[off:off+1], int64(off)); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- u.Close()
+		}()
+	}
+	for range ms {
+		assert.NoError(t, <-errs)
+	}
+	close(ch)
+	w.WaitForCompletion()
+	for _, m := range ms {
+		assert.Equal(t, partsPerSizeStep+11, m.uploadPartCalls)
+		assert.Equal(t, 1, m.completeMultipartUploadCalls)
+		assert.Equal(t, len(buf), m.totalBytes)
+	}
+	assert.Equal(t, int32(0), pool.Used)
+}
+
+func TestMultipartUploadTooManyParts(t *testing.T) {
+	log, _ := fake_log.NewNullLogger()
+	w := NewS3UploadWorkers(context.Background(), 1, log)
+	ch := w.Start()
+	m := &mockedS3{
+		partSize: 1,
+	}
+	u := &S3MultipartUploadWriter{
+		Ctx:                    context.Background(),
+		S3:                     m,
+		UploadMemoryBufferPool: NewMemoryBufferPool(context.Background(), 1, 1, 5*time.Second),
+		RequestMethod:          "read",
+		Log:                    log,
+		PhantomObjectMap:       NewPhantomObjectMap(),
+		Info:                   &PhantomObjectInfo{Key: Path{"", "a", "b"}},
+		UploadChan:             ch,
+		MaxObjectSize:          -1,
+		ServerSideEncryption:   &ServerSideEncryptionConfig{},
+	}
+	_, err := u.WriteAt([]byte("0"), s3MaxParts-1)
+	assert.NoError(t, err)
+	_, err = u.WriteAt([]byte("0"), s3MaxParts)
+	assert.Error(t, err)
+	assert.Error(t, u.Close())
+	close(ch)
+	w.WaitForCompletion()
+	assert.Equal(t, 1, m.uploadPartCalls)
+	assert.Equal(t, 0, m.completeMultipartUploadCalls)
+	assert.Equal(t, 1, m.abortMultipartUploadCalls)
+}
+
+func TestMultipartUploadSpill(t *testing.T) {
+	partSize := 10
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	us, err := NewUploadSpill(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log, _ := fake_log.NewNullLogger()
+	w := NewS3UploadWorkers(context.Background(), 1, log)
+	ch := w.Start()
+	m := &mockedS3{
+		partSize: partSize,
+	}
+	u := &S3MultipartUploadWriter{
+		Ctx:                    context.Background(),
+		S3:                     m,
+		UploadMemoryBufferPool: NewMemoryBufferPool(context.Background(), partSize, 1, 5*time.Second),
+		UploadSpill:            us,
+		RequestMethod:          "read",
+		Log:                    log,
+		PhantomObjectMap:       NewPhantomObjectMap(),
+		Info:                   &PhantomObjectInfo{Key: Path{"", "a", "b"}},
+		UploadChan:             ch,
+		MaxObjectSize:          -1,
+		ServerSideEncryption:   &ServerSideEncryptionConfig{},
+	}
+	buf := make([]byte, 25)
+	for i := range buf {
+		buf[i] = byte(i%10 + 48)
+	}
+	// the first part takes the only buffer of the pool, the second one is spilled to disk
+	_, err = u.WriteAt(buf[7:19], 7)
+	assert.NoError(t, err)
+	assert.NotNil(t, u.parts[1].spilled)
+	_, err = u.WriteAt(buf[:7], 0)
+	assert.NoError(t, err)
+	_, err = u.WriteAt(buf[19:], 19)
+	assert.NoError(t, err)
+	assert.NoError(t, u.Close())
+	close(ch)
+	w.WaitForCompletion()
+	assert.Equal(t, 3, m.uploadPartCalls)
+	assert.Equal(t, 1, m.completeMultipartUploadCalls)
+	assert.Equal(t, len(buf), m.totalBytes)
+	assert.Equal(t, int32(0), u.UploadMemoryBufferPool.Used)
+	assert.Equal(t, int64(0), us.used)
+	files, _ := ioutil.ReadDir(dir)
+	assert.Empty(t, files)
+}
+
+func TestMultipartUploadSpillQuotaExceeded(t *testing.T) {
+	partSize := 10
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	us, err := NewUploadSpill(dir, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log, _ := fake_log.NewNullLogger()
+	w := NewS3UploadWorkers(context.Background(), 1, log)
+	ch := w.Start()
+	m := &mockedS3{
+		partSize: partSize,
+	}
+	u := &S3MultipartUploadWriter{
+		Ctx:                    context.Background(),
+		S3:                     m,
+		UploadMemoryBufferPool: NewMemoryBufferPool(context.Background(), partSize, 1, 5*time.Second),
+		UploadSpill:            us,
+		RequestMethod:          "read",
+		Log:                    log,
+		PhantomObjectMap:       NewPhantomObjectMap(),
+		Info:                   &PhantomObjectInfo{Key: Path{"", "a", "b"}},
+		UploadChan:             ch,
+		MaxObjectSize:          -1,
+		ServerSideEncryption:   &ServerSideEncryptionConfig{},
+	}
+	_, err = u.WriteAt([]byte("7890123456"), 7)
+	assert.Error(t, err)
+	close(ch)
+	w.WaitForCompletion()
+	assert.Equal(t, 0, m.uploadPartCalls)
+	assert.Equal(t, int32(0), u.UploadMemoryBufferPool.Used)
+	assert.Equal(t, int64(0), us.used)
+	files, _ := ioutil.ReadDir(dir)
+	assert.Empty(t, files)
+}
+
 // Helpers
 func assertPartsWithState(t *testing.T, u *S3MultipartUploadWriter, expected int, state S3PartUploadState) {
 	res := 0
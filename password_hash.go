@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Password hash methods allowed as authentication_method
+const (
+	authMethodPlain       = "plain"
+	authMethodBcrypt      = "bcrypt"
+	authMethodArgon2id    = "argon2id"
+	authMethodScrypt      = "scrypt"
+	authMethodSHA512Crypt = "sha512-crypt"
+)
+
+// detectAuthenticationMethod guesses the hash method of a password from its prefix.
+// Passwords not starting with "$" are taken as plain text, while unknown hashes give an empty method.
+func detectAuthenticationMethod(password string) string {
+	switch {
+	case strings.HasPrefix(password, "$2a$"), strings.HasPrefix(password, "$2b$"), strings.HasPrefix(password, "$2y$"):
+		return authMethodBcrypt
+	case strings.HasPrefix(password, "$argon2id$"):
+		return authMethodArgon2id
+	case strings.HasPrefix(password, "$scrypt$"):
+		return authMethodScrypt
+	case strings.HasPrefix(password, "$6$"):
+		return authMethodSHA512Crypt
+	case strings.HasPrefix(password, "$"):
+		return ""
+	default:
+		return authMethodPlain
+	}
+}
+
+// newUserWithHashedPassword creates a user validating passwords with the method passed as parameter.
+// The password hash is checked to be well-formed, so that broken hashes are reported on configuration.
+func newUserWithHashedPassword(method string, u UserWithPassword) (User, error) {
+	if method == "" {
+		method = detectAuthenticationMethod(u.password)
+		if method == "" {
+			return nil, fmt.Errorf(`unsupported password hash, set authentication_method = "plain" for plain text passwords starting with "$"`)
+		}
+	}
+	switch method {
+	case authMethodPlain:
+		return &UserPlainTextPassword{u}, nil
+	case authMethodBcrypt:
+		if _, err := bcrypt.Cost([]byte(u.password)); err != nil {
+			return nil, fmt.Errorf("invalid bcrypt password hash: %s", err)
+		}
+		return &UserBcryptPassword{u}, nil
+	case authMethodArgon2id:
+		if _, err := parseArgon2idHash(u.password); err != nil {
+			return nil, err
+		}
+		return &UserArgon2idPassword{u}, nil
+	case authMethodScrypt:
+		if _, err := parseScryptHash(u.password); err != nil {
+			return nil, err
+		}
+		return &UserScryptPassword{u}, nil
+	case authMethodSHA512Crypt:
+		if _, err := parseSHA512CryptHash(u.password); err != nil {
+			return nil, err
+		}
+		return &UserSHA512CryptPassword{u}, nil
+	default:
+		return nil, fmt.Errorf("unknown authentication method: %s", method)
+	}
+}
+
+// parsePHCParams parses the comma-separated parameters of a PHC string (like "m=65536,t=3,p=4")
+func parsePHCParams(s string, names ...string) (map[string]int, error) {
+	params := map[string]int{}
+	for _, kv := range strings.Split(s, ",") {
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("malformed parameter %s", kv)
+		}
+		v, err := strconv.Atoi(kv[i+1:])
+		if err != nil || v <= 0 {
+			return nil, fmt.Errorf("malformed parameter %s", kv)
+		}
+		params[kv[:i]] = v
+	}
+	for _, name := range names {
+		if _, ok := params[name]; !ok {
+			return nil, fmt.Errorf("missing parameter %s", name)
+		}
+	}
+	return params, nil
+}
+
+// phcHash hash in PHC string format: $<id>$<params>$<salt>$<hash>, salt and hash being base64-encoded with no padding
+type phcHash struct {
+	params map[string]int
+	salt   []byte
+	key    []byte
+}
+
+func parsePHCHash(s string, id string, paramNames ...string) (*phcHash, error) {
+	fields := strings.Split(s, "$")
+	if len(fields) == 6 && id == authMethodArgon2id && fields[2] == "v=19" {
+		// the version field is optional, and 19 is the only one supported
+		fields = append(fields[:2], fields[3:]...)
+	}
+	if len(fields) != 5 || fields[0] != "" || fields[1] != id {
+		return nil, fmt.Errorf("malformed %s password hash", id)
+	}
+	params, err := parsePHCParams(fields[2], paramNames...)
+	if err != nil {
+		return nil, fmt.Errorf("malformed %s password hash: %s", id, err)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(fields[3])
+	if err != nil {
+		return nil, fmt.Errorf("malformed %s password hash: invalid salt", id)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(fields[4])
+	if err != nil || len(key) == 0 {
+		return nil, fmt.Errorf("malformed %s password hash: invalid hash", id)
+	}
+	return &phcHash{params: params, salt: salt, key: key}, nil
+}
+
+func parseArgon2idHash(s string) (*phcHash, error) {
+	h, err := parsePHCHash(s, authMethodArgon2id, "m", "t", "p")
+	if err != nil {
+		return nil, err
+	}
+	if h.params["p"] > 255 {
+		return nil, fmt.Errorf("malformed argon2id password hash: p must be lower than 256")
+	}
+	return h, nil
+}
+
+// parseScryptHash parses a scrypt hash like $scrypt$ln=15,r=8,p=1$<salt>$<hash>, where ln is the base 2 logarithm of N
+func parseScryptHash(s string) (*phcHash, error) {
+	h, err := parsePHCHash(s, authMethodScrypt, "ln", "r", "p")
+	if err != nil {
+		return nil, err
+	}
+	if h.params["ln"] >= 32 {
+		return nil, fmt.Errorf("malformed scrypt password hash: ln must be lower than 32")
+	}
+	return h, nil
+}
+
+// UserArgon2idPassword user with password hashed using argon2id, in PHC string format
+type UserArgon2idPassword struct {
+	UserWithPassword
+}
+
+// ValidatePassword validates a password
+func (u *UserArgon2idPassword) ValidatePassword(pwd []byte) bool {
+	h, err := parseArgon2idHash(u.password)
+	if err != nil {
+		return false
+	}
+	key := argon2.IDKey(pwd, h.salt, uint32(h.params["t"]), uint32(h.params["m"]), uint8(h.params["p"]), uint32(len(h.key)))
+	return subtle.ConstantTimeCompare(key, h.key) == 1
+}
+
+// UserScryptPassword user with password hashed using scrypt
+type UserScryptPassword struct {
+	UserWithPassword
+}
+
+// ValidatePassword validates a password
+func (u *UserScryptPassword) ValidatePassword(pwd []byte) bool {
+	h, err := parseScryptHash(u.password)
+	if err != nil {
+		return false
+	}
+	key, err := scrypt.Key(pwd, h.salt, 1<<uint(h.params["ln"]), h.params["r"], h.params["p"], len(h.key))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(key, h.key) == 1
+}
+
+const (
+	sha512CryptDefaultRounds = 5000
+	sha512CryptMinRounds     = 1000
+	sha512CryptMaxRounds     = 999999999
+	sha512CryptMaxSaltLen    = 16
+	cryptAlphabet            = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+// sha512CryptHash hash in the $6$[rounds=<rounds>$]<salt>$<hash> format found in shadow files
+type sha512CryptHash struct {
+	rounds       int
+	roundsCustom bool
+	salt         []byte
+}
+
+func parseSHA512CryptHash(s string) (*sha512CryptHash, error) {
+	if !strings.HasPrefix(s, "$6$") {
+		return nil, fmt.Errorf("malformed sha512-crypt password hash")
+	}
+	fields := strings.Split(s[3:], "$")
+	h := &sha512CryptHash{rounds: sha512CryptDefaultRounds}
+	if len(fields) == 3 && strings.HasPrefix(fields[0], "rounds=") {
+		rounds, err := strconv.Atoi(fields[0][len("rounds="):])
+		if err != nil {
+			return nil, fmt.Errorf("malformed sha512-crypt password hash: invalid rounds")
+		}
+		if rounds < sha512CryptMinRounds {
+			rounds = sha512CryptMinRounds
+		} else if rounds > sha512CryptMaxRounds {
+			rounds = sha512CryptMaxRounds
+		}
+		h.rounds, h.roundsCustom = rounds, true
+		fields = fields[1:]
+	}
+	if len(fields) != 2 || len(fields[1]) != 86 {
+		return nil, fmt.Errorf("malformed sha512-crypt password hash")
+	}
+	h.salt = []byte(fields[0])
+	if len(h.salt) > sha512CryptMaxSaltLen {
+		h.salt = h.salt[:sha512CryptMaxSaltLen]
+	}
+	return h, nil
+}
+
+// repeatBytes returns the bytes passed as parameter repeated up to the given length
+func repeatBytes(b []byte, n int) []byte {
+	retval := make([]byte, 0, n)
+	for len(retval)+len(b) <= n {
+		retval = append(retval, b...)
+	}
+	return append(retval, b[:n-len(retval)]...)
+}
+
+// sha512Crypt computes a sha512-crypt hash as specified in https://www.akkadia.org/drepper/SHA-crypt.txt
+func sha512Crypt(pwd []byte, h *sha512CryptHash) string {
+	b := sha512.New()
+	b.Write(pwd)
+	b.Write(h.salt)
+	b.Write(pwd)
+	digestB := b.Sum(nil)
+
+	a := sha512.New()
+	a.Write(pwd)
+	a.Write(h.salt)
+	a.Write(repeatBytes(digestB, len(pwd)))
+	for i := len(pwd); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			a.Write(digestB)
+		} else {
+			a.Write(pwd)
+		}
+	}
+	digestA := a.Sum(nil)
+
+	dp := sha512.New()
+	for i := 0; i < len(pwd); i++ {
+		dp.Write(pwd)
+	}
+	p := repeatBytes(dp.Sum(nil), len(pwd))
+
+	ds := sha512.New()
+	for i := 0; i < 16+int(digestA[0]); i++ {
+		ds.Write(h.salt)
+	}
+	s := repeatBytes(ds.Sum(nil), len(h.salt))
+
+	c := digestA
+	for i := 0; i < h.rounds; i++ {
+		r := sha512.New()
+		if i&1 != 0 {
+			r.Write(p)
+		} else {
+			r.Write(c)
+		}
+		if i%3 != 0 {
+			r.Write(s)
+		}
+		if i%7 != 0 {
+			r.Write(p)
+		}
+		if i&1 != 0 {
+			r.Write(c)
+		} else {
+			r.Write(p)
+		}
+		c = r.Sum(nil)
+	}
+
+	buf := bytes.NewBufferString("$6$")
+	if h.roundsCustom {
+		fmt.Fprintf(buf, "rounds=%d$", h.rounds)
+	}
+	buf.Write(h.salt)
+	buf.WriteByte('$')
+	encode := func(b2, b1, b0 byte, n int) {
+		w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+		for ; n > 0; n-- {
+			buf.WriteByte(cryptAlphabet[w&0x3f])
+			w >>= 6
+		}
+	}
+	for i := 0; i < 21; i++ {
+		encode(c[i*22%63], c[(i*22+21)%63], c[(i*22+42)%63], 4)
+	}
+	encode(0, 0, c[63], 2)
+	return buf.String()
+}
+
+// UserSHA512CryptPassword user with password hashed using sha512-crypt, as found in shadow files
+type UserSHA512CryptPassword struct {
+	UserWithPassword
+}
+
+// ValidatePassword validates a password
+func (u *UserSHA512CryptPassword) ValidatePassword(pwd []byte) bool {
+	h, err := parseSHA512CryptHash(u.password)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(sha512Crypt(pwd, h)), []byte(u.password)) == 1
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/argon2"
+)
+
+func TestUserSHA512CryptPasswordValidation(t *testing.T) {
+	tests := []struct {
+		enc      string
+		pass     string
+		expected bool
+	}{
+		{
+			enc:      "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1",
+			pass:     "Hello world!",
+			expected: true,
+		},
+		{
+			enc:      "$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v.",
+			pass:     "Hello world!",
+			expected: true,
+		},
+		{
+			enc:      "$6$rounds=1000$x$JUgHESfT/mKR2X.Qz/PrkEgBINN.wbH/GsJhhFRcgrb0a4MjVYFixxXtKicccBbv9PSG/n1kVdpVqZiR7Brv1.",
+			pass:     "",
+			expected: true,
+		},
+		{
+			enc:      "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1",
+			pass:     "Hello world",
+			expected: false,
+		},
+	}
+
+	for _, test := range tests {
+		u := &UserSHA512CryptPassword{UserWithPassword{password: test.enc}}
+		assert.Equal(t, test.expected, u.ValidatePassword([]byte(test.pass)), test.enc)
+	}
+}
+
+func TestUserScryptPasswordValidation(t *testing.T) {
+	// RFC 7914 test vector
+	enc := "$scrypt$ln=10,r=8,p=16$TmFDbA$/bq+HJ00cgB4VucZDQHp/nxq18vII3gw53N2Y0s3MWIurzDZLiKjiG/xCSedmDDaxyevuUqD7m2DYMvfoswGQA"
+	u := &UserScryptPassword{UserWithPassword{password: enc}}
+	assert.True(t, u.ValidatePassword([]byte("password")))
+	assert.False(t, u.ValidatePassword([]byte("password2")))
+}
+
+func TestUserArgon2idPasswordValidation(t *testing.T) {
+	salt := []byte("somesalt")
+	key := argon2.IDKey([]byte("password"), salt, 2, 1024, 1, 32)
+	enc := fmt.Sprintf("$argon2id$v=19$m=1024,t=2,p=1$%s$%s", base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+	u := &UserArgon2idPassword{UserWithPassword{password: enc}}
+	assert.True(t, u.ValidatePassword([]byte("password")))
+	assert.False(t, u.ValidatePassword([]byte("password2")))
+}
+
+func TestNewUserWithHashedPassword(t *testing.T) {
+	tests := []struct {
+		method   string
+		password string
+		expected interface{}
+	}{
+		{"", "test", &UserPlainTextPassword{}},
+		{"", "$2a$04$IdGko3VpUeqY/HEFv5olLOa/E.dswOKxSEivXDSYnvXLWRQyJSFOi", &UserBcryptPassword{}},
+		{"", "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1", &UserSHA512CryptPassword{}},
+		{"", "$scrypt$ln=10,r=8,p=16$TmFDbA$/bq+HJ00cgB4VucZDQHp/nxq18vII3gw53N2Y0s3MWIurzDZLiKjiG/xCSedmDDaxyevuUqD7m2DYMvfoswGQA", &UserScryptPassword{}},
+		{"", "$argon2id$v=19$m=1024,t=2,p=1$c29tZXNhbHQ$c29tZWhhc2g", &UserArgon2idPassword{}},
+		{"plain", "$6$not-a-hash", &UserPlainTextPassword{}},
+		{"", "$6$not-a-hash", nil},
+		{"", "$1$saltsalt$qjXMvbEw8oaL.CzflDugX/", nil},
+		{"", "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZF1xJrlu/", nil},
+		{"", "$y$j9T$salt$hash", nil},
+		{"", "$pbkdf2-sha256$29000$N2ZMqnbJ$hash", nil},
+		{"bcrypt", "test", nil},
+		{"argon2id", "$argon2id$v=19$m=1024,t=2$c29tZXNhbHQ$c29tZWhhc2g", nil},
+		{"scrypt", "$scrypt$ln=10,r=8,p=16$TmFDbA", nil},
+		{"md5", "test", nil},
+	}
+	for _, test := range tests {
+		u, err := newUserWithHashedPassword(test.method, UserWithPassword{name: "user1", password: test.password})
+		if test.expected == nil {
+			assert.Error(t, err, test.password)
+		} else {
+			assert.NoError(t, err, test.password)
+			assert.IsType(t, test.expected, u, test.password)
+		}
+	}
+}
@@ -1,6 +1,10 @@
 package main
 
-import "strings"
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
 
 // Path represents a fs path
 type Path []string
@@ -164,3 +168,40 @@ func (p Path) Equal(p2 Path) bool {
 	}
 	return true
 }
+
+// pathTemplateVarNames names of the placeholders supported in key prefixes and root paths
+var pathTemplateVarNames = []string{"user", "auth", "bucket"}
+
+var pathTemplatePlaceholderRegexp = regexp.MustCompile(`\{[^{}]*\}`)
+
+// Expand returns a new path with the placeholders (like "{user}") present in its components replaced
+// by the values passed as parameter. Values may not span several components nor refer to parent directories.
+func (p Path) Expand(vars map[string]string) (Path, error) {
+	retval := make(Path, len(p))
+	for i, c := range p {
+		var err error
+		retval[i] = pathTemplatePlaceholderRegexp.ReplaceAllStringFunc(c, func(placeholder string) string {
+			v, ok := vars[placeholder[1:len(placeholder)-1]]
+			if !ok {
+				err = fmt.Errorf("unknown placeholder %s", placeholder)
+			} else if v == "" || v == "." || v == ".." || strings.ContainsRune(v, '/') {
+				err = fmt.Errorf("invalid value for placeholder %s: %q", placeholder, v)
+			}
+			return v
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return retval, nil
+}
+
+// validatePathTemplate checks that a path only contains supported placeholders
+func validatePathTemplate(p Path) error {
+	vars := map[string]string{}
+	for _, name := range pathTemplateVarNames {
+		vars[name] = name
+	}
+	_, err := p.Expand(vars)
+	return err
+}
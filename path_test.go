@@ -28,3 +28,22 @@ func TestSplitIntoPathAbsolute(t *testing.T) {
 	assert.Equal(t, Path{""}, SplitIntoPathAsAbs("//"))
 	assert.Equal(t, Path{"", "abc", "bcd"}, SplitIntoPathAsAbs("//abc//bcd"))
 }
+
+func TestPathExpand(t *testing.T) {
+	vars := map[string]string{"user": "user1", "auth": "test"}
+	p, err := SplitIntoPath("tenants/{auth}-{user}/{user}").Expand(vars)
+	assert.NoError(t, err)
+	assert.Equal(t, Path{"tenants", "test-user1", "user1"}, p)
+	p, err = SplitIntoPath("/fixed").Expand(vars)
+	assert.NoError(t, err)
+	assert.Equal(t, Path{"", "fixed"}, p)
+
+	_, err = SplitIntoPath("tenants/{bucket}").Expand(vars)
+	assert.Error(t, err)
+	for _, user := range []string{"", ".", "..", "../user2", "a/b"} {
+		_, err = SplitIntoPath("tenants/{user}").Expand(map[string]string{"user": user})
+		assert.Error(t, err, user)
+	}
+	assert.NoError(t, validatePathTemplate(SplitIntoPath("{bucket}/{auth}/{user}")))
+	assert.Error(t, validatePathTemplate(SplitIntoPath("{users}")))
+}
@@ -17,7 +17,11 @@ type PhantomObjectInfo struct {
 func (info *PhantomObjectInfo) GetOne() PhantomObjectInfo {
 	info.Mtx.Lock()
 	defer info.Mtx.Unlock()
-	return *info
+	return PhantomObjectInfo{
+		Key:          info.Key,
+		LastModified: info.LastModified,
+		Size:         info.Size,
+	}
 }
 
 func (info *PhantomObjectInfo) setKey(v Path) {
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	aws "github.com/aws/aws-sdk-go/aws"
+	aws_s3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var readAheadBufferPoolMetrics = memoryBufferPoolMetrics{
+	Max:  mReadAheadBuffersMax,
+	Used: mReadAheadBuffersUsed,
+}
+
+// ReadAhead read-ahead settings of downloads. Each download fetches up to Chunks upcoming ranges of ChunkSize bytes
+// concurrently, into buffers taken from a pool shared by all of them, so that the memory used for read-ahead
+// never exceeds the budget given. Downloads fall back to streaming when there are no buffers left.
+type ReadAhead struct {
+	Chunks    int
+	ChunkSize int
+	Pool      *MemoryBufferPool
+}
+
+// NewReadAhead creates read-ahead settings along with their pool of buffers
+func NewReadAhead(ctx context.Context, chunks int, chunkSize int, memoryBudget int) *ReadAhead {
+	return &ReadAhead{
+		Chunks:    chunks,
+		ChunkSize: chunkSize,
+		Pool:      newMemoryBufferPool(ctx, chunkSize, memoryBudget/chunkSize, 0, readAheadBufferPoolMetrics),
+	}
+}
+
+// readAheadChunk range of an object fetched ahead of the client
+type readAheadChunk struct {
+	off  int64
+	buf  []byte
+	n    int
+	err  error
+	done chan struct{}
+}
+
+// fetchReadAheadChunk fetches a range of the object through a ranged GetObject. The chunk is done once it returns.
+func (oor *S3GetObjectOutputReader) fetchReadAheadChunk(ctx context.Context, c *readAheadChunk) {
+	defer close(c.done)
+	mReadAheadFetches.Inc()
+	defer mReadAheadFetches.Dec()
+	end := c.off + int64(len(c.buf))
+	if end > oor.size {
+		end = oor.size
+	}
+	goo, err := oor.S3.GetObjectWithContext(
+		ctx,
+		&aws_s3.GetObjectInput{
+			Bucket:               &oor.Bucket,
+			Key:                  &oor.Key,
+			IfMatch:              oor.etag,
+			Range:                aws.String(fmt.Sprintf("bytes=%d-%d", c.off, end-1)),
+			SSECustomerAlgorithm: nilIfEmpty(oor.ServerSideEncryption.CustomerAlgorithm()),
+			SSECustomerKey:       nilIfEmpty(oor.ServerSideEncryption.CustomerKey),
+			SSECustomerKeyMD5:    nilIfEmpty(oor.ServerSideEncryption.CustomerKeyMD5),
+		},
+	)
+	if err != nil {
+		c.err = err
+		return
+	}
+	defer goo.Body.Close()
+	c.n, c.err = io.ReadFull(goo.Body, c.buf[:end-c.off])
+}
+
+// releaseReadAheadChunk forgets a chunk, whose buffer goes back to the pool once it's done
+func (oor *S3GetObjectOutputReader) releaseReadAheadChunk(i int64) {
+	c := oor.readAheadChunks[i]
+	delete(oor.readAheadChunks, i)
+	go func() {
+		<-c.done
+		oor.ReadAhead.Pool.Put(c.buf)
+	}()
+}
+
+// releaseReadAhead stops fetching ahead and releases all the chunks
+func (oor *S3GetObjectOutputReader) releaseReadAhead() {
+	if oor.cancelReadAhead != nil {
+		oor.cancelReadAhead()
+	}
+	for i := range oor.readAheadChunks {
+		oor.releaseReadAheadChunk(i)
+	}
+}
+
+// readAhead reads data present on offset from the chunks fetched ahead, scheduling the upcoming ones. It returns
+// false when the data isn't there, so that it is read from the stream instead.
+func (oor *S3GetObjectOutputReader) readAhead(buf []byte, off int64) (int, bool, error) {
+	ra := oor.ReadAhead
+	if ra == nil || oor.size <= int64(ra.ChunkSize) || off >= oor.size {
+		return 0, false, nil
+	}
+	chunkSize := int64(ra.ChunkSize)
+	first := off / chunkSize
+	last := first + int64(ra.Chunks)
+	if oor.readAheadChunks == nil {
+		oor.readAheadChunks = map[int64]*readAheadChunk{}
+		var ctx context.Context
+		ctx, oor.cancelReadAhead = context.WithCancel(oor.Ctx)
+		oor.readAheadCtx = ctx
+		if oor.spoolOffset == 0 && len(oor.spooled) == 0 {
+			// nothing has been read from the stream opened first, which is reopened if ever needed
+			oor.closeStream()
+		}
+	}
+
+	// the chunks behind the lookback buffer and the ones far ahead are not going to be read soon
+	for i := range oor.readAheadChunks {
+		if (i < first && (i+1)*chunkSize <= off-int64(oor.Lookback)) || i >= last {
+			oor.releaseReadAheadChunk(i)
+		}
+	}
+	for i := first; i < last && i*chunkSize < oor.size; i++ {
+		if _, ok := oor.readAheadChunks[i]; ok {
+			continue
+		}
+		b := ra.Pool.TryGet()
+		if b == nil {
+			// the memory budget is exhausted
+			break
+		}
+		c := &readAheadChunk{off: i * chunkSize, buf: b, done: make(chan struct{})}
+		oor.readAheadChunks[i] = c
+		go oor.fetchReadAheadChunk(oor.readAheadCtx, c)
+	}
+
+	result := "hit"
+	i := 0
+	for i < len(buf) && off < oor.size {
+		c, ok := oor.readAheadChunks[off/chunkSize]
+		if !ok {
+			if i == 0 {
+				result = "miss"
+			}
+			break
+		}
+		select {
+		case <-c.done:
+		default:
+			if i == 0 {
+				result = "wait"
+			}
+			select {
+			case <-c.done:
+			case <-oor.Ctx.Done():
+				oor.Log.Debug("Read operation canceled")
+				return 0, true, fmt.Errorf("read operation canceled")
+			}
+		}
+		if c.err != nil && !IsEOF(c.err) {
+			oor.Log.WithField("exception", c.err).Warn("Error reading ahead")
+			oor.releaseReadAheadChunk(off / chunkSize)
+			if i == 0 {
+				result = "miss"
+			}
+			break
+		}
+		o := int(off - c.off)
+		if o >= c.n {
+			break
+		}
+		n := copy(buf[i:], c.buf[o:c.n])
+		i += n
+		off += int64(n)
+	}
+	mReadAheadReads.With(prometheus.Labels{"result": result}).Inc()
+	if i == 0 {
+		return 0, false, nil
+	}
+	mReadsBytesTotal.Add(float64(i))
+	return i, true, nil
+}
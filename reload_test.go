@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	fake_log "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+const reloadTestConfig = `
+host_key_file = "./host_key"
+
+[buckets.test]
+bucket = "test"
+region = "ap-northeast-1"
+auth = "test"
+
+[auth.test]
+type = "inplace"
+
+[auth.test.users.user01]
+password = "test"
+`
+
+func TestReloadBuckets(t *testing.T) {
+	log, _ := fake_log.NewNullLogger()
+	dir, err := ioutil.TempDir("", "s3-sftp-proxy")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "s3-sftp-proxy.toml")
+
+	assert.NoError(t, ioutil.WriteFile(configFile, []byte(reloadTestConfig), 0600))
+	s3Buckets, err := reloadBuckets(configFile, nil, log)
+	assert.NoError(t, err)
+	buckets := NewReloadableS3Buckets(s3Buckets)
+	old := buckets.Load()
+	_, u := old.LookupUser("user01")
+	assert.NotNil(t, u)
+
+	assert.NoError(t, ioutil.WriteFile(configFile, []byte(reloadTestConfig+`
+[auth.test.users.user02]
+password = "test"
+`), 0600))
+	s3Buckets, err = reloadBuckets(configFile, buckets.Load(), log)
+	assert.NoError(t, err)
+	buckets.Store(s3Buckets)
+	_, u = buckets.Load().LookupUser("user02")
+	assert.NotNil(t, u)
+	// the buckets loaded before are left as they are
+	_, u = old.LookupUser("user02")
+	assert.Nil(t, u)
+
+	assert.NoError(t, ioutil.WriteFile(configFile, []byte(reloadTestConfig+`
+[auth.test.users.user03]
+password = "test"
+authentication_method = "unknown"
+`), 0600))
+	_, err = reloadBuckets(configFile, buckets.Load(), log)
+	assert.Error(t, err)
+}
+
+func TestReloadBucketsKeepsTOTPSteps(t *testing.T) {
+	log, _ := fake_log.NewNullLogger()
+	dir, err := ioutil.TempDir("", "s3-sftp-proxy")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "s3-sftp-proxy.toml")
+
+	config := reloadTestConfig + `totp_secret = "` + testTOTPSecret + `"
+`
+	assert.NoError(t, ioutil.WriteFile(configFile, []byte(config), 0600))
+	old, err := reloadBuckets(configFile, nil, log)
+	assert.NoError(t, err)
+	bucket, u := old.LookupUser("user01")
+	now := time.Now()
+	code := u.GetTOTP().code(now.Unix() / 30)
+	assert.True(t, bucket.Users.ValidateTOTP(u, code, now))
+
+	// codes accepted before a reload may not be replayed after it
+	s3Buckets, err := reloadBuckets(configFile, old, log)
+	assert.NoError(t, err)
+	bucket, u = s3Buckets.LookupUser("user01")
+	assert.False(t, bucket.Users.ValidateTOTP(u, code, now))
+}
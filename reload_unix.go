@@ -0,0 +1,11 @@
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// reloadSignals signals that trigger a reload of the configuration
+var reloadSignals = []os.Signal{syscall.SIGHUP}
@@ -0,0 +1,10 @@
+// +build windows
+
+package main
+
+import (
+	"os"
+)
+
+// reloadSignals signals that trigger a reload of the configuration. There is no such signal on Windows.
+var reloadSignals = []os.Signal{}
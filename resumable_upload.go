@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// resumableUploadAbortTimeout time given to abort each of the uploads still kept when the server stops
+const resumableUploadAbortTimeout = 30 * time.Second
+
+// ResumableUploads multipart uploads interrupted by their client going away, kept for a while so that they are
+// continued when the client opens the same file again without truncating it. They are only kept in memory, so
+// they can't be resumed once the server is restarted: Close aborts them when the server stops.
+type ResumableUploads struct {
+	Ctx     context.Context
+	Timeout time.Duration
+	mtx     sync.Mutex
+	// uploads is nil once closed
+	uploads map[string]*suspendedUpload
+}
+
+// suspendedUpload interrupted upload waiting to be resumed
+type suspendedUpload struct {
+	u     *S3MultipartUploadWriter
+	timer *time.Timer
+}
+
+// NewResumableUploads creates a new registry of interrupted uploads, which are aborted after the timeout given
+func NewResumableUploads(ctx context.Context, timeout time.Duration) *ResumableUploads {
+	return &ResumableUploads{
+		Ctx:     ctx,
+		Timeout: timeout,
+		uploads: map[string]*suspendedUpload{},
+	}
+}
+
+// resumableUploadKey identifies an upload by the user who started it as well as by the object, so that it's
+// never continued by anyone else
+func resumableUploadKey(bucket string, user string, key Path) string {
+	return user + "@" + bucket + "/" + key.String()
+}
+
+// Suspend keeps an interrupted upload until it's resumed or it expires. An upload suspended earlier on the same
+// key by the same user is aborted.
+func (ru *ResumableUploads) Suspend(u *S3MultipartUploadWriter) {
+	k := resumableUploadKey(u.Bucket, u.User, u.Info.GetOne().Key)
+	// the session of the upload is over
+	u.Ctx = ru.Ctx
+	su := &suspendedUpload{u: u}
+	ru.mtx.Lock()
+	if ru.uploads == nil {
+		ru.mtx.Unlock()
+		u.Log.Info("Upload interrupted while the server is stopping, aborting it")
+		abortSuspendedUpload(u)
+		u.PhantomObjectMap.RemoveByInfoPtr(u.Info)
+		return
+	}
+	prev := ru.uploads[k]
+	ru.uploads[k] = su
+	su.timer = time.AfterFunc(ru.Timeout, func() { ru.expire(k, su) })
+	ru.mtx.Unlock()
+	u.Log.Info("Upload interrupted, kept for the client to resume it")
+	mUploadsSuspended.Inc()
+	if prev != nil {
+		prev.timer.Stop()
+		mUploadsSuspended.Dec()
+		prev.u.discard()
+	}
+}
+
+// Take returns the upload suspended on a key by the user given, which is no longer kept, or nil if there's none
+func (ru *ResumableUploads) Take(bucket string, user string, key Path) *S3MultipartUploadWriter {
+	k := resumableUploadKey(bucket, user, key)
+	ru.mtx.Lock()
+	su := ru.uploads[k]
+	if su == nil {
+		ru.mtx.Unlock()
+		return nil
+	}
+	delete(ru.uploads, k)
+	ru.mtx.Unlock()
+	su.timer.Stop()
+	mUploadsSuspended.Dec()
+	return su.u
+}
+
+func (ru *ResumableUploads) expire(k string, su *suspendedUpload) {
+	ru.mtx.Lock()
+	if ru.uploads[k] != su {
+		// resumed in the meantime
+		ru.mtx.Unlock()
+		return
+	}
+	delete(ru.uploads, k)
+	ru.mtx.Unlock()
+	su.u.Log.Info("Interrupted upload not resumed in time, aborting it")
+	su.u.discard()
+	mUploadsSuspended.Dec()
+	mUploadsResumeExpired.Inc()
+}
+
+// Close aborts all the uploads kept, as well as the ones suspended afterwards
+func (ru *ResumableUploads) Close() {
+	ru.mtx.Lock()
+	uploads := ru.uploads
+	ru.uploads = nil
+	ru.mtx.Unlock()
+	for _, su := range uploads {
+		su.timer.Stop()
+		su.u.Log.Info("Server stopping, aborting interrupted upload")
+		su.u.mtx.Lock()
+		abortSuspendedUpload(su.u)
+		su.u.mtx.Unlock()
+		su.u.PhantomObjectMap.RemoveByInfoPtr(su.u.Info)
+		mUploadsSuspended.Dec()
+	}
+}
+
+// abortSuspendedUpload aborts an upload with a context of its own, as the one of the server is done by then. The
+// caller holds u.mtx.
+func abortSuspendedUpload(u *S3MultipartUploadWriter) {
+	ctx, cancel := context.WithTimeout(context.Background(), resumableUploadAbortTimeout)
+	defer cancel()
+	u.Ctx = ctx
+	u.s3AbortMultipartUpload()
+}
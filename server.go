@@ -13,66 +13,130 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
+// defaultAccountCheckInterval interval the accounts of connected users are checked at by default
+const defaultAccountCheckInterval = time.Minute
+
 // Server SFTP server struct
 type Server struct {
 	*ssh.ServerConfig
-	*S3Buckets
-	*PhantomObjectMap
-	UploadMemoryBufferPool   *MemoryBufferPool
-	ReaderLookbackBufferSize int
-	ReaderMinChunkSize       int
-	ListerLookbackBufferSize int
-	Log                      logrus.FieldLogger
-	Now                      func() time.Time
-	UploadChan               chan<- *S3PartToUpload
+	Buckets *ReloadableS3Buckets
+	S3BucketIOOptions
+	AccountCheckInterval time.Duration
+	Log                  logrus.FieldLogger
+}
+
+// ServerOptions tunables of the server, as per configuration
+type ServerOptions struct {
+	ReaderLookbackBufferSize      int
+	ReaderMinChunkSize            int
+	ReadAheadChunks               int
+	ReadAheadChunkSize            int
+	ReadAheadMemoryBudget         int
+	ListerLookbackBufferSize      int
+	UploadMemoryBufferSize        int
+	UploadMemoryBufferPoolSize    int
+	UploadMemoryBufferPoolTimeout time.Duration
+	UploadMaxPartBuffers          int
+	UploadSpill                   *UploadSpill
+	UploadResumeTimeout           time.Duration
+	// AccountCheckInterval interval the accounts of connected users are checked at, so that sessions of accounts
+	// disabled or removed in the meantime are terminated. Defaults to a minute.
+	AccountCheckInterval time.Duration
 }
 
 // NewServer creates a new sftp server
-func NewServer(ctx context.Context, buckets *S3Buckets, serverConfig *ssh.ServerConfig, logger logrus.FieldLogger, readerLookbackBufferSize int, readerMinChunkSize int, listerLookbackBufferSize int, partSize int, uploadMemoryBufferPoolSize int, uploadMemoryBufferPoolTimeout time.Duration, uploadChan chan<- *S3PartToUpload) *Server {
+func NewServer(ctx context.Context, buckets *ReloadableS3Buckets, serverConfig *ssh.ServerConfig, logger logrus.FieldLogger, opts ServerOptions, uploadChan chan<- *S3PartToUpload) *Server {
+	var readAhead *ReadAhead
+	if opts.ReadAheadChunks > 0 {
+		readAhead = NewReadAhead(ctx, opts.ReadAheadChunks, opts.ReadAheadChunkSize, opts.ReadAheadMemoryBudget)
+	}
+	var resumableUploads *ResumableUploads
+	if opts.UploadResumeTimeout > 0 {
+		resumableUploads = NewResumableUploads(ctx, opts.UploadResumeTimeout)
+	}
+	accountCheckInterval := opts.AccountCheckInterval
+	if accountCheckInterval <= 0 {
+		accountCheckInterval = defaultAccountCheckInterval
+	}
 	return &Server{
-		S3Buckets:                buckets,
-		ServerConfig:             serverConfig,
-		Log:                      logger,
-		ReaderLookbackBufferSize: readerLookbackBufferSize,
-		ReaderMinChunkSize:       readerMinChunkSize,
-		ListerLookbackBufferSize: listerLookbackBufferSize,
-		UploadMemoryBufferPool:   NewMemoryBufferPool(ctx, partSize, uploadMemoryBufferPoolSize, uploadMemoryBufferPoolTimeout),
-		PhantomObjectMap:         NewPhantomObjectMap(),
-		Now:                      time.Now,
-		UploadChan:               uploadChan,
+		Buckets:              buckets,
+		ServerConfig:         serverConfig,
+		AccountCheckInterval: accountCheckInterval,
+		Log:                  logger,
+		S3BucketIOOptions: S3BucketIOOptions{
+			ReaderLookbackBufferSize: opts.ReaderLookbackBufferSize,
+			ReaderMinChunkSize:       opts.ReaderMinChunkSize,
+			ReadAhead:                readAhead,
+			ListerLookbackBufferSize: opts.ListerLookbackBufferSize,
+			UploadMemoryBufferPool:   NewMemoryBufferPool(ctx, opts.UploadMemoryBufferSize, opts.UploadMemoryBufferPoolSize, opts.UploadMemoryBufferPoolTimeout),
+			UploadMaxPartBuffers:     opts.UploadMaxPartBuffers,
+			UploadSpill:              opts.UploadSpill,
+			ResumableUploads:         resumableUploads,
+			PhantomObjectMap:         NewPhantomObjectMap(),
+			Now:                      time.Now,
+			UploadChan:               uploadChan,
+		},
+	}
+}
+
+func asHandlers(handlers fileHandlers, log logrus.FieldLogger) sftp.Handlers {
+	sh := &statusHandlers{handlers: handlers, Log: log}
+	return sftp.Handlers{FileGet: sh, FilePut: sh, FileCmd: sh, FileList: sh}
+}
+
+func (s *Server) newS3BucketIO(ctx context.Context, bucket *S3Bucket, userInfo *UserInfo, sessionEnded <-chan struct{}, log logrus.FieldLogger) (*S3BucketIO, error) {
+	s3io, err := NewS3BucketIO(ctx, bucket, userInfo, s.S3BucketIOOptions, log)
+	if err != nil {
+		return nil, err
 	}
+	s3io.SessionEnded = sessionEnded
+	return s3io, nil
 }
 
-func asHandlers(handlers interface {
-	sftp.FileReader
-	sftp.FileWriter
-	sftp.FileCmder
-	sftp.FileLister
-}) sftp.Handlers {
-	return sftp.Handlers{FileGet: handlers, FilePut: handlers, FileCmd: handlers, FileList: handlers}
+// sessionChannel channel of an sftp session, whose end is known before the server closes the files left open
+type sessionChannel struct {
+	ssh.Channel
+	once  sync.Once
+	ended chan struct{}
 }
 
-// HandleChannel handles an sftp channel
-func (s *Server) HandleChannel(ctx context.Context, bucket *S3Bucket, sshCh ssh.Channel, reqs <-chan *ssh.Request, userInfo *UserInfo, log logrus.FieldLogger) {
+// Read reads data from the channel, noting the end of the session on errors
+func (ch *sessionChannel) Read(p []byte) (int, error) {
+	n, err := ch.Channel.Read(p)
+	if err != nil {
+		ch.once.Do(func() { close(ch.ended) })
+	}
+	return n, err
+}
+
+// HandleChannel handles an sftp channel. When several buckets are given, each one of them is mounted
+// on a top-level directory named after its bucket config.
+func (s *Server) HandleChannel(ctx context.Context, buckets []*S3Bucket, sshCh ssh.Channel, reqs <-chan *ssh.Request, userInfo *UserInfo, log logrus.FieldLogger) {
 	defer s.Log.Debug("HandleChannel ended")
-	server := sftp.NewRequestServer(
-		sshCh,
-		asHandlers(
-			NewS3BucketIO(
-				ctx,
-				bucket,
-				s.ReaderLookbackBufferSize,
-				s.ReaderMinChunkSize,
-				s.ListerLookbackBufferSize,
-				s.UploadMemoryBufferPool,
-				log,
-				s.PhantomObjectMap,
-				s.Now,
-				userInfo,
-				s.UploadChan,
-			),
-		),
-	)
+	ch := &sessionChannel{Channel: sshCh, ended: make(chan struct{})}
+	var handlers sftp.Handlers
+	if len(buckets) == 1 {
+		s3io, err := s.newS3BucketIO(ctx, buckets[0], userInfo, ch.ended, log)
+		if err != nil {
+			log.WithField("exception", err).Error("Could not set up user root")
+			sshCh.Close()
+			return
+		}
+		handlers = asHandlers(s3io, log)
+	} else {
+		mounts := make([]*S3BucketIO, len(buckets))
+		for i, bucket := range buckets {
+			s3io, err := s.newS3BucketIO(ctx, bucket, userInfo, ch.ended, log.WithField("mount", bucket.Name))
+			if err != nil {
+				log.WithField("exception", err).Errorf("Could not set up user root on %s", bucket.Name)
+				sshCh.Close()
+				return
+			}
+			mounts[i] = s3io
+		}
+		handlers = asHandlers(NewVirtualRootIO(mounts, log), log)
+	}
+	server := sftp.NewRequestServer(ch, handlers)
 
 	innerCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
@@ -143,21 +207,50 @@ func (s *Server) HandleClient(ctx context.Context, conn *net.TCPConn) error {
 	log = log.WithField("user", sconn.User())
 	log.Info("User logged in")
 	mUsersConnected.Inc()
-	bucket, ok := s.UserToBucketMap[sconn.User()]
-	if !ok {
+	userInfo := &UserInfo{
+		Addr: conn.RemoteAddr(),
+		User: sconn.User(),
+	}
+	var ext map[string]string
+	if sconn.Permissions != nil {
+		ext = sconn.Permissions.Extensions
+	}
+	// the session keeps the buckets it starts with even if the configuration is reloaded in the meantime
+	s3Buckets := s.Buckets.Load()
+	var buckets []*S3Bucket
+	if ext["bucket"] != "" {
+		// remote users get their bucket and root path from the authentication callbacks
+		if bucket := s3Buckets.Get(ext["bucket"]); bucket != nil {
+			buckets = []*S3Bucket{bucket}
+		}
+		userInfo.RootPath = ext["root-path"]
+	} else {
+		var u User
+		buckets, u = s3Buckets.LookupUserBuckets(sconn.User())
+		if u != nil {
+			userInfo.RootPath = u.GetRootPath()
+			userInfo.PermsOverride = u.GetPermsOverride()
+			userInfo.ACL = u.GetACL()
+		}
+	}
+	if len(buckets) == 0 {
 		log.Error("No bucket designated to user")
 		return fmt.Errorf("unknown error: no bucket designated to user %s found", sconn.User())
 	}
-	u := bucket.Users.Lookup(sconn.User())
-
-	userInfo := &UserInfo{
-		Addr:     conn.RemoteAddr(),
-		User:     sconn.User(),
-		RootPath: u.GetRootPath(),
-	}
+	// permissions may be further restricted by the authentication callbacks
+	userInfo.PermsOverride = userInfo.PermsOverride.Merge(ParsePermsOverride(ext["perms-override"]))
 
 	wg := sync.WaitGroup{}
 
+	if ext["bucket"] == "" {
+		// sessions may not outlive the account; accounts of remote users are left to the external service
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.watchAccount(innerCtx, sconn.User(), cancel, log)
+		}()
+	}
+
 	wg.Add(1)
 	go func(reqs <-chan *ssh.Request) {
 		defer wg.Done()
@@ -188,7 +281,7 @@ func (s *Server) HandleClient(ctx context.Context, conn *net.TCPConn) error {
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
-				s.HandleChannel(innerCtx, bucket, sshCh, reqs, userInfo, log)
+				s.HandleChannel(innerCtx, buckets, sshCh, reqs, userInfo, log)
 			}()
 		}
 	}(chans)
@@ -197,6 +290,39 @@ func (s *Server) HandleClient(ctx context.Context, conn *net.TCPConn) error {
 	return nil
 }
 
+// watchAccount terminates the session of a user as soon as the account may no longer be used, as per the users
+// currently loaded. The account is checked when it expires and every AccountCheckInterval, so that accounts
+// disabled, removed or expiring earlier once the users are reloaded are caught as well.
+func (s *Server) watchAccount(ctx context.Context, user string, cancel func(), log logrus.FieldLogger) {
+	for {
+		wait := s.AccountCheckInterval
+		_, u := s.Buckets.Load().LookupUser(user)
+		var err error
+		if u == nil {
+			err = fmt.Errorf("unknown user: %s", user)
+		} else {
+			policy := u.GetAccountPolicy()
+			now := s.Now()
+			err = policy.CheckSession(now)
+			if err == nil && !policy.ExpiresAt.IsZero() && policy.ExpiresAt.Sub(now) < wait {
+				wait = policy.ExpiresAt.Sub(now)
+			}
+		}
+		if err != nil {
+			log.WithField("exception", err).Warn("Account may no longer be used, terminating session")
+			cancel()
+			return
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
 // RunListenerEventLoop runs the listener event loop, which waits for incoming TCP connections
 func (s *Server) RunListenerEventLoop(ctx context.Context, lsnr *net.TCPListener) error {
 	defer s.Log.Debug("RunListenerEventLoop ended")
@@ -250,6 +376,11 @@ outer:
 
 	wg.Wait()
 
+	// sessions are over, so interrupted uploads can't be resumed anymore
+	if s.ResumableUploads != nil {
+		s.ResumableUploads.Close()
+	}
+
 	if IsTimeout(err) {
 		err = nil
 	}
@@ -0,0 +1,730 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	fake_log "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+const testServerConfig = `
+%s
+host_key_file = "%s"
+upload_memory_buffer_size = 1024
+
+[buckets.test]
+bucket = "test"
+key_prefix = "prefix"
+endpoint = "%s"
+s3_force_path_style = true
+disable_ssl = true
+region = "us-east-1"
+auth = "test"
+
+[buckets.test.credentials]
+aws_access_key_id = "test"
+aws_secret_access_key = "test"
+
+[auth.test]
+type = "inplace"
+
+[auth.test.users.writer]
+password = "test"
+
+[auth.test.users.other]
+password = "test"
+
+[auth.test.users.reader]
+password = "test"
+writable = false
+deletable = false
+
+[auth.test.users.jailed]
+password = "test"
+root_path = "users/{user}"
+`
+
+// testServer SFTP server listening on a local port, backed by a fake S3
+type testServer struct {
+	Addr    string
+	S3      *fakeS3
+	Buckets *ReloadableS3Buckets
+	close   func()
+}
+
+func writeTestHostKey(t *testing.T, dir string) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	der, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	hostKeyFile := filepath.Join(dir, "host_key")
+	assert.NoError(t, ioutil.WriteFile(hostKeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600))
+	return hostKeyFile
+}
+
+func startTestServer(t *testing.T) *testServer {
+	return startTestServerWithConfig(t, "")
+}
+
+// startTestServerWithConfig starts a test server with additional top level settings
+func startTestServerWithConfig(t *testing.T, extraConfig string) *testServer {
+	log, _ := fake_log.NewNullLogger()
+	dir, err := ioutil.TempDir("", "s3-sftp-proxy")
+	assert.NoError(t, err)
+	s3 := newFakeS3("test")
+	s3Server := httptest.NewServer(s3)
+
+	configFile := filepath.Join(dir, "s3-sftp-proxy.toml")
+	assert.NoError(t, ioutil.WriteFile(configFile, []byte(fmt.Sprintf(testServerConfig, extraConfig, writeTestHostKey(t, dir), s3Server.URL)), 0600))
+	cfg, err := ReadConfigFromFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s3Buckets, err := reloadBuckets(configFile, nil, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buckets := NewReloadableS3Buckets(s3Buckets)
+	sCfg, err := buildSSHServerConfig(buckets, cfg, nil, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	uploadWorkers := NewS3UploadWorkers(ctx, *cfg.UploadWorkersCount, log)
+	uploadChan := uploadWorkers.Start()
+	errChan := make(chan error)
+	go func() {
+		errChan <- NewServer(
+			ctx,
+			buckets,
+			sCfg,
+			log,
+			ServerOptions{
+				ReaderLookbackBufferSize:      *cfg.ReaderLookbackBufferSize,
+				ReaderMinChunkSize:            *cfg.ReaderMinChunkSize,
+				ReadAheadChunks:               *cfg.ReadAheadChunks,
+				ReadAheadChunkSize:            *cfg.ReadAheadChunkSize,
+				ReadAheadMemoryBudget:         *cfg.ReadAheadMemoryBudget,
+				ListerLookbackBufferSize:      *cfg.ListerLookbackBufferSize,
+				UploadMemoryBufferSize:        *cfg.UploadMemoryBufferSize,
+				UploadMemoryBufferPoolSize:    *cfg.UploadMemoryBufferPoolSize,
+				UploadMemoryBufferPoolTimeout: (*cfg.UploadMemoryBufferPoolTimeout).Duration,
+				UploadMaxPartBuffers:          *cfg.UploadMaxPartBuffers,
+				UploadResumeTimeout:           (*cfg.UploadResumeTimeout).Duration,
+				AccountCheckInterval:          50 * time.Millisecond,
+			},
+			uploadChan,
+		).RunListenerEventLoop(ctx, lsnr.(*net.TCPListener))
+	}()
+	return &testServer{
+		Addr:    lsnr.Addr().String(),
+		S3:      s3,
+		Buckets: buckets,
+		close: func() {
+			cancel()
+			assert.NoError(t, <-errChan)
+			uploadWorkers.WaitForCompletion()
+			lsnr.Close()
+			s3Server.Close()
+			os.RemoveAll(dir)
+		},
+	}
+}
+
+// Dial logs into the server through SFTP
+func (ts *testServer) Dial(t *testing.T, user string, password string) (*sftp.Client, error) {
+	conn, err := ssh.Dial("tcp", ts.Addr, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.Password(password)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+func (ts *testServer) MustDial(t *testing.T, user string) *sftp.Client {
+	client, err := ts.Dial(t, user, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func sftpPut(client *sftp.Client, path string, data []byte) error {
+	f, err := client.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, bytes.NewReader(data)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func sftpGet(client *sftp.Client, path string) ([]byte, error) {
+	f, err := client.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+func sftpReadDirNames(t *testing.T, client *sftp.Client, path string) []string {
+	fis, err := client.ReadDir(path)
+	assert.NoError(t, err)
+	names := []string{}
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestServerLogin(t *testing.T) {
+	ts := startTestServer(t)
+	defer ts.close()
+
+	_, err := ts.Dial(t, "writer", "wrong")
+	assert.Error(t, err)
+	_, err = ts.Dial(t, "nobody", "test")
+	assert.Error(t, err)
+	client := ts.MustDial(t, "writer")
+	assert.NoError(t, client.Close())
+}
+
+func TestServerAccountDisabledWhileConnected(t *testing.T) {
+	ts := startTestServer(t)
+	defer ts.close()
+
+	writer := ts.MustDial(t, "writer")
+	defer writer.Close()
+	reader := ts.MustDial(t, "reader")
+	defer reader.Close()
+	_, err := writer.Stat("/")
+	assert.NoError(t, err)
+
+	// the users are reloaded with the writer disabled
+	bucket := ts.Buckets.Load().Get("test")
+	users, err := buildUsersFromAuthUsers(nil, map[string]AuthUser{
+		"writer": AuthUser{Password: "test", Disabled: true},
+		"reader": AuthUser{Password: "test"},
+	})
+	assert.NoError(t, err)
+	bucket.Users.setUsers(users)
+
+	for i := 0; i < 100 && err == nil; i++ {
+		time.Sleep(20 * time.Millisecond)
+		_, err = writer.Stat("/")
+	}
+	assert.Error(t, err)
+	_, err = reader.Stat("/")
+	assert.NoError(t, err)
+}
+
+func TestServerUploadDownload(t *testing.T) {
+	ts := startTestServer(t)
+	defer ts.close()
+	client := ts.MustDial(t, "writer")
+	defer client.Close()
+
+	// fits in one part, so it's put at once
+	assert.NoError(t, sftpPut(client, "/small.txt", []byte("hello")))
+	assert.Equal(t, []byte("hello"), ts.S3.Get("prefix/small.txt"))
+
+	// spans several parts, so it's uploaded through a multipart upload
+	large := make([]byte, 10000)
+	rand.Read(large)
+	assert.NoError(t, sftpPut(client, "/large.bin", large))
+	assert.Equal(t, large, ts.S3.Get("prefix/large.bin"))
+
+	data, err := sftpGet(client, "/small.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), data)
+	data, err = sftpGet(client, "/large.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, large, data)
+
+	_, err = sftpGet(client, "/missing")
+	assert.Error(t, err)
+}
+
+func TestServerRandomAccessDownload(t *testing.T) {
+	ts := startTestServer(t)
+	defer ts.close()
+	// larger than the lookback buffer, so that reads behind it need a new request
+	large := make([]byte, 4*minReaderLookbackBufferSize)
+	rand.Read(large)
+	ts.S3.Put("prefix/large.bin", large)
+	client := ts.MustDial(t, "reader")
+	defer client.Close()
+
+	f, err := client.Open("/large.bin")
+	assert.NoError(t, err)
+	defer f.Close()
+	readAt := func(buf []byte, off int) (int, error) {
+		_, err := f.Seek(int64(off), io.SeekStart)
+		assert.NoError(t, err)
+		return io.ReadFull(f, buf)
+	}
+	buf := make([]byte, 1000)
+	for _, off := range []int{len(large) - 1000, 0, len(large) / 2, 10, len(large) - 3000} {
+		n, err := readAt(buf, off)
+		assert.NoError(t, err, off)
+		assert.Equal(t, large[off:off+1000], buf[:n], off)
+	}
+	n, err := readAt(buf, len(large)-500)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.Equal(t, large[len(large)-500:], buf[:n])
+
+	// resuming a download
+	_, err = f.Seek(int64(len(large)/3), io.SeekStart)
+	assert.NoError(t, err)
+	rest, err := ioutil.ReadAll(f)
+	assert.NoError(t, err)
+	assert.Equal(t, large[len(large)/3:], rest)
+
+	// the object is replaced in the middle of the download
+	ts.S3.Put("prefix/large.bin", make([]byte, len(large)))
+	_, err = readAt(buf, 0)
+	assert.Error(t, err)
+}
+
+func TestServerReadAhead(t *testing.T) {
+	ts := startTestServerWithConfig(t, `
+read_ahead_chunks = 2
+read_ahead_chunk_size = 262144
+read_ahead_memory_budget = 786432
+`)
+	defer ts.close()
+	large := make([]byte, 4*minReaderLookbackBufferSize+1000)
+	rand.Read(large)
+	ts.S3.Put("prefix/large.bin", large)
+	client := ts.MustDial(t, "reader")
+	defer client.Close()
+
+	hits := testutil.ToFloat64(mReadAheadReads.With(prometheus.Labels{"result": "hit"})) +
+		testutil.ToFloat64(mReadAheadReads.With(prometheus.Labels{"result": "wait"}))
+	data, err := sftpGet(client, "/large.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, large, data)
+	assert.True(t, testutil.ToFloat64(mReadAheadReads.With(prometheus.Labels{"result": "hit"}))+
+		testutil.ToFloat64(mReadAheadReads.With(prometheus.Labels{"result": "wait"})) > hits)
+
+	// two downloads at once take more buffers than the budget allows, so some of their reads are streamed
+	f1, err := client.Open("/large.bin")
+	assert.NoError(t, err)
+	f2, err := client.Open("/large.bin")
+	assert.NoError(t, err)
+	for _, f := range []*sftp.File{f1, f2} {
+		_, err := f.Seek(int64(len(large)/2), io.SeekStart)
+		assert.NoError(t, err)
+		rest, err := ioutil.ReadAll(f)
+		assert.NoError(t, err)
+		assert.Equal(t, large[len(large)/2:], rest)
+	}
+	f1.Close()
+	f2.Close()
+
+	// buffers go back to the pool once downloads are closed
+	for i := 0; i < 100 && testutil.ToFloat64(mReadAheadBuffersUsed) > 0; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.Equal(t, 0.0, testutil.ToFloat64(mReadAheadBuffersUsed))
+}
+
+// interruptTestUpload uploads the beginning of data then drops the connection without closing the file
+func interruptTestUpload(t *testing.T, ts *testServer, path string, data []byte) {
+	client := ts.MustDial(t, "writer")
+	f, err := client.Create(path)
+	assert.NoError(t, err)
+	_, err = f.Write(data)
+	assert.NoError(t, err)
+	client.Close()
+}
+
+// uploadCounts returns the number of multipart uploads created and the number of those still pending
+func (f *fakeS3) uploadCounts() (int, int) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.nextUploadID, len(f.uploads)
+}
+
+func TestServerResumableUpload(t *testing.T) {
+	ts := startTestServerWithConfig(t, `upload_resume_timeout = "1m"`)
+	defer ts.close()
+	large := make([]byte, 5000)
+	rand.Read(large)
+	interruptTestUpload(t, ts, "/large.bin", large[:3500])
+
+	client := ts.MustDial(t, "writer")
+	defer client.Close()
+	// the three parts uploaded are kept, while the data of the one being filled is lost
+	var size int64
+	for i := 0; i < 100 && size != 3072; i++ {
+		time.Sleep(50 * time.Millisecond)
+		if fi, err := client.Stat("/large.bin"); err == nil {
+			size = fi.Size()
+		}
+	}
+	assert.Equal(t, int64(3072), size)
+	assert.Nil(t, ts.S3.Get("prefix/large.bin"))
+
+	f, err := client.OpenFile("/large.bin", os.O_WRONLY|os.O_APPEND)
+	assert.NoError(t, err)
+	_, err = f.Seek(size, io.SeekStart)
+	assert.NoError(t, err)
+	_, err = f.Write(large[size:])
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	assert.Equal(t, large, ts.S3.Get("prefix/large.bin"))
+	created, pending := ts.S3.uploadCounts()
+	assert.Equal(t, 1, created)
+	assert.Equal(t, 0, pending)
+
+	// truncating the file starts over
+	interruptTestUpload(t, ts, "/other.bin", large[:3500])
+	for i := 0; i < 100 && testutil.ToFloat64(mUploadsSuspended) == 0; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.NoError(t, sftpPut(client, "/other.bin", []byte("hello")))
+	assert.Equal(t, []byte("hello"), ts.S3.Get("prefix/other.bin"))
+	created, pending = ts.S3.uploadCounts()
+	assert.Equal(t, 2, created)
+	assert.Equal(t, 0, pending)
+}
+
+func TestServerResumableUploadAbortedOnShutdown(t *testing.T) {
+	ts := startTestServerWithConfig(t, `upload_resume_timeout = "1m"`)
+	large := make([]byte, 3500)
+	rand.Read(large)
+	suspended := testutil.ToFloat64(mUploadsSuspended)
+	interruptTestUpload(t, ts, "/large.bin", large)
+	for i := 0; i < 100 && testutil.ToFloat64(mUploadsSuspended) == suspended; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.Equal(t, suspended+1, testutil.ToFloat64(mUploadsSuspended))
+
+	// interrupted uploads can't be resumed after a restart, so they are aborted
+	ts.close()
+	assert.Equal(t, suspended, testutil.ToFloat64(mUploadsSuspended))
+	_, pending := ts.S3.uploadCounts()
+	assert.Equal(t, 0, pending)
+}
+
+func TestServerResumableUploadRewritten(t *testing.T) {
+	ts := startTestServerWithConfig(t, `upload_resume_timeout = "1m"`)
+	defer ts.close()
+	large := make([]byte, 3500)
+	rand.Read(large)
+	suspended := testutil.ToFloat64(mUploadsSuspended)
+	interruptTestUpload(t, ts, "/large.bin", large)
+	for i := 0; i < 100 && testutil.ToFloat64(mUploadsSuspended) == suspended; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// data already uploaded can't be overwritten, which fails the upload
+	client := ts.MustDial(t, "writer")
+	defer client.Close()
+	f, err := client.OpenFile("/large.bin", os.O_WRONLY|os.O_APPEND)
+	assert.NoError(t, err)
+	_, err = f.Write([]byte("hello"))
+	assert.Error(t, err)
+	f.Close()
+	assert.Nil(t, ts.S3.Get("prefix/large.bin"))
+	_, pending := ts.S3.uploadCounts()
+	assert.Equal(t, 0, pending)
+}
+
+func TestServerResumableUploadOtherUser(t *testing.T) {
+	ts := startTestServerWithConfig(t, `upload_resume_timeout = "1m"`)
+	defer ts.close()
+	large := make([]byte, 3500)
+	rand.Read(large)
+	suspended := testutil.ToFloat64(mUploadsSuspended)
+	interruptTestUpload(t, ts, "/large.bin", large)
+	for i := 0; i < 100 && testutil.ToFloat64(mUploadsSuspended) == suspended; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// another user writing the same file starts a new upload, leaving the interrupted one alone
+	client := ts.MustDial(t, "other")
+	defer client.Close()
+	f, err := client.OpenFile("/large.bin", os.O_WRONLY|os.O_APPEND)
+	assert.NoError(t, err)
+	_, err = f.Write([]byte("hello"))
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	assert.Equal(t, []byte("hello"), ts.S3.Get("prefix/large.bin"))
+	_, pending := ts.S3.uploadCounts()
+	assert.Equal(t, 1, pending)
+	assert.Equal(t, suspended+1, testutil.ToFloat64(mUploadsSuspended))
+}
+
+func TestServerResumableUploadClosedWithoutWrites(t *testing.T) {
+	ts := startTestServerWithConfig(t, `upload_resume_timeout = "1m"`)
+	defer ts.close()
+	large := make([]byte, 3500)
+	rand.Read(large)
+	suspended := testutil.ToFloat64(mUploadsSuspended)
+	interruptTestUpload(t, ts, "/large.bin", large)
+	for i := 0; i < 100 && testutil.ToFloat64(mUploadsSuspended) == suspended; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// the object is made of the parts uploaded so far
+	client := ts.MustDial(t, "writer")
+	defer client.Close()
+	f, err := client.OpenFile("/large.bin", os.O_WRONLY|os.O_APPEND)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	assert.Equal(t, large[:3072], ts.S3.Get("prefix/large.bin"))
+	_, pending := ts.S3.uploadCounts()
+	assert.Equal(t, 0, pending)
+}
+
+func TestServerResumableUploadExpires(t *testing.T) {
+	ts := startTestServerWithConfig(t, `upload_resume_timeout = "100ms"`)
+	defer ts.close()
+	large := make([]byte, 3500)
+	rand.Read(large)
+	expired := testutil.ToFloat64(mUploadsResumeExpired)
+	interruptTestUpload(t, ts, "/large.bin", large)
+
+	for i := 0; i < 100 && testutil.ToFloat64(mUploadsResumeExpired) == expired; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.Equal(t, expired+1, testutil.ToFloat64(mUploadsResumeExpired))
+	_, pending := ts.S3.uploadCounts()
+	assert.Equal(t, 0, pending)
+	client := ts.MustDial(t, "writer")
+	defer client.Close()
+	_, err := client.Stat("/large.bin")
+	assert.Error(t, err)
+}
+
+func TestServerStagedUpload(t *testing.T) {
+	ts := startTestServer(t)
+	defer ts.close()
+	ts.Buckets.Load().Get("test").StagingPrefix = Path{".inflight"}
+	client := ts.MustDial(t, "writer")
+	defer client.Close()
+	checksum := func(data []byte) string {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	}
+
+	assert.NoError(t, sftpPut(client, "/small.txt", []byte("hello")))
+	assert.Equal(t, []byte("hello"), ts.S3.Get("prefix/small.txt"))
+	assert.Equal(t, checksum([]byte("hello")), ts.S3.Metadata("prefix/small.txt")["sha256"])
+
+	// the object shows up once the upload is complete
+	large := make([]byte, 10000)
+	rand.Read(large)
+	f, err := client.Create("/large.bin")
+	assert.NoError(t, err)
+	_, err = f.Write(large[:5000])
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"prefix/small.txt"}, ts.S3.Keys())
+	_, err = f.Write(large[5000:])
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	assert.Equal(t, large, ts.S3.Get("prefix/large.bin"))
+	assert.Equal(t, checksum(large), ts.S3.Metadata("prefix/large.bin")["sha256"])
+
+	// parts filled out of order
+	f, err = client.Create("/unordered.bin")
+	assert.NoError(t, err)
+	_, err = f.Seek(2048, io.SeekStart)
+	assert.NoError(t, err)
+	_, err = f.Write(large[2048:])
+	assert.NoError(t, err)
+	_, err = f.Seek(0, io.SeekStart)
+	assert.NoError(t, err)
+	_, err = f.Write(large[:2048])
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	assert.Equal(t, large, ts.S3.Get("prefix/unordered.bin"))
+	assert.Equal(t, checksum(large), ts.S3.Metadata("prefix/unordered.bin")["sha256"])
+
+	// objects larger than the maximum size of a copy are copied part by part
+	defer func(v int64) { s3CopyPartSize = v }(s3CopyPartSize)
+	s3CopyPartSize = 4096
+	assert.NoError(t, sftpPut(client, "/copied.bin", large))
+	assert.Equal(t, large, ts.S3.Get("prefix/copied.bin"))
+	assert.Equal(t, checksum(large), ts.S3.Metadata("prefix/copied.bin")["sha256"])
+
+	assert.Equal(t, []string{"prefix/copied.bin", "prefix/large.bin", "prefix/small.txt", "prefix/unordered.bin"}, ts.S3.Keys())
+	_, pending := ts.S3.uploadCounts()
+	assert.Equal(t, 0, pending)
+}
+
+func TestServerStatAndList(t *testing.T) {
+	ts := startTestServer(t)
+	defer ts.close()
+	client := ts.MustDial(t, "writer")
+	defer client.Close()
+
+	assert.NoError(t, client.Mkdir("/dir"))
+	assert.Equal(t, []string{}, sftpReadDirNames(t, client, "/dir"))
+	assert.NoError(t, sftpPut(client, "/dir/file", []byte("content")))
+	assert.NoError(t, sftpPut(client, "/top", []byte("top")))
+
+	fi, err := client.Stat("/")
+	assert.NoError(t, err)
+	assert.True(t, fi.IsDir())
+	fi, err = client.Stat("/dir")
+	assert.NoError(t, err)
+	assert.True(t, fi.IsDir())
+	fi, err = client.Stat("/dir/file")
+	assert.NoError(t, err)
+	assert.False(t, fi.IsDir())
+	assert.Equal(t, int64(7), fi.Size())
+	assert.Equal(t, "file", fi.Name())
+	_, err = client.Stat("/missing")
+	assert.True(t, os.IsNotExist(err))
+	_, err = client.Stat("/di")
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Equal(t, []string{"dir", "top"}, sftpReadDirNames(t, client, "/"))
+	assert.Equal(t, []string{"file"}, sftpReadDirNames(t, client, "/dir"))
+}
+
+func TestServerRenameRemove(t *testing.T) {
+	ts := startTestServer(t)
+	defer ts.close()
+	client := ts.MustDial(t, "writer")
+	defer client.Close()
+
+	assert.NoError(t, client.Mkdir("/dir"))
+	assert.NoError(t, sftpPut(client, "/a", []byte("a")))
+	assert.NoError(t, client.Rename("/a", "/dir/b"))
+	assert.Nil(t, ts.S3.Get("prefix/a"))
+	assert.Equal(t, []byte("a"), ts.S3.Get("prefix/dir/b"))
+
+	assert.NoError(t, client.Remove("/dir/b"))
+	assert.NoError(t, client.RemoveDirectory("/dir"))
+	assert.Empty(t, ts.S3.Keys())
+}
+
+func TestServerPermissions(t *testing.T) {
+	ts := startTestServer(t)
+	defer ts.close()
+	ts.S3.Put("prefix/file", []byte("file"))
+	client := ts.MustDial(t, "reader")
+	defer client.Close()
+
+	data, err := sftpGet(client, "/file")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("file"), data)
+	assert.Equal(t, []string{"file"}, sftpReadDirNames(t, client, "/"))
+
+	assert.Error(t, sftpPut(client, "/new", []byte("new")))
+	assert.Error(t, client.Mkdir("/dir"))
+	assert.Error(t, client.Rename("/file", "/renamed"))
+	assert.Error(t, client.Remove("/file"))
+	assert.Equal(t, []string{"prefix/file"}, ts.S3.Keys())
+}
+
+// sftpStatusCode returns the status code of an error reported by the server
+func sftpStatusCode(err error) uint32 {
+	if os.IsNotExist(err) {
+		return uint32(sftp.ErrSshFxNoSuchFile)
+	}
+	if serr, ok := err.(*sftp.StatusError); ok {
+		return serr.Code
+	}
+	return uint32(sftp.ErrSshFxOk)
+}
+
+func TestServerErrorStatuses(t *testing.T) {
+	ts := startTestServer(t)
+	defer ts.close()
+	ts.S3.Put("prefix/file", []byte("file"))
+	ts.S3.Put("prefix/secret/file", []byte("secret"))
+	ts.S3.Deny("prefix/secret")
+	ts.Buckets.Load().Get("test").MaxObjectSize = 10
+	reader := ts.MustDial(t, "reader")
+	defer reader.Close()
+	writer := ts.MustDial(t, "writer")
+	defer writer.Close()
+
+	_, err := sftpGet(reader, "/missing")
+	assert.Equal(t, uint32(sftp.ErrSshFxNoSuchFile), sftpStatusCode(err))
+
+	err = sftpPut(reader, "/new", []byte("new"))
+	assert.Equal(t, uint32(sftp.ErrSshFxPermissionDenied), sftpStatusCode(err))
+	err = reader.Remove("/file")
+	assert.Equal(t, uint32(sftp.ErrSshFxPermissionDenied), sftpStatusCode(err))
+
+	_, err = sftpGet(writer, "/secret/file")
+	assert.Equal(t, uint32(sftp.ErrSshFxPermissionDenied), sftpStatusCode(err))
+	_, err = writer.Stat("/secret/file")
+	assert.Equal(t, uint32(sftp.ErrSshFxPermissionDenied), sftpStatusCode(err))
+
+	err = sftpPut(writer, "/large", []byte("more than ten bytes"))
+	assert.Equal(t, uint32(sftp.ErrSshFxFailure), sftpStatusCode(err))
+	assert.Contains(t, err.Error(), syscall.EDQUOT.Error())
+	assert.Nil(t, ts.S3.Get("prefix/large"))
+
+	assert.True(t, testutil.ToFloat64(mErrors.With(prometheus.Labels{"method": "Put", "kind": errorKindQuotaExceeded})) > 0)
+}
+
+func TestServerChroot(t *testing.T) {
+	ts := startTestServer(t)
+	defer ts.close()
+	ts.S3.Put("prefix/secret", []byte("secret"))
+	ts.S3.Put("prefix/users/other/secret", []byte("secret"))
+	client := ts.MustDial(t, "jailed")
+	defer client.Close()
+
+	assert.NoError(t, sftpPut(client, "/../../escape", []byte("escape")))
+	assert.NoError(t, sftpPut(client, "../other/escape", []byte("escape")))
+	assert.Equal(t, []string{"prefix/secret", "prefix/users/jailed/escape", "prefix/users/jailed/other/escape", "prefix/users/other/secret"}, ts.S3.Keys())
+
+	for _, path := range []string{"/../secret", "../../secret", "/../other/secret", "/./../../prefix/secret"} {
+		_, err := sftpGet(client, path)
+		assert.Error(t, err, path)
+		_, err = client.Stat(path)
+		assert.True(t, os.IsNotExist(err), path)
+	}
+	assert.Equal(t, []string{"escape", "other"}, sftpReadDirNames(t, client, "/.."))
+	assert.NoError(t, client.Rename("/escape", "/../../../renamed"))
+	assert.Equal(t, []byte("escape"), ts.S3.Get("prefix/users/jailed/renamed"))
+}
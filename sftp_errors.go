@@ -0,0 +1,191 @@
+package main
+
+import (
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// Kinds errors reported to clients are classified in
+const (
+	errorKindNotFound         = "not_found"
+	errorKindPermissionDenied = "permission_denied"
+	errorKindQuotaExceeded    = "quota_exceeded"
+	errorKindFailure          = "failure"
+)
+
+// errnoKinds kinds of the errnos errors are reported to clients with. pkg/sftp turns ENOENT and EPERM into their
+// own status codes; SFTP v3 has no status code for exceeded quotas, so they are reported as failures whose
+// message tells them apart.
+var errnoKinds = map[syscall.Errno]string{
+	syscall.ENOENT: errorKindNotFound,
+	syscall.EPERM:  errorKindPermissionDenied,
+	syscall.EDQUOT: errorKindQuotaExceeded,
+}
+
+// s3ErrorErrnos errnos S3 error codes are reported to clients with
+var s3ErrorErrnos = map[string]syscall.Errno{
+	"NoSuchKey":         syscall.ENOENT,
+	"NoSuchBucket":      syscall.ENOENT,
+	"NotFound":          syscall.ENOENT,
+	"AccessDenied":      syscall.EPERM,
+	"AllAccessDisabled": syscall.EPERM,
+	"Forbidden":         syscall.EPERM,
+	"EntityTooLarge":    syscall.EDQUOT,
+}
+
+// permissionDenied returns an error for an operation not allowed to the user
+func permissionDenied(format string, args ...interface{}) error {
+	return errors.Wrapf(syscall.EPERM, format, args...)
+}
+
+// quotaExceeded returns an error for an upload going over the size allowed
+func quotaExceeded(format string, args ...interface{}) error {
+	return errors.Wrapf(syscall.EDQUOT, format, args...)
+}
+
+// errnoOf returns the errno an error is reported to clients with, or 0 if it's reported as a plain failure
+func errnoOf(err error) syscall.Errno {
+	cause := errors.Cause(err)
+	if aerr, ok := cause.(awserr.Error); ok {
+		return s3ErrorErrnos[aerr.Code()]
+	}
+	switch {
+	case os.IsNotExist(cause):
+		return syscall.ENOENT
+	case os.IsPermission(cause):
+		return syscall.EPERM
+	}
+	if pe, ok := cause.(*os.PathError); ok {
+		cause = pe.Err
+	}
+	if errno, ok := cause.(syscall.Errno); ok && errnoKinds[errno] != "" {
+		return errno
+	}
+	return 0
+}
+
+// sftpError translates an error raised by an operation over a path into one pkg/sftp reports to clients with
+// the matching status code, and counts it
+func sftpError(method string, path string, err error, log logrus.FieldLogger) error {
+	if err == nil || err == io.EOF {
+		return err
+	}
+	errno := errnoOf(err)
+	if errno == 0 {
+		mErrors.With(prometheus.Labels{"method": method, "kind": errorKindFailure}).Inc()
+		return err
+	}
+	kind := errnoKinds[errno]
+	mErrors.With(prometheus.Labels{"method": method, "kind": kind}).Inc()
+	log.WithFields(logrus.Fields{
+		"method":    method,
+		"path":      path,
+		"kind":      kind,
+		"exception": err,
+	}).Debug("Reporting error to client")
+	return &os.PathError{Op: method, Path: path, Err: errno}
+}
+
+// fileHandlers handlers of the operations over files
+type fileHandlers interface {
+	sftp.FileReader
+	sftp.FileWriter
+	sftp.FileCmder
+	sftp.FileLister
+}
+
+// statusHandlers translates the errors of file handlers, and of the readers, writers and listers they return,
+// so that clients get the matching status codes
+type statusHandlers struct {
+	handlers fileHandlers
+	Log      logrus.FieldLogger
+}
+
+// Fileread opens a file for reading
+func (sh *statusHandlers) Fileread(req *sftp.Request) (io.ReaderAt, error) {
+	r, err := sh.handlers.Fileread(req)
+	if err != nil {
+		return nil, sftpError(req.Method, req.Filepath, err, sh.Log)
+	}
+	return &statusReaderAt{r, req.Method, req.Filepath, sh.Log}, nil
+}
+
+// Filewrite opens a file for writing
+func (sh *statusHandlers) Filewrite(req *sftp.Request) (io.WriterAt, error) {
+	w, err := sh.handlers.Filewrite(req)
+	if err != nil {
+		return nil, sftpError(req.Method, req.Filepath, err, sh.Log)
+	}
+	return &statusWriterAt{w, req.Method, req.Filepath, sh.Log}, nil
+}
+
+// Filecmd executes a file command
+func (sh *statusHandlers) Filecmd(req *sftp.Request) error {
+	return sftpError(req.Method, req.Filepath, sh.handlers.Filecmd(req), sh.Log)
+}
+
+// Filelist lists or stats files
+func (sh *statusHandlers) Filelist(req *sftp.Request) (sftp.ListerAt, error) {
+	l, err := sh.handlers.Filelist(req)
+	if err != nil {
+		return nil, sftpError(req.Method, req.Filepath, err, sh.Log)
+	}
+	return &statusListerAt{l, req.Method, req.Filepath, sh.Log}, nil
+}
+
+type statusReaderAt struct {
+	r      io.ReaderAt
+	method string
+	path   string
+	log    logrus.FieldLogger
+}
+
+func (r *statusReaderAt) ReadAt(buf []byte, off int64) (int, error) {
+	n, err := r.r.ReadAt(buf, off)
+	return n, sftpError(r.method, r.path, err, r.log)
+}
+
+func (r *statusReaderAt) Close() error {
+	if c, ok := r.r.(io.Closer); ok {
+		return sftpError(r.method, r.path, c.Close(), r.log)
+	}
+	return nil
+}
+
+type statusWriterAt struct {
+	w      io.WriterAt
+	method string
+	path   string
+	log    logrus.FieldLogger
+}
+
+func (w *statusWriterAt) WriteAt(buf []byte, off int64) (int, error) {
+	n, err := w.w.WriteAt(buf, off)
+	return n, sftpError(w.method, w.path, err, w.log)
+}
+
+func (w *statusWriterAt) Close() error {
+	if c, ok := w.w.(io.Closer); ok {
+		return sftpError(w.method, w.path, c.Close(), w.log)
+	}
+	return nil
+}
+
+type statusListerAt struct {
+	l      sftp.ListerAt
+	method string
+	path   string
+	log    logrus.FieldLogger
+}
+
+func (l *statusListerAt) ListAt(result []os.FileInfo, off int64) (int, error) {
+	n, err := l.l.ListAt(result, off)
+	return n, sftpError(l.method, l.path, err, l.log)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	fake_log "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrnoOf(t *testing.T) {
+	cases := []struct {
+		err   error
+		errno syscall.Errno
+	}{
+		{awserr.New("NoSuchKey", "The specified key does not exist.", nil), syscall.ENOENT},
+		{awserr.New("NotFound", "Not Found", nil), syscall.ENOENT},
+		{awserr.New("AccessDenied", "Access Denied", nil), syscall.EPERM},
+		{awserr.New("EntityTooLarge", "Your proposed upload exceeds the maximum allowed size", nil), syscall.EDQUOT},
+		{awserr.New("InternalError", "We encountered an internal error.", nil), 0},
+		{os.ErrNotExist, syscall.ENOENT},
+		{os.ErrPermission, syscall.EPERM},
+		{&os.PathError{Op: "open", Path: "/tmp/missing", Err: syscall.ENOENT}, syscall.ENOENT},
+		{permissionDenied("read operation not allowed as per configuration"), syscall.EPERM},
+		{quotaExceeded("file too large: maximum allowed size is %d bytes", 10), syscall.EDQUOT},
+		{fmt.Errorf("unsupported method: %s", "Link"), 0},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.errno, errnoOf(c.err), c.err.Error())
+	}
+}
+
+func TestSFTPError(t *testing.T) {
+	log, _ := fake_log.NewNullLogger()
+	assert.Nil(t, sftpError("Get", "/file", nil, log))
+	assert.Equal(t, io.EOF, sftpError("Get", "/file", io.EOF, log))
+
+	failures := mErrors.With(prometheus.Labels{"method": "Get", "kind": errorKindFailure})
+	notFound := mErrors.With(prometheus.Labels{"method": "Get", "kind": errorKindNotFound})
+	failuresBefore, notFoundBefore := testutil.ToFloat64(failures), testutil.ToFloat64(notFound)
+
+	err := fmt.Errorf("trying to download an uploading file")
+	assert.Equal(t, err, sftpError("Get", "/file", err, log))
+	assert.Equal(t, failuresBefore+1, testutil.ToFloat64(failures))
+
+	err = sftpError("Get", "/file", awserr.New("NoSuchKey", "The specified key does not exist.", nil), log)
+	assert.Equal(t, &os.PathError{Op: "Get", Path: "/file", Err: syscall.ENOENT}, err)
+	assert.Equal(t, notFoundBefore+1, testutil.ToFloat64(notFound))
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	aws_s3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/sftp"
+	"github.com/sirupsen/logrus"
+)
+
+// StorageBackend storage the objects of a bucket config are kept in. S3BucketIO checks permissions and access rules,
+// then leaves the operations themselves to the backend. Keys include both the key prefix and the user root.
+type StorageBackend interface {
+	// Open opens an object for reading
+	Open(ctx context.Context, s3io *S3BucketIO, key Path, log logrus.FieldLogger) (io.ReaderAt, error)
+	// Create creates an object to be written. It shows up as the phantom object passed as parameter until
+	// the writer is closed, and it's stored under the key the phantom object has by then. When resume is true,
+	// an upload of the same key interrupted earlier is continued, if the backend supports it.
+	Create(ctx context.Context, s3io *S3BucketIO, info *PhantomObjectInfo, resume bool, requestMethod string, log logrus.FieldLogger) (io.WriterAt, error)
+	// Rename renames an object
+	Rename(ctx context.Context, src Path, dest Path, log logrus.FieldLogger) error
+	// Remove removes an object
+	Remove(ctx context.Context, key Path, log logrus.FieldLogger) error
+	// Mkdir creates a directory
+	Mkdir(ctx context.Context, key Path, log logrus.FieldLogger) error
+	// Rmdir removes a directory
+	Rmdir(ctx context.Context, key Path, log logrus.FieldLogger) error
+	// Stat obtains the file information of an object or directory
+	Stat(ctx context.Context, s3io *S3BucketIO, key Path, log logrus.FieldLogger) (sftp.ListerAt, error)
+	// List lists the objects and directories under a prefix
+	List(ctx context.Context, s3io *S3BucketIO, prefix Path, log logrus.FieldLogger) (sftp.ListerAt, error)
+}
+
+// S3Storage storage backed by an S3 bucket
+type S3Storage struct {
+	Bucket *S3Bucket
+}
+
+func (st *S3Storage) s3(log logrus.FieldLogger) (*aws_s3.S3, error) {
+	s3, err := st.Bucket.S3()
+	if err != nil {
+		log.WithField("exception", err).Error("Error connecting to AWS")
+		mAWSSessionError.Inc()
+		return nil, err
+	}
+	return s3, nil
+}
+
+// Open downloads an S3 object in streaming (using S3GetObjectOutputReader)
+func (st *S3Storage) Open(ctx context.Context, s3io *S3BucketIO, key Path, log logrus.FieldLogger) (io.ReaderAt, error) {
+	s3, err := st.s3(log)
+	if err != nil {
+		return nil, err
+	}
+	oor := &S3GetObjectOutputReader{
+		Ctx:                  ctx,
+		S3:                   s3,
+		Bucket:               st.Bucket.Bucket,
+		Key:                  key.String(),
+		ServerSideEncryption: &st.Bucket.ServerSideEncryption,
+		Log:                  log,
+		Lookback:             s3io.ReaderLookbackBufferSize,
+		MinChunkSize:         s3io.ReaderMinChunkSize,
+		ReadAhead:            s3io.ReadAhead,
+	}
+	if err := oor.Open(0); err != nil {
+		return nil, err
+	}
+	return oor, nil
+}
+
+// Create uploads an object to S3 (using S3MultipartUploadWriter)
+func (st *S3Storage) Create(ctx context.Context, s3io *S3BucketIO, info *PhantomObjectInfo, resume bool, requestMethod string, log logrus.FieldLogger) (io.WriterAt, error) {
+	s3, err := st.s3(log)
+	if err != nil {
+		return nil, err
+	}
+	maxObjectSize := st.Bucket.MaxObjectSize
+	if maxObjectSize < 0 {
+		maxObjectSize = int64(^uint(0) >> 1)
+	}
+	var stagingKey string
+	if len(st.Bucket.StagingPrefix) > 0 {
+		stagingKey, err = newStagingKey(st.Bucket.StagingPrefix)
+		if err != nil {
+			return nil, err
+		}
+	}
+	log.Debug("S3MultipartUploadWriter.New")
+	u := &S3MultipartUploadWriter{
+		Ctx:                    ctx,
+		Bucket:                 st.Bucket.Bucket,
+		Key:                    info.Key,
+		User:                   s3io.UserInfo.User,
+		S3:                     s3,
+		ServerSideEncryption:   &st.Bucket.ServerSideEncryption,
+		Log:                    log,
+		MaxObjectSize:          maxObjectSize,
+		UploadMemoryBufferPool: s3io.UploadMemoryBufferPool,
+		MaxPartBuffers:         s3io.UploadMaxPartBuffers,
+		UploadSpill:            s3io.UploadSpill,
+		StagingKey:             stagingKey,
+		ResumableUploads:       s3io.ResumableUploads,
+		SessionEnded:           s3io.SessionEnded,
+		PhantomObjectMap:       s3io.PhantomObjectMap,
+		Info:                   info,
+		RequestMethod:          requestMethod,
+		UploadChan:             s3io.UploadChan,
+	}
+	if s3io.ResumableUploads != nil {
+		if su := s3io.ResumableUploads.Take(st.Bucket.Bucket, u.User, info.Key); su != nil {
+			if resume {
+				u.resume(su)
+			} else {
+				// the file is truncated
+				su.discard()
+			}
+		}
+	}
+	return u, nil
+}
+
+// Rename copies an S3 object and deletes the original one
+func (st *S3Storage) Rename(ctx context.Context, src Path, dest Path, log logrus.FieldLogger) error {
+	s3, err := st.s3(log)
+	if err != nil {
+		return err
+	}
+	srcStr := src.String()
+	destStr := dest.String()
+	copySource := st.Bucket.Bucket + "/" + srcStr
+	sse := &st.Bucket.ServerSideEncryption
+	log.Debugf("CopyObject(dest=%s, Sse=%v)", destStr, sse.Type)
+	_, err = s3.CopyObjectWithContext(
+		ctx,
+		&aws_s3.CopyObjectInput{
+			ACL:                  &aclPrivate,
+			Bucket:               &st.Bucket.Bucket,
+			CopySource:           &copySource,
+			Key:                  &destStr,
+			ServerSideEncryption: sseTypes[sse.Type],
+			SSECustomerAlgorithm: nilIfEmpty(sse.CustomerAlgorithm()),
+			SSECustomerKey:       nilIfEmpty(sse.CustomerKey),
+			SSECustomerKeyMD5:    nilIfEmpty(sse.CustomerKeyMD5),
+			SSEKMSKeyId:          nilIfEmpty(sse.KMSKeyID),
+		},
+	)
+	if err != nil {
+		log.WithField("exception", err).Error("Error copying object")
+		return err
+	}
+	log.Debug("DeleteObject")
+	_, err = s3.DeleteObjectWithContext(
+		ctx,
+		&aws_s3.DeleteObjectInput{
+			Bucket: &st.Bucket.Bucket,
+			Key:    &srcStr,
+		},
+	)
+	if err != nil {
+		log.WithField("exception", err).Error("Error deleting object")
+		return err
+	}
+	return nil
+}
+
+// Remove deletes an S3 object
+func (st *S3Storage) Remove(ctx context.Context, key Path, log logrus.FieldLogger) error {
+	s3, err := st.s3(log)
+	if err != nil {
+		return err
+	}
+	keyStr := key.String()
+	log.Debug("DeleteObject")
+	_, err = s3.DeleteObjectWithContext(
+		ctx,
+		&aws_s3.DeleteObjectInput{
+			Bucket: &st.Bucket.Bucket,
+			Key:    &keyStr,
+		},
+	)
+	if err != nil {
+		log.WithField("exception", err).Error("Error deleting object")
+		return err
+	}
+	return nil
+}
+
+// Mkdir creates an empty S3 object whose key ends with a slash, which stands for a directory
+func (st *S3Storage) Mkdir(ctx context.Context, key Path, log logrus.FieldLogger) error {
+	s3, err := st.s3(log)
+	if err != nil {
+		return err
+	}
+	keyStr := fmt.Sprintf("%s/", key.String())
+	log.Debug("Mkdir")
+	_, err = s3.PutObject(
+		&aws_s3.PutObjectInput{
+			Bucket: &st.Bucket.Bucket,
+			Key:    &keyStr,
+		},
+	)
+	if err != nil {
+		log.WithField("exception", err).Error("Error creating directory")
+		return err
+	}
+	return nil
+}
+
+// Rmdir deletes the S3 object standing for a directory
+func (st *S3Storage) Rmdir(ctx context.Context, key Path, log logrus.FieldLogger) error {
+	s3, err := st.s3(log)
+	if err != nil {
+		return err
+	}
+	keyStr := fmt.Sprintf("%s/", key.String())
+	log.Debug("Rmdir")
+	_, err = s3.DeleteObject(
+		&aws_s3.DeleteObjectInput{
+			Bucket: &st.Bucket.Bucket,
+			Key:    &keyStr,
+		},
+	)
+	if err != nil {
+		log.WithField("exception", err).Error("Error deleting directory")
+		return err
+	}
+	return nil
+}
+
+// Stat obtains stat information from an S3 object (using S3ObjectStat)
+func (st *S3Storage) Stat(ctx context.Context, s3io *S3BucketIO, key Path, log logrus.FieldLogger) (sftp.ListerAt, error) {
+	s3, err := st.s3(log)
+	if err != nil {
+		return nil, err
+	}
+	return &S3ObjectStat{
+		Log:              log,
+		Ctx:              ctx,
+		Bucket:           st.Bucket.Bucket,
+		Root:             key.Equal(s3io.keyPrefix),
+		Key:              key,
+		S3:               s3,
+		PhantomObjectMap: s3io.PhantomObjectMap,
+	}, nil
+}
+
+// List lists the objects present on S3 under a prefix (using S3ObjectLister)
+func (st *S3Storage) List(ctx context.Context, s3io *S3BucketIO, prefix Path, log logrus.FieldLogger) (sftp.ListerAt, error) {
+	s3, err := st.s3(log)
+	if err != nil {
+		return nil, err
+	}
+	return &S3ObjectLister{
+		Log:              s3io.Log,
+		Ctx:              ctx,
+		Bucket:           st.Bucket.Bucket,
+		Prefix:           prefix,
+		S3:               s3,
+		Lookback:         s3io.ListerLookbackBufferSize,
+		PhantomObjectMap: s3io.PhantomObjectMap,
+	}, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	totpPeriod = 30 * time.Second
+	totpDigits = 6
+	// totpSkew number of periods before and after the current one accepted, to make up for clock drift
+	totpSkew = 1
+)
+
+// TOTP time-based one-time password generator (RFC 6238), as used by authenticator apps
+type TOTP struct {
+	secret []byte
+}
+
+// NewTOTP creates a new TOTP generator from a base32-encoded secret
+func NewTOTP(secret string) (*TOTP, error) {
+	secret = strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid base32-encoded TOTP secret")
+	}
+	if len(key) < 10 {
+		return nil, fmt.Errorf("TOTP secret must be at least 80 bits long")
+	}
+	return &TOTP{secret: key}, nil
+}
+
+// code computes the one-time password for a time step (RFC 4226)
+func (t *TOTP) code(step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, t.secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	v := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, v%1000000)
+}
+
+// Validate validates a one-time password at the time passed as parameter, and returns the time step it matches.
+// Only the steps after the last accepted one are considered, so that a password seen by someone else may not be
+// replayed.
+func (t *TOTP) Validate(code string, lastStep int64, now time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / int64(totpPeriod/time.Second)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step > lastStep && hmac.Equal([]byte(t.code(step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
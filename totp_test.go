@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// secret of the RFC 6238 test vectors ("12345678901234567890")
+var testTOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPValidate(t *testing.T) {
+	totp, err := NewTOTP(testTOTPSecret)
+	assert.NoError(t, err)
+	assert.Equal(t, "287082", totp.code(1))
+	assert.Equal(t, "081804", totp.code(37037036))
+
+	now := time.Unix(1111111109, 0)
+	_, ok := totp.Validate("000000", 0, now)
+	assert.False(t, ok)
+	step, ok := totp.Validate("081804", 0, now)
+	assert.True(t, ok)
+	assert.Equal(t, int64(37037036), step)
+	// codes may not be replayed
+	_, ok = totp.Validate("081804", step, now)
+	assert.False(t, ok)
+	// clock drift of a period is tolerated
+	step, ok = totp.Validate(totp.code(37037037), step, now)
+	assert.True(t, ok)
+	assert.Equal(t, int64(37037037), step)
+	_, ok = totp.Validate(totp.code(37037039), step, now)
+	assert.False(t, ok)
+
+	_, err = NewTOTP("not base32!")
+	assert.Error(t, err)
+	_, err = NewTOTP("GEZDGNBV")
+	assert.Error(t, err)
+	_, err = NewTOTP("gezd gnbv gy3t qojq gezd gnbv gy3t qojq")
+	assert.NoError(t, err)
+}
+
+func TestRequireTOTP(t *testing.T) {
+	totp, err := NewTOTP(testTOTPSecret)
+	assert.NoError(t, err)
+	u := &UserPlainTextPassword{UserWithPassword{name: "user1", password: "test", totp: totp}}
+	perms := &ssh.Permissions{Extensions: map[string]string{"pubkey-fp": "fp"}}
+	us := &UserStore{totp: newTOTPSteps()}
+	partialSuccess, ok := requireTOTP(us, u, perms).(*ssh.PartialSuccessError)
+	assert.True(t, ok)
+	cb := partialSuccess.Next.KeyboardInteractiveCallback
+	answer := func(code string) ssh.KeyboardInteractiveChallenge {
+		return func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			assert.Equal(t, []string{totpQuestion}, questions)
+			return []string{code}, nil
+		}
+	}
+	c := &fakeConnMetadata{user: "user1"}
+	_, err = cb(c, answer(totp.code(1)))
+	assert.Error(t, err)
+	code := totp.code(time.Now().Unix() / 30)
+	p, err := cb(c, answer(code))
+	assert.NoError(t, err)
+	assert.Equal(t, perms, p)
+	// codes may not be replayed, even once the user is built again
+	u = &UserPlainTextPassword{UserWithPassword{name: "user1", password: "test", totp: totp}}
+	assert.False(t, us.ValidateTOTP(u, code, time.Now()))
+	_, err = cb(c, answer(code))
+	assert.Error(t, err)
+	_, err = cb(c, func(string, string, []string, []bool) ([]string, error) { return nil, fmt.Errorf("disconnected") })
+	assert.Error(t, err)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// uploadSpillPrefix prefix of the files parts are staged in
+const uploadSpillPrefix = "s3-sftp-proxy-spill-"
+
+// UploadSpill directory parts of uploads are staged in when no memory buffer is left in the pool.
+// The space they take is bounded by a quota.
+type UploadSpill struct {
+	Dir   string
+	Quota int64
+	mtx   sync.Mutex
+	used  int64
+}
+
+// NewUploadSpill creates a new upload spill on the directory passed as parameter, which must exist.
+// Files left behind by a previous run are removed.
+func NewUploadSpill(dir string, quota int64) (*UploadSpill, error) {
+	st, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !st.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	sts, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, st := range sts {
+		if strings.HasPrefix(st.Name(), uploadSpillPrefix) {
+			os.Remove(filepath.Join(dir, st.Name()))
+		}
+	}
+	return &UploadSpill{Dir: dir, Quota: quota}, nil
+}
+
+// spillFile temporary file a part is staged in
+type spillFile struct {
+	*os.File
+	size  int64
+	spill *UploadSpill
+}
+
+// Create creates a temporary file for a part of the size passed as parameter, if the quota allows it
+func (us *UploadSpill) Create(size int64) (*spillFile, error) {
+	us.mtx.Lock()
+	if us.used+size > us.Quota {
+		us.mtx.Unlock()
+		mUploadSpillRejected.Inc()
+		return nil, fmt.Errorf("upload spill quota of %d bytes exceeded", us.Quota)
+	}
+	us.used += size
+	us.mtx.Unlock()
+
+	f, err := ioutil.TempFile(us.Dir, uploadSpillPrefix)
+	if err != nil {
+		us.release(size)
+		return nil, err
+	}
+	mUploadSpillBytes.Add(float64(size))
+	mUploadSpillParts.Inc()
+	mUploadSpillTotal.Inc()
+	return &spillFile{File: f, size: size, spill: us}, nil
+}
+
+func (us *UploadSpill) release(size int64) {
+	us.mtx.Lock()
+	defer us.mtx.Unlock()
+	us.used -= size
+}
+
+// Remove closes and removes the file, giving its size back to the quota
+func (f *spillFile) Remove() {
+	f.Close()
+	os.Remove(f.Name())
+	f.spill.release(f.size)
+	mUploadSpillBytes.Sub(float64(f.size))
+	mUploadSpillParts.Dec()
+}
@@ -1,11 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
 
+	"github.com/BurntSushi/toml"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/crypto/ssh"
 )
@@ -13,9 +20,14 @@ import (
 // User user interface used to authenticate users using several methods
 type User interface {
 	ValidatePassword(pwd []byte) bool
-	GetPublicKeys() []ssh.PublicKey
+	GetPublicKeys() []*AuthorizedKey
 	GetName() string
 	GetRootPath() string
+	GetPermsOverride() PermsOverride
+	GetACL() ACL
+	GetTOTP() *TOTP
+	GetAccountPolicy() *AccountPolicy
+	GetAddrFilter() *AddrFilter
 	HasPublicKeys() bool
 	HasPassword() bool
 }
@@ -25,13 +37,44 @@ type UserStore struct {
 	Name     string
 	Users    []User
 	usersMap map[string]User
+	dbFile   *userDBFile
+	webhook  *Webhook
+	caKeys   []ssh.PublicKey
+	totp     *totpSteps
+	log      logrus.FieldLogger
+	mtx      sync.RWMutex
+}
+
+// totpSteps last time steps one-time passwords were accepted at, by user name. They are kept apart from the
+// users, which are built again whenever they are reloaded.
+type totpSteps struct {
+	steps map[string]int64
+	mtx   sync.Mutex
+}
+
+func newTOTPSteps() *totpSteps {
+	return &totpSteps{steps: map[string]int64{}}
+}
+
+// userDBFile keeps track of the file users are loaded from, so that they can be reloaded when it changes
+type userDBFile struct {
+	path    string
+	modTime time.Time
+	size    int64
+}
+
+// userDBFileContent contents of an user DB file
+type userDBFileContent struct {
+	Users map[string]AuthUser `toml:"users"`
 }
 
 // UserInfo user information
 type UserInfo struct {
-	Addr     net.Addr
-	User     string
-	RootPath string
+	Addr          net.Addr
+	User          string
+	RootPath      string
+	PermsOverride PermsOverride
+	ACL           ACL
 }
 
 func (ui *UserInfo) String() string {
@@ -39,36 +82,170 @@ func (ui *UserInfo) String() string {
 }
 
 // UserStores map of stores of users
-type UserStores map[string]UserStore
+type UserStores map[string]*UserStore
 
 // Add adds a user to current store
 func (us *UserStore) Add(u User) {
+	us.mtx.Lock()
+	defer us.mtx.Unlock()
 	us.Users = append(us.Users, u)
 	us.usersMap[u.GetName()] = u
 }
 
+// IsRemote returns true if users are validated by an external service, and so any user name
+// may be found on current store
+func (us *UserStore) IsRemote() bool {
+	return us.webhook != nil
+}
+
 // Lookup gets a user from current store
 func (us *UserStore) Lookup(name string) User {
+	if us.webhook != nil {
+		return &UserWebhook{name: name, webhook: us.webhook}
+	}
+	if us.dbFile != nil {
+		us.reloadIfChanged()
+	}
+	us.mtx.RLock()
+	defer us.mtx.RUnlock()
 	u, _ := us.usersMap[name]
 	return u
 }
 
-func parseAuthorizedKeys(pubKeys []ssh.PublicKey, pubKeyFileContent []byte) ([]ssh.PublicKey, error) {
-	for len(pubKeyFileContent) > 0 {
-		var pubKey ssh.PublicKey
+// HasTrustedUserCAKeys wether user certificates may be used to authenticate users of current store
+func (us *UserStore) HasTrustedUserCAKeys() bool {
+	return us.caKeys != nil
+}
+
+// CheckCertificate validates a user certificate against the trusted user CA keys of current store.
+// Validity window, principals and critical options like source-address are checked.
+func (us *UserStore) CheckCertificate(c ssh.ConnMetadata, cert *ssh.Certificate) (*ssh.Permissions, error) {
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			authMarshaled := auth.Marshal()
+			for _, caKey := range us.caKeys {
+				if bytes.Equal(caKey.Marshal(), authMarshaled) {
+					return true
+				}
+			}
+			return false
+		},
+	}
+	if len(cert.ValidPrincipals) == 0 {
+		return nil, fmt.Errorf("certificate has no principals")
+	}
+	perms, err := checker.Authenticate(c, cert)
+	if err != nil {
+		return nil, err
+	}
+	// certificate extensions are not copied, as extensions are used to pass information to the server
+	return &ssh.Permissions{
+		CriticalOptions: perms.CriticalOptions,
+		Extensions: map[string]string{
+			"pubkey-fp": ssh.FingerprintSHA256(cert),
+		},
+	}, nil
+}
+
+// ValidateTOTP validates a one-time password of a user of current store. Each password is accepted once,
+// so that a password seen by someone else may not be replayed, even after the users are reloaded.
+func (us *UserStore) ValidateTOTP(u User, code string, now time.Time) bool {
+	us.totp.mtx.Lock()
+	defer us.totp.mtx.Unlock()
+	step, ok := u.GetTOTP().Validate(code, us.totp.steps[u.GetName()], now)
+	if ok {
+		us.totp.steps[u.GetName()] = step
+	}
+	return ok
+}
+
+// keepTOTPSteps makes current stores share the one-time password steps of the stores of the same name the
+// buckets passed as parameter are assigned to, so that passwords accepted before a reload may not be replayed
+func (uStores UserStores) keepTOTPSteps(buckets *S3Buckets) {
+	for _, bucket := range buckets.Buckets {
+		if uStore, ok := uStores[bucket.Users.Name]; ok && bucket.Users.totp != nil {
+			uStore.totp = bucket.Users.totp
+		}
+	}
+}
+
+// GetUsers gets a snapshot of the users present on current store
+func (us *UserStore) GetUsers() []User {
+	us.mtx.RLock()
+	defer us.mtx.RUnlock()
+	return us.Users
+}
+
+func (us *UserStore) setUsers(users []User) {
+	usersMap := map[string]User{}
+	for _, u := range users {
+		usersMap[u.GetName()] = u
+	}
+	us.mtx.Lock()
+	defer us.mtx.Unlock()
+	us.Users = users
+	us.usersMap = usersMap
+}
+
+// reloadIfChanged reloads the users from the user DB file if it was modified since last load.
+// If the new content is not valid, the previous users are kept.
+func (us *UserStore) reloadIfChanged() {
+	st, err := os.Stat(us.dbFile.path)
+	if err != nil {
+		us.log.WithField("exception", err).Errorf("Error checking user DB file %s", us.dbFile.path)
+		return
+	}
+	us.mtx.RLock()
+	changed := !st.ModTime().Equal(us.dbFile.modTime) || st.Size() != us.dbFile.size
+	us.mtx.RUnlock()
+	if !changed {
+		return
+	}
+	users, err := loadUsersFromDBFile(nil, us.dbFile.path)
+	us.mtx.Lock()
+	us.dbFile.modTime = st.ModTime()
+	us.dbFile.size = st.Size()
+	us.mtx.Unlock()
+	if err != nil {
+		us.log.WithField("exception", err).Errorf("Error reloading user DB file %s, keeping previous users", us.dbFile.path)
+		return
+	}
+	us.setUsers(users)
+	us.log.Infof("Reloaded %d users from user DB file %s", len(users), us.dbFile.path)
+}
+
+func loadTrustedUserCAKeys(aCfg *AuthConfig) ([]ssh.PublicKey, error) {
+	var caKeys []*AuthorizedKey
+	if aCfg.TrustedUserCAKeys != "" {
 		var err error
-		pubKey, _, _, pubKeyFileContent, err = ssh.ParseAuthorizedKey(pubKeyFileContent)
+		caKeys, err = parseAuthorizedKeys(caKeys, []byte(aCfg.TrustedUserCAKeys))
+		if err != nil {
+			return nil, errors.Wrapf(err, "trusted_user_ca_keys")
+		}
+	}
+	if aCfg.TrustedUserCAKeyFile != "" {
+		caKeysFileContent, err := ioutil.ReadFile(aCfg.TrustedUserCAKeyFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "trusted_user_ca_key_file")
+		}
+		caKeys, err = parseAuthorizedKeys(caKeys, caKeysFileContent)
 		if err != nil {
-			return pubKeys, err
+			return nil, errors.Wrapf(err, "trusted_user_ca_key_file")
 		}
-		pubKeys = append(pubKeys, pubKey)
+	}
+	if caKeys == nil {
+		return nil, nil
+	}
+	pubKeys := make([]ssh.PublicKey, len(caKeys))
+	for i, caKey := range caKeys {
+		pubKeys[i] = caKey.PublicKey
 	}
 	return pubKeys, nil
 }
 
-func buildUsersFromAuthConfigInplace(users []User, aCfg *AuthConfig) ([]User, error) {
-	for name, params := range aCfg.Users {
-		var pubKeys []ssh.PublicKey
+func buildUsersFromAuthUsers(users []User, authUsers map[string]AuthUser) ([]User, error) {
+	for name, params := range authUsers {
+		var pubKeys []*AuthorizedKey
 		if params.PublicKeys != "" {
 			var err error
 			pubKeys, err = parseAuthorizedKeys(pubKeys, []byte(params.PublicKeys))
@@ -87,24 +264,64 @@ func buildUsersFromAuthConfigInplace(users []User, aCfg *AuthConfig) ([]User, er
 				return users, errors.Wrapf(err, `user "%s"`, name)
 			}
 		}
-		switch params.AuthenticationMethod {
-		case "bcrypt":
-			users = append(users, &UserBcryptPassword{UserWithPassword{
-				name:       name,
-				password:   params.Password,
-				rootPath:   params.RootPath,
-				publicKeys: pubKeys,
-			},
-			})
-		default:
-			users = append(users, &UserPlainTextPassword{UserWithPassword{
-				name:       name,
-				password:   params.Password,
-				rootPath:   params.RootPath,
-				publicKeys: pubKeys,
-			},
-			})
+		acl, err := ParseACL(params.Rules)
+		if err != nil {
+			return users, errors.Wrapf(err, `user "%s"`, name)
+		}
+		if err := validatePathTemplate(SplitIntoPath(params.RootPath)); err != nil {
+			return users, errors.Wrapf(err, `user "%s": root path %s`, name, params.RootPath)
 		}
+		var totp *TOTP
+		if params.TOTPSecret != "" {
+			totp, err = NewTOTP(params.TOTPSecret)
+			if err != nil {
+				return users, errors.Wrapf(err, `user "%s"`, name)
+			}
+		}
+		accountPolicy := AccountPolicy{Disabled: params.Disabled}
+		if params.ExpiresAt != nil {
+			accountPolicy.ExpiresAt = params.ExpiresAt.Time
+		}
+		accountPolicy.Schedule, err = ParseSchedule(params.Schedule, params.ScheduleTimezone)
+		if err != nil {
+			return users, errors.Wrapf(err, `user "%s"`, name)
+		}
+		addrFilter, err := NewAddrFilter(params.AllowFrom, params.DenyFrom)
+		if err != nil {
+			return users, errors.Wrapf(err, `user "%s"`, name)
+		}
+		u, err := newUserWithHashedPassword(params.AuthenticationMethod, UserWithPassword{
+			name:          name,
+			password:      params.Password,
+			rootPath:      params.RootPath,
+			publicKeys:    pubKeys,
+			permsOverride: params.PermsOverride,
+			acl:           acl,
+			totp:          totp,
+			accountPolicy: accountPolicy,
+			addrFilter:    addrFilter,
+		})
+		if err != nil {
+			return users, errors.Wrapf(err, `user "%s"`, name)
+		}
+		users = append(users, u)
+	}
+	return users, nil
+}
+
+func buildUsersFromAuthConfigInplace(users []User, aCfg *AuthConfig) ([]User, error) {
+	return buildUsersFromAuthUsers(users, aCfg.Users)
+}
+
+func loadUsersFromDBFile(users []User, dbFile string) ([]User, error) {
+	content := userDBFileContent{}
+	_, err := toml.DecodeFile(dbFile, &content)
+	if err != nil {
+		return users, errors.Wrapf(err, "failed to parse user DB file %s", dbFile)
+	}
+	users, err = buildUsersFromAuthUsers(users, content.Users)
+	if err != nil {
+		return users, errors.Wrapf(err, "user DB file %s", dbFile)
 	}
 	return users, nil
 }
@@ -113,40 +330,63 @@ func buildUsersFromAuthConfig(users []User, aCfg *AuthConfig) ([]User, error) {
 	switch aCfg.Type {
 	case "inplace":
 		return buildUsersFromAuthConfigInplace(users, aCfg)
+	case "file":
+		return loadUsersFromDBFile(users, aCfg.UserDBFile)
+	case "webhook":
+		return users, nil
 	default:
 		return users, fmt.Errorf("unknown auth config type: %s", aCfg.Type)
 	}
 }
 
 // NewUserStoresFromConfig creates a new user stores based on configuration passed as parameter
-func NewUserStoresFromConfig(cfg *S3SFTPProxyConfig) (UserStores, error) {
+func NewUserStoresFromConfig(cfg *S3SFTPProxyConfig, log logrus.FieldLogger) (UserStores, error) {
 	uStores := UserStores{}
 	for name, aCfg := range cfg.AuthConfigs {
+		uStore := &UserStore{Name: name, totp: newTOTPSteps(), log: log.WithField("auth", name)}
+		if aCfg.Type == "file" {
+			st, err := os.Stat(aCfg.UserDBFile)
+			if err != nil {
+				return nil, errors.Wrapf(err, `auth config "%s"`, name)
+			}
+			uStore.dbFile = &userDBFile{path: aCfg.UserDBFile, modTime: st.ModTime(), size: st.Size()}
+		} else if aCfg.Type == "webhook" {
+			uStore.webhook = &Webhook{
+				Endpoint: aCfg.Endpoint.String(),
+				Client:   &http.Client{Timeout: aCfg.Timeout.Duration},
+			}
+		}
 		var err error
+		uStore.caKeys, err = loadTrustedUserCAKeys(aCfg)
+		if err != nil {
+			return nil, errors.Wrapf(err, `auth config "%s"`, name)
+		}
 		var users []User
 		users, err = buildUsersFromAuthConfig(users, aCfg)
 		if err != nil {
 			return nil, err
 		}
-		usersMap := map[string]User{}
-		for _, u := range users {
-			usersMap[u.GetName()] = u
-		}
-		uStores[name] = UserStore{Name: name, Users: users, usersMap: usersMap}
+		uStore.setUsers(users)
+		uStores[name] = uStore
 	}
 	return uStores, nil
 }
 
 // UserWithPassword user with password. Used as base struct for other users that has a password.
 type UserWithPassword struct {
-	name       string
-	password   string
-	rootPath   string
-	publicKeys []ssh.PublicKey
+	name          string
+	password      string
+	rootPath      string
+	publicKeys    []*AuthorizedKey
+	permsOverride PermsOverride
+	acl           ACL
+	totp          *TOTP
+	accountPolicy AccountPolicy
+	addrFilter    *AddrFilter
 }
 
 // GetPublicKeys gets public keys
-func (u *UserWithPassword) GetPublicKeys() []ssh.PublicKey {
+func (u *UserWithPassword) GetPublicKeys() []*AuthorizedKey {
 	return u.publicKeys
 }
 
@@ -160,6 +400,31 @@ func (u *UserWithPassword) GetRootPath() string {
 	return u.rootPath
 }
 
+// GetPermsOverride permissions overriding the ones of the bucket
+func (u *UserWithPassword) GetPermsOverride() PermsOverride {
+	return u.permsOverride
+}
+
+// GetACL access rules of the user, evaluated before the ones of the bucket
+func (u *UserWithPassword) GetACL() ACL {
+	return u.acl
+}
+
+// GetTOTP one-time password generator required as second factor, or nil if none is required
+func (u *UserWithPassword) GetTOTP() *TOTP {
+	return u.totp
+}
+
+// GetAccountPolicy restrictions on when the user may log in
+func (u *UserWithPassword) GetAccountPolicy() *AccountPolicy {
+	return &u.accountPolicy
+}
+
+// GetAddrFilter source addresses the user may log in from
+func (u *UserWithPassword) GetAddrFilter() *AddrFilter {
+	return u.addrFilter
+}
+
 // HasPublicKeys wether the user has public keys or not
 func (u *UserWithPassword) HasPublicKeys() bool {
 	return u.publicKeys != nil
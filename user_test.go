@@ -1,9 +1,18 @@
 package main
 
 import (
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
 	"testing"
+	"time"
 
+	"github.com/BurntSushi/toml"
+	fake_log "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
 )
 
 func TestUserBcryptPasswordValidation(t *testing.T) {
@@ -60,6 +69,7 @@ func TestUserPlainPasswordValidation(t *testing.T) {
 }
 
 func TestNewUserStoresFromConfigSeveralTypes(t *testing.T) {
+	log, _ := fake_log.NewNullLogger()
 	stores, err := NewUserStoresFromConfig(&S3SFTPProxyConfig{
 		AuthConfigs: map[string]*AuthConfig{
 			"test": &AuthConfig{
@@ -79,7 +89,7 @@ func TestNewUserStoresFromConfigSeveralTypes(t *testing.T) {
 				},
 			},
 		},
-	})
+	}, log)
 	us, _ := stores["test"]
 	assert.NoError(t, err)
 	assert.Equal(t, true, us.Lookup("user1").ValidatePassword([]byte("test")))
@@ -89,3 +99,149 @@ func TestNewUserStoresFromConfigSeveralTypes(t *testing.T) {
 	assert.Equal(t, true, us.Lookup("user3").ValidatePassword([]byte("test")))
 	assert.Equal(t, false, us.Lookup("user3").ValidatePassword([]byte("test2")))
 }
+
+func TestUserStoreFromDBFileReloadsOnChange(t *testing.T) {
+	f, err := ioutil.TempFile("", "s3-sftp-proxy-users")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(`
+[users.user1]
+password = "$2a$04$IdGko3VpUeqY/HEFv5olLOa/E.dswOKxSEivXDSYnvXLWRQyJSFOi"
+authentication_method = "bcrypt"
+root_path = "partners/user1"
+`)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	log, _ := fake_log.NewNullLogger()
+	stores, err := NewUserStoresFromConfig(&S3SFTPProxyConfig{
+		AuthConfigs: map[string]*AuthConfig{
+			"test": &AuthConfig{
+				Type:       "file",
+				UserDBFile: f.Name(),
+			},
+		},
+	}, log)
+	assert.NoError(t, err)
+	us := stores["test"]
+	assert.Equal(t, true, us.Lookup("user1").ValidatePassword([]byte("test")))
+	assert.Equal(t, "partners/user1", us.Lookup("user1").GetRootPath())
+	assert.Nil(t, us.Lookup("user2"))
+
+	assert.NoError(t, ioutil.WriteFile(f.Name(), []byte(`
+[users.user2]
+password = "test"
+`), 0600))
+	later := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(f.Name(), later, later))
+	assert.Nil(t, us.Lookup("user1"))
+	assert.Equal(t, true, us.Lookup("user2").ValidatePassword([]byte("test")))
+
+	// broken content keeps previous users
+	assert.NoError(t, ioutil.WriteFile(f.Name(), []byte(`[users.user3`), 0600))
+	later = later.Add(time.Minute)
+	assert.NoError(t, os.Chtimes(f.Name(), later, later))
+	assert.Equal(t, true, us.Lookup("user2").ValidatePassword([]byte("test")))
+}
+
+type fakeConnMetadata struct {
+	user string
+	addr net.Addr
+}
+
+func (c *fakeConnMetadata) User() string          { return c.user }
+func (c *fakeConnMetadata) SessionID() []byte     { return nil }
+func (c *fakeConnMetadata) ClientVersion() []byte { return nil }
+func (c *fakeConnMetadata) ServerVersion() []byte { return nil }
+func (c *fakeConnMetadata) RemoteAddr() net.Addr  { return c.addr }
+func (c *fakeConnMetadata) LocalAddr() net.Addr   { return c.addr }
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(priv)
+	assert.NoError(t, err)
+	return signer
+}
+
+func newTestCertificate(t *testing.T, ca ssh.Signer, principals []string, validBefore time.Time, criticalOptions map[string]string) *ssh.Certificate {
+	cert := &ssh.Certificate{
+		Key:             newTestSigner(t).PublicKey(),
+		CertType:        ssh.UserCert,
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(time.Now().Add(-time.Hour).Unix()),
+		ValidBefore:     uint64(validBefore.Unix()),
+		Permissions: ssh.Permissions{
+			CriticalOptions: criticalOptions,
+		},
+	}
+	assert.NoError(t, cert.SignCert(rand.Reader, ca))
+	return cert
+}
+
+func TestUserStoreCheckCertificate(t *testing.T) {
+	ca := newTestSigner(t)
+	log, _ := fake_log.NewNullLogger()
+	stores, err := NewUserStoresFromConfig(&S3SFTPProxyConfig{
+		AuthConfigs: map[string]*AuthConfig{
+			"test": &AuthConfig{
+				Type: "inplace",
+				Users: map[string]AuthUser{
+					"user1": AuthUser{},
+				},
+				TrustedUserCAKeys: string(ssh.MarshalAuthorizedKey(ca.PublicKey())),
+			},
+		},
+	}, log)
+	assert.NoError(t, err)
+	us := stores["test"]
+	assert.True(t, us.HasTrustedUserCAKeys())
+
+	c := &fakeConnMetadata{user: "user1", addr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 50000}}
+	later := time.Now().Add(time.Hour)
+
+	perms, err := us.CheckCertificate(c, newTestCertificate(t, ca, []string{"user1"}, later, nil))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, perms.Extensions["pubkey-fp"])
+
+	perms, err = us.CheckCertificate(c, newTestCertificate(t, ca, []string{"user1"}, later, map[string]string{"source-address": "192.0.2.0/24"}))
+	assert.NoError(t, err)
+	assert.Equal(t, "192.0.2.0/24", perms.CriticalOptions["source-address"])
+
+	_, err = us.CheckCertificate(c, newTestCertificate(t, ca, []string{"user2"}, later, nil))
+	assert.Error(t, err)
+	_, err = us.CheckCertificate(c, newTestCertificate(t, ca, nil, later, nil))
+	assert.Error(t, err)
+	_, err = us.CheckCertificate(c, newTestCertificate(t, ca, []string{"user1"}, time.Now().Add(-time.Minute), nil))
+	assert.Error(t, err)
+	_, err = us.CheckCertificate(c, newTestCertificate(t, newTestSigner(t), []string{"user1"}, later, nil))
+	assert.Error(t, err)
+	_, err = us.CheckCertificate(c, newTestCertificate(t, ca, []string{"user1"}, later, map[string]string{"force-command": "true"}))
+	assert.Error(t, err)
+}
+
+func TestUserPermsOverride(t *testing.T) {
+	content := userDBFileContent{}
+	_, err := toml.Decode(`
+[users.user1]
+password = "test"
+writable = true
+deletable = false
+
+[users.user2]
+password = "test"
+`, &content)
+	assert.NoError(t, err)
+	users, err := buildUsersFromAuthUsers(nil, content.Users)
+	assert.NoError(t, err)
+	us := &UserStore{}
+	us.setUsers(users)
+
+	bucketPerms := Perms{Readable: true, Writable: false, Listable: true, Deletable: false}
+	assert.Equal(t, Perms{Readable: true, Writable: true, Listable: true, Deletable: false}, bucketPerms.Apply(us.Lookup("user1").GetPermsOverride()))
+	assert.Equal(t, bucketPerms, bucketPerms.Apply(us.Lookup("user2").GetPermsOverride()))
+
+	// key restrictions take precedence over the user ones
+	keyOverride := PermsOverride{Writable: &vFalse}
+	assert.Equal(t, bucketPerms, bucketPerms.Apply(us.Lookup("user1").GetPermsOverride().Merge(keyOverride)))
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// RemoteUser user whose credentials are validated by an external service on every login attempt
+type RemoteUser interface {
+	User
+	Authenticate(addr net.Addr, pwd []byte, key ssh.PublicKey) (*RemoteAuthResult, error)
+}
+
+// RemoteAuthResult information returned by an external authentication service about an authenticated user
+type RemoteAuthResult struct {
+	PermsOverride
+	RootPath string `json:"root_path"`
+	Bucket   string `json:"bucket"`
+}
+
+// WebhookRequest request body sent to the webhook endpoint
+type WebhookRequest struct {
+	Username             string `json:"username"`
+	RemoteAddr           string `json:"remote_addr"`
+	Password             string `json:"password,omitempty"`
+	PublicKeyFingerprint string `json:"public_key_fingerprint,omitempty"`
+	Certificate          bool   `json:"certificate,omitempty"`
+}
+
+// Webhook external authentication service reached through HTTP
+type Webhook struct {
+	Endpoint string
+	Client   *http.Client
+}
+
+var errWebhookDenied = fmt.Errorf("authentication denied by webhook")
+
+// Authenticate asks the webhook endpoint whether the credentials are valid.
+// Responses with status 200 grant access, 401 and 403 deny it and any other status is considered an error.
+func (wh *Webhook) Authenticate(req *WebhookRequest) (*RemoteAuthResult, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := wh.Client.Post(wh.Endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to call webhook")
+	}
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return nil, errWebhookDenied
+	default:
+		return nil, fmt.Errorf("unexpected webhook response status: %s", resp.Status)
+	}
+	result := &RemoteAuthResult{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse webhook response")
+	}
+	return result, nil
+}
+
+// UserWebhook user validated through a webhook
+type UserWebhook struct {
+	name    string
+	webhook *Webhook
+}
+
+// Authenticate validates either the password or the public key offered by the user. Public keys may be user
+// certificates already validated against the trusted CA keys, whose principal is the user name.
+func (u *UserWebhook) Authenticate(addr net.Addr, pwd []byte, key ssh.PublicKey) (*RemoteAuthResult, error) {
+	req := &WebhookRequest{
+		Username: u.name,
+		Password: string(pwd),
+	}
+	if addr != nil {
+		req.RemoteAddr = addr.String()
+	}
+	if key != nil {
+		req.PublicKeyFingerprint = ssh.FingerprintSHA256(key)
+		_, req.Certificate = key.(*ssh.Certificate)
+	}
+	return u.webhook.Authenticate(req)
+}
+
+// ValidatePassword validates a password without knowing the remote address
+func (u *UserWebhook) ValidatePassword(pwd []byte) bool {
+	_, err := u.Authenticate(nil, pwd, nil)
+	return err == nil
+}
+
+// GetPublicKeys public keys are not known beforehand, so none is returned
+func (u *UserWebhook) GetPublicKeys() []*AuthorizedKey {
+	return nil
+}
+
+// GetName gets user name
+func (u *UserWebhook) GetName() string {
+	return u.name
+}
+
+// GetRootPath root path is given by the webhook response, so it's empty
+func (u *UserWebhook) GetRootPath() string {
+	return ""
+}
+
+// GetPermsOverride permissions are given by the webhook response, so none is overridden
+func (u *UserWebhook) GetPermsOverride() PermsOverride {
+	return PermsOverride{}
+}
+
+// GetACL no access rules are given by the webhook
+func (u *UserWebhook) GetACL() ACL {
+	return nil
+}
+
+// GetTOTP second factors are left to the webhook
+func (u *UserWebhook) GetTOTP() *TOTP {
+	return nil
+}
+
+// GetAccountPolicy accounts are managed by the webhook, so no restrictions apply here
+func (u *UserWebhook) GetAccountPolicy() *AccountPolicy {
+	return &AccountPolicy{}
+}
+
+// GetAddrFilter source addresses are checked by the webhook
+func (u *UserWebhook) GetAddrFilter() *AddrFilter {
+	return nil
+}
+
+// HasPublicKeys public keys may be validated by the webhook
+func (u *UserWebhook) HasPublicKeys() bool {
+	return true
+}
+
+// HasPassword passwords may be validated by the webhook
+func (u *UserWebhook) HasPassword() bool {
+	return true
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	fake_log "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+var testAuthorizedKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGrU1ysDQKHAPcfyH4yZ1bOIFKT2GkgSYbB8mAWCBAuZ"
+
+func newTestWebhookServer(t *testing.T, requests *[]WebhookRequest) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := WebhookRequest{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		*requests = append(*requests, req)
+		switch {
+		case req.Username == "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		case req.Username == "blocked":
+			w.WriteHeader(http.StatusForbidden)
+		case req.Password == "test":
+			w.Write([]byte(`{"root_path": "partners/user1", "bucket": "other", "writable": false}`))
+		case req.PublicKeyFingerprint != "":
+			w.Write([]byte(`{"root_path": "partners/user1"}`))
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+}
+
+func TestUserWebhookAuthenticate(t *testing.T) {
+	requests := []WebhookRequest{}
+	srv := newTestWebhookServer(t, &requests)
+	defer srv.Close()
+
+	endpoint := &URL{}
+	assert.NoError(t, endpoint.UnmarshalText([]byte(srv.URL)))
+	log, _ := fake_log.NewNullLogger()
+	stores, err := NewUserStoresFromConfig(&S3SFTPProxyConfig{
+		AuthConfigs: map[string]*AuthConfig{
+			"test": &AuthConfig{
+				Type:     "webhook",
+				Endpoint: endpoint,
+				Timeout:  &duration{defaultWebhookTimeout},
+			},
+		},
+	}, log)
+	assert.NoError(t, err)
+	us := stores["test"]
+	assert.True(t, us.IsRemote())
+
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 50000}
+	u := us.Lookup("user1").(RemoteUser)
+	res, err := u.Authenticate(addr, []byte("test"), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "partners/user1", res.RootPath)
+	assert.Equal(t, "other", res.Bucket)
+	assert.Equal(t, Perms{Readable: true, Writable: false, Listable: true}, Perms{Readable: true, Writable: true, Listable: true}.Apply(res.PermsOverride))
+	assert.Equal(t, WebhookRequest{Username: "user1", RemoteAddr: "192.0.2.1:50000", Password: "test"}, requests[0])
+
+	_, err = u.Authenticate(addr, []byte("test2"), nil)
+	assert.Equal(t, errWebhookDenied, err)
+
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(testAuthorizedKey))
+	assert.NoError(t, err)
+	res, err = u.Authenticate(addr, nil, key)
+	assert.NoError(t, err)
+	assert.Equal(t, "", res.Bucket)
+	assert.Equal(t, ssh.FingerprintSHA256(key), requests[2].PublicKeyFingerprint)
+	assert.Equal(t, "", requests[2].Password)
+
+	_, err = us.Lookup("broken").(RemoteUser).Authenticate(addr, []byte("test"), nil)
+	assert.Error(t, err)
+	assert.NotEqual(t, errWebhookDenied, err)
+}
+
+func TestPermsOverrideEncoding(t *testing.T) {
+	for _, o := range []PermsOverride{{}, {Readable: &vTrue}, {Writable: &vFalse, Listable: &vTrue}, {&vFalse, &vFalse, &vFalse, &vFalse}} {
+		assert.Equal(t, o, ParsePermsOverride(o.String()))
+	}
+	assert.Equal(t, "+r-w", PermsOverride{Readable: &vTrue, Writable: &vFalse}.String())
+}
+
+func TestAuthenticateCertificateWithWebhook(t *testing.T) {
+	requests := []WebhookRequest{}
+	srv := newTestWebhookServer(t, &requests)
+	defer srv.Close()
+
+	endpoint := &URL{}
+	assert.NoError(t, endpoint.UnmarshalText([]byte(srv.URL)))
+	log, _ := fake_log.NewNullLogger()
+	ca := newTestSigner(t)
+	stores, err := NewUserStoresFromConfig(&S3SFTPProxyConfig{
+		AuthConfigs: map[string]*AuthConfig{
+			"test": &AuthConfig{
+				Type:              "webhook",
+				Endpoint:          endpoint,
+				Timeout:           &duration{defaultWebhookTimeout},
+				TrustedUserCAKeys: string(ssh.MarshalAuthorizedKey(ca.PublicKey())),
+			},
+		},
+	}, log)
+	assert.NoError(t, err)
+	bucket := &S3Bucket{Name: "test", Users: stores["test"]}
+	buckets := &S3Buckets{Buckets: map[string]*S3Bucket{"test": bucket}}
+
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 50000}
+	later := time.Now().Add(time.Hour)
+	cert := newTestCertificate(t, ca, []string{"user1"}, later, map[string]string{"source-address": "192.0.2.0/24"})
+	perms, err := authenticateCertificate(buckets, bucket, bucket.Users.Lookup("user1"), &fakeConnMetadata{user: "user1", addr: addr}, log, cert)
+	assert.NoError(t, err)
+	// the permissions of the certificate and the ones given by the webhook are merged
+	assert.Equal(t, "192.0.2.0/24", perms.CriticalOptions["source-address"])
+	assert.Equal(t, ssh.FingerprintSHA256(cert), perms.Extensions["pubkey-fp"])
+	assert.Equal(t, "partners/user1", perms.Extensions["root-path"])
+	assert.Equal(t, WebhookRequest{Username: "user1", RemoteAddr: "192.0.2.1:50000", PublicKeyFingerprint: ssh.FingerprintSHA256(cert), Certificate: true}, requests[0])
+
+	// certificates signed by a trusted CA don't get past the webhook
+	cert = newTestCertificate(t, ca, []string{"blocked"}, later, nil)
+	_, err = authenticateCertificate(buckets, bucket, bucket.Users.Lookup("blocked"), &fakeConnMetadata{user: "blocked", addr: addr}, log, cert)
+	assert.Equal(t, errWebhookDenied, errors.Cause(err))
+	assert.Len(t, requests, 2)
+
+	// nor is the webhook asked about certificates that aren't
+	cert = newTestCertificate(t, newTestSigner(t), []string{"user1"}, later, nil)
+	_, err = authenticateCertificate(buckets, bucket, bucket.Users.Lookup("user1"), &fakeConnMetadata{user: "user1", addr: addr}, log, cert)
+	assert.Error(t, err)
+	assert.Len(t, requests, 2)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// FileInfoLister lister over a fixed list of file information
+type FileInfoLister []os.FileInfo
+
+// ListAt copies the file information present from the offset passed as parameter into the result array
+func (fil FileInfoLister) ListAt(result []os.FileInfo, o int64) (int, error) {
+	if o >= int64(len(fil)) {
+		return 0, io.EOF
+	}
+	n := copy(result, fil[o:])
+	if o+int64(n) >= int64(len(fil)) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// VirtualRootIO represents IO operations over a virtual root directory holding several buckets,
+// each one of them mounted on a top-level directory named after its bucket config
+type VirtualRootIO struct {
+	Mounts     map[string]*S3BucketIO
+	Log        logrus.FieldLogger
+	mountNames []string
+}
+
+// NewVirtualRootIO creates a new instance of VirtualRootIO mounting the buckets IOs passed as parameter
+func NewVirtualRootIO(mounts []*S3BucketIO, log logrus.FieldLogger) *VirtualRootIO {
+	vr := &VirtualRootIO{
+		Mounts: map[string]*S3BucketIO{},
+		Log:    log,
+	}
+	for _, s3io := range mounts {
+		s3io.mountPoint = Path{"", s3io.Bucket.Name}
+		vr.Mounts[s3io.Bucket.Name] = s3io
+		vr.mountNames = append(vr.mountNames, s3io.Bucket.Name)
+	}
+	sort.Strings(vr.mountNames)
+	return vr
+}
+
+// lookup gets the bucket IO a path is mounted on. The path passed as parameter is absolute.
+// Top-level directories (mount points) are reported through the isMountPoint return value.
+func (vr *VirtualRootIO) lookup(path string) (s3io *S3BucketIO, isMountPoint bool) {
+	p := SplitIntoPath(path)
+	if len(p) < 2 {
+		return nil, false
+	}
+	s3io, _ = vr.Mounts[p[1]]
+	return s3io, len(p) == 2
+}
+
+// lookupInside gets the bucket IO a path is mounted on, as long as the path is not a mount point itself
+func (vr *VirtualRootIO) lookupInside(req *sftp.Request) (*S3BucketIO, error) {
+	s3io, isMountPoint := vr.lookup(req.Filepath)
+	if s3io == nil || isMountPoint {
+		mOperationStatus.With(prometheus.Labels{"method": req.Method, "status": "failure"}).Inc()
+		vr.Log.WithField("method", req.Method).Errorf("Operation not allowed outside a mounted bucket: %s", req.Filepath)
+		return nil, os.ErrPermission
+	}
+	return s3io, nil
+}
+
+// Fileread downloads an S3 object from the bucket the file is mounted on
+func (vr *VirtualRootIO) Fileread(req *sftp.Request) (io.ReaderAt, error) {
+	s3io, err := vr.lookupInside(req)
+	if err != nil {
+		return nil, err
+	}
+	return s3io.Fileread(req)
+}
+
+// Filewrite uploads a file to the bucket it is mounted on
+func (vr *VirtualRootIO) Filewrite(req *sftp.Request) (io.WriterAt, error) {
+	s3io, err := vr.lookupInside(req)
+	if err != nil {
+		return nil, err
+	}
+	return s3io.Filewrite(req)
+}
+
+// Filecmd executes a file command on the bucket the file is mounted on. Files may not be renamed across buckets.
+func (vr *VirtualRootIO) Filecmd(req *sftp.Request) error {
+	s3io, err := vr.lookupInside(req)
+	if err != nil {
+		return err
+	}
+	if req.Method == "Rename" {
+		dest, isMountPoint := vr.lookup(req.Target)
+		if dest != s3io || isMountPoint {
+			mOperationStatus.With(prometheus.Labels{"method": req.Method, "status": "failure"}).Inc()
+			vr.Log.WithField("method", req.Method).Errorf("Renaming across buckets is not supported: %s to %s", req.Filepath, req.Target)
+			return fmt.Errorf("renaming across buckets is not supported")
+		}
+	}
+	return s3io.Filecmd(req)
+}
+
+func (vr *VirtualRootIO) mountPointFileInfo(name string) os.FileInfo {
+	return &ObjectFileInfo{
+		_Name:         name,
+		_LastModified: time.Unix(1, 0),
+		_Size:         0,
+		_Mode:         0755 | os.ModeDir,
+	}
+}
+
+// Filelist lists the mount points on the virtual root, or dispatches the operation to the bucket the path is mounted on
+func (vr *VirtualRootIO) Filelist(req *sftp.Request) (sftp.ListerAt, error) {
+	s3io, isMountPoint := vr.lookup(req.Filepath)
+	switch {
+	case SplitIntoPath(req.Filepath).IsRoot():
+		switch req.Method {
+		case "List":
+			vr.Log.WithField("method", req.Method).Info("User listed virtual root")
+			fil := FileInfoLister{vr.mountPointFileInfo("."), vr.mountPointFileInfo("..")}
+			for _, name := range vr.mountNames {
+				fil = append(fil, vr.mountPointFileInfo(name))
+			}
+			mOperationStatus.With(prometheus.Labels{"method": "Ls", "status": "success"}).Inc()
+			return fil, nil
+		default:
+			return FileInfoLister{vr.mountPointFileInfo("/")}, nil
+		}
+	case s3io == nil:
+		mOperationStatus.With(prometheus.Labels{"method": req.Method, "status": "noSuchObject"}).Inc()
+		return nil, os.ErrNotExist
+	case isMountPoint && req.Method != "List":
+		return FileInfoLister{vr.mountPointFileInfo(s3io.Bucket.Name)}, nil
+	default:
+		return s3io.Filelist(req)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/pkg/sftp"
+	fake_log "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestVirtualRootIO() *VirtualRootIO {
+	log, _ := fake_log.NewNullLogger()
+	userInfo := &UserInfo{User: "user1", RootPath: "users/user1"}
+	mounts := []*S3BucketIO{}
+	for _, name := range []string{"outbox", "inbox"} {
+		bucket := &S3Bucket{
+			Name:      name,
+			Bucket:    name + "-bucket",
+			KeyPrefix: Path{"prefix"},
+			Perms:     Perms{Readable: true, Writable: true, Listable: true},
+		}
+		s3io, _ := NewS3BucketIO(context.Background(), bucket, userInfo, S3BucketIOOptions{}, log)
+		mounts = append(mounts, s3io)
+	}
+	return NewVirtualRootIO(mounts, log)
+}
+
+func TestVirtualRootIOListRoot(t *testing.T) {
+	vr := newTestVirtualRootIO()
+	lister, err := vr.Filelist(sftp.NewRequest("List", "/"))
+	assert.NoError(t, err)
+	result := make([]os.FileInfo, 10)
+	n, err := lister.ListAt(result, 0)
+	assert.Equal(t, io.EOF, err)
+	names := []string{}
+	for _, fi := range result[:n] {
+		assert.True(t, fi.IsDir())
+		names = append(names, fi.Name())
+	}
+	assert.Equal(t, []string{".", "..", "inbox", "outbox"}, names)
+
+	lister, err = vr.Filelist(sftp.NewRequest("Stat", "/inbox"))
+	assert.NoError(t, err)
+	n, _ = lister.ListAt(result, 0)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, "inbox", result[0].Name())
+	assert.True(t, result[0].IsDir())
+
+	_, err = vr.Filelist(sftp.NewRequest("Stat", "/unknown/file"))
+	assert.Equal(t, os.ErrNotExist, err)
+}
+
+func TestVirtualRootIODispatch(t *testing.T) {
+	vr := newTestVirtualRootIO()
+	assert.Equal(t, Path{"prefix", "users", "user1", "a", "b"}, vr.Mounts["inbox"].buildKey("/inbox/a/b"))
+	assert.Equal(t, Path{"prefix", "users", "user1"}, vr.Mounts["outbox"].buildKey("/outbox"))
+
+	_, err := vr.Filewrite(sftp.NewRequest("Put", "/file"))
+	assert.Equal(t, os.ErrPermission, err)
+	_, err = vr.Filewrite(sftp.NewRequest("Put", "/inbox"))
+	assert.Equal(t, os.ErrPermission, err)
+	assert.Equal(t, os.ErrPermission, vr.Filecmd(sftp.NewRequest("Mkdir", "/newdir")))
+
+	req := sftp.NewRequest("Rename", "/inbox/file")
+	req.Target = "/outbox/file"
+	assert.Error(t, vr.Filecmd(req))
+}